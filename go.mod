@@ -11,6 +11,8 @@ require (
 	github.com/pkg/profile v1.7.0
 	github.com/x448/float16 v0.8.4
 	golang.org/x/exp v0.0.0-20230321023759-10a507213a29
+	golang.org/x/sys v0.7.0
+	golang.org/x/text v0.8.0
 )
 
 require (
@@ -32,8 +34,6 @@ require (
 	github.com/valyala/fasthttp v1.45.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	golang.org/x/net v0.8.0 // indirect
-	golang.org/x/sys v0.7.0 // indirect
-	golang.org/x/text v0.8.0 // indirect
 	google.golang.org/genproto v0.0.0-20230306155012-7f2fa6fef1f4 // indirect
 	google.golang.org/grpc v1.55.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +20,7 @@ import (
 
 	"github.com/extrame/llama.go/pkg/grpc"
 	"github.com/extrame/llama.go/pkg/llama"
+	"github.com/extrame/llama.go/pkg/ml"
 	"github.com/extrame/llama.go/pkg/server"
 	"github.com/extrame/llama.go/pkg/utils"
 )
@@ -23,23 +28,59 @@ import (
 const VERSION = "1.4.0"
 
 type Options struct {
-	Prompt  string  `long:"prompt" description:"Text prompt from user to feed the model input"`
-	Model   string  `long:"model" description:"Path and file name of converted .bin LLaMA model [ llama-7b-fp32.bin, etc ]"`
-	Server  bool    `long:"server" description:"Start in Server Mode acting as REST API endpoint"`
-	Grpc    bool    `long:"grpc" description:"Start in Grpc Server Mode acting as Grpc API endpoint"`
-	Host    string  `long:"host" description:"Host to allow requests from in Server Mode [ localhost by default ]"`
-	Port    string  `long:"port" description:"Port listen to in Server Mode [ 8080 by default ]"`
-	Pods    int64   `long:"pods" description:"Maximum pods or units of parallel execution allowed in Server Mode [ 1 by default ]"`
-	Threads int     `long:"threads" description:"Max number of CPU cores you allow to use for one pod [ all cores by default ]"`
-	Context uint32  `long:"context" description:"Context size in tokens [ 1024 by default ]"`
-	Predict uint32  `long:"predict" description:"Number of tokens to predict [ 512 by default ]"`
-	Temp    float32 `long:"temp" description:"Model temperature hyper parameter [ 0.50 by default ]"`
-	Silent  bool    `long:"silent" description:"Hide welcome logo and other output [ shown by default ]"`
-	Chat    bool    `long:"chat" description:"Chat with user in interactive mode instead of compute over static prompt"`
-	Dir     string  `long:"dir" description:"Directory used to download .bin model specified with --model parameter [ current by default ]"`
-	Profile bool    `long:"profile" description:"Profe CPU performance while running and store results to cpu.pprof file"`
-	UseAVX  bool    `long:"avx" description:"Enable x64 AVX2 optimizations for Intel and AMD machines"`
-	UseNEON bool    `long:"neon" description:"Enable ARM NEON optimizations for Apple and ARM machines"`
+	Prompt      string   `long:"prompt" description:"Text prompt from user to feed the model input"`
+	Model       string   `long:"model" description:"Path and file name of converted .bin LLaMA model [ llama-7b-fp32.bin, etc ]"`
+	Server      bool     `long:"server" description:"Start in Server Mode acting as REST API endpoint"`
+	Grpc        bool     `long:"grpc" description:"Start in Grpc Server Mode acting as Grpc API endpoint"`
+	Host        string   `long:"host" description:"Host to allow requests from in Server Mode [ localhost by default ]"`
+	Port        string   `long:"port" description:"Port listen to in Server Mode [ 8080 by default ]"`
+	Pods        int64    `long:"pods" description:"Maximum pods or units of parallel execution allowed in Server Mode [ 1 by default ]"`
+	Threads     int      `long:"threads" description:"Max number of CPU cores you allow to use for one pod [ all cores by default ]"`
+	Context     uint32   `long:"context" description:"Context size in tokens [ 1024 by default ]"`
+	Predict     uint32   `long:"predict" description:"Number of tokens to predict [ 512 by default ]"`
+	Temp        float32  `long:"temp" description:"Model temperature hyper parameter [ 0.50 by default ]"`
+	Silent      bool     `long:"silent" description:"Hide welcome logo and other output [ shown by default ]"`
+	Chat        bool     `long:"chat" description:"Chat with user in interactive mode instead of compute over static prompt"`
+	Dir         string   `long:"dir" description:"Directory used to download .bin model specified with --model parameter [ current by default ]"`
+	Profile     bool     `long:"profile" description:"Profe CPU performance while running and store results to cpu.pprof file"`
+	UseAVX      bool     `long:"avx" description:"Enable x64 AVX2 optimizations for Intel and AMD machines"`
+	UseNEON     bool     `long:"neon" description:"Enable ARM NEON optimizations for Apple and ARM machines"`
+	MMap        bool     `long:"mmap" description:"Map model file into memory instead of reading it, so processes share one copy of weights"`
+	MLock       bool     `long:"mlock" description:"Lock mapped model in memory to prevent swapping, works together with --mmap"`
+	Lora        []string `long:"lora" description:"LoRA adapter merged into the model, scale might follow the path like adapter.bin:0.5 [ could be repeated ]"`
+	Adapter     []string `long:"adapter" description:"LoRA adapter jobs could choose by name in Server Mode, like name=adapter.bin:0.5 [ could be repeated ]"`
+	RopeBase    float32  `long:"rope-base" description:"RoPE base frequency [ taken from the model, 10000.0 for LLaMA ]"`
+	RopeScale   float32  `long:"rope-scale" description:"How many times to extend the context the model was trained with, like 4.0 for 8k context of LLaMA-2"`
+	RopeScaling string   `long:"rope-scaling" description:"RoPE scaling used with --rope-scale: none, linear, ntk or yarn [ taken from the model or linear ]"`
+	Out         string   `long:"out" description:"Path and file name of the resulting model for quantize command"`
+	Type        string   `long:"type" description:"Type of weights for quantize command: q8_0, q4_0, q4_1 or f16 [ q8_0 by default ]"`
+	Special     bool     `long:"special" description:"Turn the text of special tokens like </s> into their ids with tokenize command"`
+	MemTest     bool     `long:"memtest" description:"Show peak memory of temporary tensors for the context size and exit"`
+}
+
+// commands are special modes selected with the first argument instead of prompt processing
+var commands = map[string]bool{
+	"load":     true,
+	"quantize": true,
+	"info":     true,
+	"tokenize": true,
+}
+
+// typeNames are short names of data types
+var typeNames = map[ml.DType]string{
+	ml.TYPE_F32:  "f32",
+	ml.TYPE_F16:  "f16",
+	ml.TYPE_Q4_0: "q4_0",
+	ml.TYPE_Q4_1: "q4_1",
+	ml.TYPE_Q8_0: "q8_0",
+}
+
+// weightTypes are data types allowed for quantize command
+var weightTypes = map[string]ml.DType{
+	"f16":  ml.TYPE_F16,
+	"q4_0": ml.TYPE_Q4_0,
+	"q4_1": ml.TYPE_Q4_1,
+	"q8_0": ml.TYPE_Q8_0,
 }
 
 func main() {
@@ -67,6 +108,27 @@ func main() {
 		os.Exit(0)
 	}
 
+	// --- special command to quantize model file
+
+	if len(os.Args) > 1 && os.Args[1] == "quantize" {
+		quantize(opts)
+		os.Exit(0)
+	}
+
+	// --- special command to show what is inside of model file
+
+	if len(os.Args) > 1 && os.Args[1] == "info" {
+		modelInfo(opts)
+		os.Exit(0)
+	}
+
+	// --- special command to show how the prompt is split into tokens
+
+	if len(os.Args) > 1 && os.Args[1] == "tokenize" {
+		tokenize(opts)
+		os.Exit(0)
+	}
+
 	// --- set model parameters from user settings and safe defaults
 
 	params := &llama.ModelParams{
@@ -77,6 +139,14 @@ func main() {
 		UseAVX:  opts.UseAVX,
 		UseNEON: opts.UseNEON,
 
+		UseMMap:  opts.MMap,
+		UseMLock: opts.MLock,
+
+		LoraAdapters: loraAdapters(opts.Lora),
+
+		RopeFreqBase: opts.RopeBase,
+		RopeScaling:  opts.RopeScaling,
+
 		Interactive: opts.Chat,
 
 		CtxSize:      opts.Context,
@@ -92,16 +162,45 @@ func main() {
 		RepeatPenalty: 1.10,
 
 		MemoryFP16: true,
+		MemTest:    opts.MemTest,
+	}
+
+	if opts.RopeScale > 0 {
+		params.RopeFreqScale = 1.0 / opts.RopeScale
 	}
 
 	// --- load the model and vocab
 
 	vocab, model, err := llama.LoadModel(params.Model, params, opts.Silent)
 	if err != nil {
-		utils.Colorize("\n[magenta][ ERROR ][white] Failed to load model [light_magenta]\"%s\"\n\n", params.Model)
+		utils.Colorize("\n[magenta][ ERROR ][white] Failed to load model [light_magenta]\"%s\"[white]: %s\n\n", params.Model, err.Error())
 		os.Exit(0)
 	}
 
+	// --- report memory needed to compute the full context instead of running the prompt
+
+	if params.MemTest {
+		memTest(model, params)
+		os.Exit(0)
+	}
+
+	// --- load adapters jobs could choose instead of the base model
+
+	adapters := make(map[string]*llama.Adapter)
+	for _, arg := range opts.Adapter {
+		name, path, found := strings.Cut(arg, "=")
+		if !found {
+			path = arg
+			name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		adapter, err := llama.LoadAdapter(model, loraAdapters([]string{path})[0])
+		if err != nil {
+			utils.Colorize("\n[magenta][ ERROR ][white] Failed to load adapter [light_magenta]\"%s\"[white]: %s\n\n", name, err.Error())
+			os.Exit(0)
+		}
+		adapters[name] = adapter
+	}
+
 	// --- set up internal REST server
 
 	server.MaxPods = opts.Pods
@@ -110,10 +209,12 @@ func main() {
 	server.Vocab = vocab
 	server.Model = model
 	server.Params = params
+	server.Adapters = adapters
 
 	if opts.Grpc {
-		runningCtx, _ := context.WithCancel(context.Background())
-		_, err := grpc.NewServer(opts.Host+":"+opts.Port, opts.Pods, vocab, model, params, runningCtx)
+		runningCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		_, err := grpc.NewServer(opts.Host+":"+opts.Port, opts.Pods, vocab, model, params, adapters, runningCtx)
 		if err != nil {
 			panic(err)
 		}
@@ -138,7 +239,7 @@ func main() {
 			// add a space to match LLaMA tokenizer behavior
 			prompt := " " + opts.Prompt
 			jobID := uuid.New().String()
-			server.PlaceJob(jobID, prompt)
+			server.PlaceJob(jobID, prompt, "")
 			output := ""
 
 			//utils.Colorize("\n\n[magenta]▒▒▒[light_yellow]" + prompt + "\n[light_blue]▒▒▒ ")
@@ -355,7 +456,7 @@ func parseOptions() *Options {
 		os.Exit(0)
 	}
 
-	if opts.Server == false && opts.Prompt == "" && len(os.Args) > 1 && os.Args[1] != "load" {
+	if opts.Server == false && !opts.MemTest && opts.Prompt == "" && len(os.Args) > 1 && !commands[os.Args[1]] {
 		utils.Colorize("\n[magenta][ ERROR ][white] Please specify correct prompt with [light_magenta]--prompt[white] parameter!\n\n")
 		os.Exit(0)
 	}
@@ -391,9 +492,169 @@ func parseOptions() *Options {
 		opts.Temp = 0.5
 	}
 
+	if opts.Type == "" {
+		opts.Type = "q8_0"
+	}
+
 	return &opts
 }
 
+// loraAdapters parses adapter paths with optional scale factors after the colon
+func loraAdapters(args []string) []llama.LoraAdapter {
+	adapters := make([]llama.LoraAdapter, 0, len(args))
+	for _, arg := range args {
+		adapter := llama.LoraAdapter{Path: arg, Scale: 1.0}
+		// the colon might be a part of Windows path too, so check there is a number after it
+		if pos := strings.LastIndex(arg, ":"); pos > 0 {
+			if scale, err := strconv.ParseFloat(arg[pos+1:], 32); err == nil {
+				adapter.Path = arg[:pos]
+				adapter.Scale = float32(scale)
+			}
+		}
+		adapters = append(adapters, adapter)
+	}
+	return adapters
+}
+
+// quantize converts the model into the new file with weights of the type selected by user
+func quantize(opts *Options) {
+
+	dtype, ok := weightTypes[opts.Type]
+	if !ok {
+		utils.Colorize("\n[magenta][ ERROR ][white] Please specify one of q8_0, q4_0, q4_1 or f16 types with [light_magenta]--type[white] parameter!\n\n")
+		return
+	}
+
+	if opts.Out == "" || opts.Out == opts.Model {
+		utils.Colorize("\n[magenta][ ERROR ][white] Please specify the new model path with [light_magenta]--out[white] parameter!\n\n")
+		return
+	}
+
+	utils.Colorize("\n[magenta][ QUANT ][light_blue] Converting [light_magenta]%s[light_blue] into [light_magenta]%s[light_blue] with [light_magenta]%s[light_blue] weights\n", opts.Model, opts.Out, opts.Type)
+
+	maxRMSE := 0.0
+	err := llama.QuantizeModel(opts.Model, opts.Out, dtype, func(stats llama.QuantizeStats) {
+		utils.Colorize("\n[magenta][ QUANT ][light_blue] %-32s %5d x %-5d %4s | RMSE [light_cyan]%.6f[light_blue] | MAX [light_cyan]%.6f",
+			stats.Name, stats.NE[0], stats.NE[1], typeNames[stats.Type], stats.RMSE, stats.MaxError)
+		maxRMSE = math.Max(maxRMSE, stats.RMSE)
+	})
+
+	if err != nil {
+		utils.Colorize("\n\n[magenta][ ERROR ][light_blue] Model [light_magenta]%s[light_blue] was not converted: [light_red]%s!\n\n", opts.Model, err.Error())
+		return
+	}
+
+	utils.Colorize("\n\n[magenta][ QUANT ][light_blue] Model [light_magenta]%s[light_blue] was successfully written, the worst RMSE is [light_cyan]%.6f\n\n", opts.Out, maxRMSE)
+}
+
+// modelInfo shows hparams, tensors and memory requirements of the model without loading its weights
+func modelInfo(opts *Options) {
+
+	info, err := llama.ReadModelInfo(opts.Model)
+	if err != nil {
+		utils.Colorize("\n[magenta][ ERROR ][light_blue] Model [light_magenta]%s[light_blue] can't be read: [light_red]%s!\n\n", opts.Model, err.Error())
+		return
+	}
+
+	utils.Colorize("\n[magenta][ INFO ][light_blue] Model [light_magenta]%s[light_blue] | format [light_cyan]%s[light_blue] | arch [light_cyan]%s[light_blue] | type [light_cyan]%s[light_blue] | ftype [light_cyan]%d",
+		opts.Model, strings.ToUpper(info.Format), info.Architecture, info.Type, info.FileType)
+	utils.Colorize("\n[magenta][ INFO ][light_blue] vocab [light_cyan]%d[light_blue] | embd [light_cyan]%d[light_blue] | mult [light_cyan]%d[light_blue] | ff [light_cyan]%d[light_blue] | heads [light_cyan]%d[light_blue] | kv heads [light_cyan]%d[light_blue] | layers [light_cyan]%d[light_blue] | rot [light_cyan]%d",
+		info.VocabSize, info.EmbdSize, info.MultSize, info.FFSize, info.HeadsCount, info.KVHeadsCount, info.LayersCount, info.RotCount)
+	if info.CtxTrain > 0 {
+		utils.Colorize("\n[magenta][ INFO ][light_blue] trained context [light_cyan]%d[light_blue] | rope base [light_cyan]%.1f[light_blue] | rope scale [light_cyan]%.3f[light_blue] | rope scaling [light_cyan]%s",
+			info.CtxTrain, info.RopeFreqBase, info.RopeFreqScale, info.RopeScaling)
+	}
+	if info.ExpertsCount > 0 {
+		utils.Colorize("\n[magenta][ INFO ][light_blue] experts [light_cyan]%d[light_blue] | used per token [light_cyan]%d",
+			info.ExpertsCount, info.ExpertsUsed)
+	}
+
+	// --- count tensors of each type
+
+	counts := make(map[ml.DType]int)
+	for _, tensor := range info.Tensors {
+		counts[tensor.Type]++
+	}
+	summary := make([]string, 0, len(counts))
+	for dtype := ml.DType(0); dtype < ml.TYPE_COUNT; dtype++ {
+		if counts[dtype] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[dtype], typeNames[dtype]))
+		}
+	}
+
+	utils.Colorize("\n[magenta][ INFO ][light_blue] tensors [light_cyan]%d[light_blue] | %s", len(info.Tensors), strings.Join(summary, ", "))
+	utils.Colorize("\n[magenta][ INFO ][light_blue] weights in memory [light_cyan]%d MB[light_blue] | RAM needed for context of [light_cyan]%d[light_blue] tokens is about [light_cyan]%d MB",
+		info.WeightsSize()/1024/1024, opts.Context, info.EstimateRAM(opts.Context)/1024/1024)
+
+	if len(info.Problems) == 0 {
+		utils.Colorize("\n[magenta][ INFO ][light_blue] All tensors are matching the model architecture\n\n")
+		return
+	}
+
+	for _, problem := range info.Problems {
+		utils.Colorize("\n[magenta][ ERROR ][light_red] %s", problem.Error())
+	}
+	utils.Colorize("\n\n[magenta][ ERROR ][light_blue] Model has [light_red]%d[light_blue] problems and can't be loaded\n\n", len(info.Problems))
+}
+
+// tokenize shows ids and pieces of prompt tokens, only the vocab is loaded
+// The model could be tokenizer.json or tokenizer.model file too
+func tokenize(opts *Options) {
+
+	if opts.Prompt == "" {
+		utils.Colorize("\n[magenta][ ERROR ][white] Please specify the text to tokenize with [light_magenta]--prompt[white] parameter!\n\n")
+		return
+	}
+
+	var vocab *ml.Vocab
+	var err error
+	switch strings.ToLower(filepath.Ext(opts.Model)) {
+	case ".json", ".model":
+		vocab, err = llama.LoadTokenizer(opts.Model)
+	default:
+		vocab, err = llama.LoadVocab(opts.Model)
+	}
+	if err != nil {
+		utils.Colorize("\n[magenta][ ERROR ][light_blue] Vocab of [light_magenta]%s[light_blue] can't be read: [light_red]%s!\n\n", opts.Model, err.Error())
+		return
+	}
+
+	// vocabs of model files expect the leading space the same way server adds it
+	prompt := opts.Prompt
+	if vocab.Normalize == nil {
+		prompt = " " + prompt
+	}
+
+	var tokens []uint32
+	if opts.Special {
+		tokens = ml.TokenizeSpecial(vocab, prompt, true)
+	} else {
+		tokens = ml.Tokenize(vocab, prompt, true)
+	}
+
+	utils.Colorize("\n[magenta][ TOKENS ][light_blue] Prompt is [light_cyan]%d[light_blue] tokens\n", len(tokens))
+	for _, id := range tokens {
+		piece := vocab.ID2Token[id].Token
+		if piece == "" {
+			piece = ml.Token2Str(vocab, id)
+		}
+		fmt.Printf("\n%8d  %q", id, piece)
+	}
+	fmt.Printf("\n\n")
+}
+
+// memTest shows the peak memory Eval needs for temporary tensors in the worst case of the full context
+func memTest(model *llama.Model, params *llama.ModelParams) {
+
+	ctx := llama.NewContext(model, params)
+	defer ctx.ReleaseContext()
+
+	scratch := llama.MemTest(ctx, model, params)
+
+	utils.Colorize("\n[magenta][ MEMTEST ][light_blue] temporary tensors take [light_cyan]%d MB[light_blue] at peak for context of [light_cyan]%d[light_blue] tokens and batch of [light_cyan]%d[light_blue]\n\n",
+		scratch/1024/1024, params.CtxSize, params.BatchSize)
+}
+
 func showLogo() {
 
 	// https://patorjk.com/software/taag/#p=display&f=3-D&t=llama.go%0A%0ALLaMA.go
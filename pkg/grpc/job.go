@@ -2,6 +2,7 @@ package grpc
 
 import (
 	"container/ring"
+	"fmt"
 	"runtime"
 	"sync/atomic"
 	"time"
@@ -24,6 +25,9 @@ func (s *Server) do(j *Job, server LlamaGoService_DoServer) error {
 	// tokenize the prompt
 	embdPrompt := ml.Tokenize(s.Vocab, prompt, true)
 
+	// output is streamed by parts of valid UTF-8 text, not by tokens
+	detokenizer := ml.NewDetokenizer(s.Vocab)
+
 	// ring buffer for last N tokens
 	lastNTokens := ring.New(int(s.Params.CtxSize))
 
@@ -50,6 +54,14 @@ func (s *Server) do(j *Job, server LlamaGoService_DoServer) error {
 
 	// new context opens sync channel and starts workers for tensor compute
 	ctx := llama.NewContext(s.Model, s.Params)
+	if j.Adapter != "" {
+		adapter, ok := s.Adapters[j.Adapter]
+		if !ok {
+			ctx.ReleaseContext()
+			return fmt.Errorf("unknown adapter '%s'", j.Adapter)
+		}
+		ctx.Adapters = []*llama.Adapter{adapter}
+	}
 
 	for remainedCount > 0 {
 
@@ -133,7 +145,10 @@ func (s *Server) do(j *Job, server LlamaGoService_DoServer) error {
 		for _, id := range embd {
 
 			tokenCounter++
-			token := ml.Token2Str(s.Vocab, id) // TODO: Simplify
+			token := detokenizer.Decode(id)
+			if token == "" {
+				continue // the char is not complete yet
+			}
 
 			server.Send(&Output{
 				Status: Status_RUNNING,
@@ -142,6 +157,13 @@ func (s *Server) do(j *Job, server LlamaGoService_DoServer) error {
 		}
 	}
 
+	if rest := detokenizer.Flush(); rest != "" {
+		server.Send(&Output{
+			Status: Status_RUNNING,
+			Output: rest,
+		})
+	}
+
 	// close sync channel and stop compute workers
 	ctx.ReleaseContext()
 
@@ -20,6 +20,7 @@ type Server struct {
 	Vocab       *ml.Vocab
 	Model       *llama.Model
 	Params      *llama.ModelParams
+	Adapters    map[string]*llama.Adapter // LoRA adapters jobs choose by name
 }
 
 //下行通道
@@ -50,17 +51,19 @@ func (c *JobStub) SendResponse(cmd *Output) error {
 }
 
 //main 从sub获取数据
-func NewServer(addr string, pods int64, vocab *ml.Vocab, model *llama.Model, params *llama.ModelParams, ctx context.Context) (server *Server, err error) {
+func NewServer(addr string, pods int64, vocab *ml.Vocab, model *llama.Model, params *llama.ModelParams, adapters map[string]*llama.Adapter, ctx context.Context) (server *Server, err error) {
 	//创建grpc服务器
 	var lis net.Listener
 	lis, err = net.Listen("tcp", addr)
 	if err == nil {
 		s := grpc.NewServer()
 		server = &Server{
-			baseCtx: ctx,
-			MaxPods: pods,
-			Vocab:   vocab,
-			Model:   model,
+			baseCtx:  ctx,
+			MaxPods:  pods,
+			Vocab:    vocab,
+			Model:    model,
+			Params:   params,
+			Adapters: adapters,
 		}
 
 		RegisterLlamaGoServiceServer(s, server)
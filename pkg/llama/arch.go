@@ -0,0 +1,360 @@
+package llama
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// architecture is the family of models sharing the same tensors and the compute graph
+// LoadModel selects it by general.architecture key of GGUF files, ggjt files are always LLaMA
+type architecture interface {
+
+	// name is the value of general.architecture within GGUF files
+	name() string
+
+	// hparams reads architecture specific hyperparameters from GGUF metadata, common ones are already there
+	hparams(meta ggufMeta, hparams *HParams) error
+
+	// tensorName converts GGUF tensor name into the name used by the model
+	tensorName(name string) string
+
+	// tensorShapes returns the expected shapes of all model tensors by their names
+	tensorShapes(hparams *HParams) map[string][4]uint32
+
+	// bind links loaded tensors with the model and its layers
+	bind(model *Model, get func(name string) *ml.Tensor)
+
+	// build adds all transformer blocks and the final norm to the graph
+	// It returns the embeddings to be multiplied by the output weights
+	build(eval *evalState, inpL *ml.Tensor) *ml.Tensor
+}
+
+// architectures are all supported model families by their GGUF names
+var architectures = map[string]architecture{
+	"llama":   llamaArch{},
+	"gptneox": gptNeoXArch{},
+	"falcon":  falconArch{},
+}
+
+// evalState keeps everything architectures need to build the graph of a single Eval call
+type evalState struct {
+	ctx   *ml.Context
+	graph *ml.Graph
+	lctx  *Context
+	model *Model
+
+	N         uint32 // tokens in the batch
+	pastCount uint32 // tokens already in the KV cache
+	kvLen     uint32 // cache positions the attention runs over, those after pastCount + N are masked
+	rope      ml.RopeParams
+
+	past   []*ml.Tensor // nodes built with pastCount, see ml.SetPast
+	stores []kvStore    // views of the cache new keys and values are copied into
+}
+
+// mulMat multiplies weights by the input adding low-rank paths of context adapters
+func (eval *evalState) mulMat(weights, input *ml.Tensor) *ml.Tensor {
+	return mulMat(eval.ctx, eval.lctx.Adapters, weights, input)
+}
+
+// bias adds the bias vector to every row of the input, models without biases have nil there
+func (eval *evalState) bias(input, bias *ml.Tensor) *ml.Tensor {
+	if bias == nil {
+		return input
+	}
+	return ml.Add(eval.ctx, input, ml.Repeat(eval.ctx, bias, input))
+}
+
+// rmsNorm is the RMS normalization multiplied by weights as in LLaMA
+func (eval *evalState) rmsNorm(input, weights *ml.Tensor) *ml.Tensor {
+	cur := ml.RMSNorm(eval.ctx, input)
+	return ml.Mul(eval.ctx, ml.Repeat(eval.ctx, weights, cur), cur)
+}
+
+// layerNorm is the layer normalization with weights and bias as in GPT-2 and its successors
+func (eval *evalState) layerNorm(input, weights, bias *ml.Tensor) *ml.Tensor {
+	cur := ml.Norm(eval.ctx, input)
+	cur = ml.Mul(eval.ctx, ml.Repeat(eval.ctx, weights, cur), cur)
+	return eval.bias(cur, bias)
+}
+
+// ropeHeads copies heads of queries or keys into the new tensor and rotates them there
+func (eval *evalState) ropeHeads(input *ml.Tensor, headsCount, dims, mode uint32) *ml.Tensor {
+	headSize := eval.model.hparams.embdSize / eval.model.hparams.headsCount
+	rope := ml.RopeCustom(eval.ctx,
+		ml.Copy(eval.ctx,
+			input,
+			ml.NewTensor3D(eval.ctx, ml.TYPE_F32, headSize, headsCount, eval.N)), // Reusable OK
+		eval.pastCount, dims, mode, eval.rope)
+	eval.past = append(eval.past, rope)
+	return rope
+}
+
+// store copies new keys or values into the cache at pastCount position of the layer
+func (eval *evalState) store(cache *ml.Tensor, il uint32, input *ml.Tensor) {
+
+	hparams := eval.model.hparams
+	kvEmbdSize := hparams.kvEmbdSize()
+
+	store := kvStore{
+		cache:  cache,
+		offset: kvEmbdSize * il * hparams.ctxSize,
+		size:   kvEmbdSize,
+	}
+
+	// NB! ggml_element_size(kv_self.k) = 2 for FP16
+	store.view = ml.View1D(eval.ctx, cache, eval.N*kvEmbdSize, store.offset+eval.pastCount*kvEmbdSize)
+	store.copy = ml.Copy(eval.ctx, input, store.view)
+
+	ml.BuildForwardExpand(eval.graph, store.copy)
+	eval.stores = append(eval.stores, store)
+}
+
+// attention stores new keys and values into the cache and runs the masked self-attention over all of them
+// Q is [headSize, headsCount, N] and K is [headSize, kvHeadsCount, N] with RoPE already applied,
+// V might be any view with kvEmbdSize values per token
+// The result is [embdSize, N] before the output projection
+func (eval *evalState) attention(il uint32, Qcur, Kcur, Vcur *ml.Tensor) *ml.Tensor {
+
+	ctx0 := eval.ctx
+	kvSelf := eval.lctx.kvSelf
+	hparams := eval.model.hparams
+
+	N := eval.N
+	kvLen := eval.kvLen
+
+	embdSize := hparams.embdSize
+	ctxSize := hparams.ctxSize
+	headsCount := hparams.headsCount
+	kvHeadsCount := hparams.kvHeadsCount
+	kvEmbdSize := hparams.kvEmbdSize()
+	headSize := embdSize / headsCount
+
+	// store key and value to memory
+	if N >= 1 {
+
+		////struct ggml_tensor * k = ggml_view_1d(ctx0, kv_self.k, N*n_embd, (ggml_element_size(kv_self.k)*n_embd)*(il*n_ctx + n_past));
+		////struct ggml_tensor * v = ggml_view_1d(ctx0, kv_self.v, N*n_embd, (ggml_element_size(kv_self.v)*n_embd)*(il*n_ctx + n_past));
+
+		eval.store(kvSelf.K, il, Kcur)
+		eval.store(kvSelf.V, il, Vcur)
+	}
+
+	// keys and values of the layer are [headSize, kvHeadsCount, kvLen] within the cache
+	K := ml.Reshape3D(ctx0,
+		ml.View1D(ctx0, kvSelf.K, kvLen*kvEmbdSize, il*ctxSize*kvEmbdSize),
+		headSize, kvHeadsCount, kvLen)
+
+	V := ml.Reshape3D(ctx0,
+		ml.View1D(ctx0, kvSelf.V, kvLen*kvEmbdSize, il*ctxSize*kvEmbdSize),
+		headSize, kvHeadsCount, kvLen)
+
+	// softmax(K * Q / sqrt(headSize)) * V, fused so KQ matrix is never stored
+	// with grouped-query attention each KV head is shared by headsCount / kvHeadsCount heads of Q
+	// positions of the cache after the new tokens are masked, they are not filled yet
+	KQV := ml.FlashAttn(ctx0, Qcur, K, V, eval.pastCount,
+		float32(1.0/math.Sqrt(float64(embdSize)/float64(headsCount))))
+	eval.past = append(eval.past, KQV)
+
+	// heads of each token are already merged, cur = KQV.view(n_embd, N)
+	return ml.Reshape2D(ctx0, KQV, embdSize, N)
+}
+
+// ---
+
+// llamaArch is LLaMA and models sharing its architecture like Mistral, Vicuna, etc
+// Tensors are named the same way as ggjt files do
+type llamaArch struct{}
+
+func (llamaArch) name() string {
+	return "llama"
+}
+
+func (llamaArch) hparams(meta ggufMeta, hparams *HParams) error {
+	return nil
+}
+
+func (llamaArch) tensorName(name string) string {
+	return ggufTensorName(name)
+}
+
+func (llamaArch) tensorShapes(hparams *HParams) map[string][4]uint32 {
+
+	embdSize := hparams.embdSize
+	kvEmbdSize := hparams.kvEmbdSize()
+	vocabSize := hparams.vocabSize
+	ffSize := hparams.ffSize
+
+	shapes := map[string][4]uint32{
+		"tok_embeddings.weight": {embdSize, vocabSize, 1, 1},
+		"norm.weight":           {embdSize, 1, 1, 1},
+		"output.weight":         {embdSize, vocabSize, 1, 1},
+	}
+
+	for i := uint32(0); i < hparams.layersCount; i++ {
+
+		prefix := fmt.Sprintf("layers.%d.", i)
+
+		shapes[prefix+"attention_norm.weight"] = [4]uint32{embdSize, 1, 1, 1}
+
+		shapes[prefix+"attention.wq.weight"] = [4]uint32{embdSize, embdSize, 1, 1}
+		shapes[prefix+"attention.wk.weight"] = [4]uint32{embdSize, kvEmbdSize, 1, 1}
+		shapes[prefix+"attention.wv.weight"] = [4]uint32{embdSize, kvEmbdSize, 1, 1}
+		shapes[prefix+"attention.wo.weight"] = [4]uint32{embdSize, embdSize, 1, 1}
+
+		shapes[prefix+"ffn_norm.weight"] = [4]uint32{embdSize, 1, 1, 1}
+
+		if hparams.expertsCount > 0 {
+			shapes[prefix+"feed_forward.router.weight"] = [4]uint32{embdSize, hparams.expertsCount, 1, 1}
+			for e := uint32(0); e < hparams.expertsCount; e++ {
+				expert := fmt.Sprintf("%sfeed_forward.experts.%d.", prefix, e)
+				shapes[expert+"w1.weight"] = [4]uint32{embdSize, ffSize, 1, 1}
+				shapes[expert+"w2.weight"] = [4]uint32{ffSize, embdSize, 1, 1}
+				shapes[expert+"w3.weight"] = [4]uint32{embdSize, ffSize, 1, 1}
+			}
+			continue
+		}
+
+		shapes[prefix+"feed_forward.w1.weight"] = [4]uint32{embdSize, ffSize, 1, 1}
+		shapes[prefix+"feed_forward.w2.weight"] = [4]uint32{ffSize, embdSize, 1, 1}
+		shapes[prefix+"feed_forward.w3.weight"] = [4]uint32{embdSize, ffSize, 1, 1}
+	}
+
+	return shapes
+}
+
+func (llamaArch) bind(model *Model, get func(name string) *ml.Tensor) {
+
+	model.tokEmbeddings = get("tok_embeddings.weight")
+	model.norm = get("norm.weight")
+	model.output = get("output.weight")
+
+	for i := range model.layers {
+
+		prefix := fmt.Sprintf("layers.%d.", i)
+
+		model.layers[i].attentionNorm = get(prefix + "attention_norm.weight")
+
+		model.layers[i].wq = get(prefix + "attention.wq.weight")
+		model.layers[i].wk = get(prefix + "attention.wk.weight")
+		model.layers[i].wv = get(prefix + "attention.wv.weight")
+		model.layers[i].wo = get(prefix + "attention.wo.weight")
+
+		model.layers[i].ffn_norm = get(prefix + "ffn_norm.weight")
+
+		if expertsCount := model.hparams.expertsCount; expertsCount > 0 {
+			model.layers[i].router = get(prefix + "feed_forward.router.weight")
+			model.layers[i].w1Experts = make([]*ml.Tensor, expertsCount)
+			model.layers[i].w2Experts = make([]*ml.Tensor, expertsCount)
+			model.layers[i].w3Experts = make([]*ml.Tensor, expertsCount)
+			for e := uint32(0); e < expertsCount; e++ {
+				expert := fmt.Sprintf("%sfeed_forward.experts.%d.", prefix, e)
+				model.layers[i].w1Experts[e] = get(expert + "w1.weight")
+				model.layers[i].w2Experts[e] = get(expert + "w2.weight")
+				model.layers[i].w3Experts[e] = get(expert + "w3.weight")
+			}
+			continue
+		}
+
+		model.layers[i].w1 = get(prefix + "feed_forward.w1.weight")
+		model.layers[i].w2 = get(prefix + "feed_forward.w2.weight")
+		model.layers[i].w3 = get(prefix + "feed_forward.w3.weight")
+	}
+}
+
+func (llamaArch) build(eval *evalState, inpL *ml.Tensor) *ml.Tensor {
+
+	ctx0 := eval.ctx
+	model := eval.model
+
+	headsCount := model.hparams.headsCount
+	kvHeadsCount := model.hparams.kvHeadsCount
+	rotCount := model.hparams.embdSize / model.hparams.headsCount
+
+	for il := uint32(0); il < model.hparams.layersCount; il++ {
+
+		layer := &model.layers[il]
+
+		inpSA := inpL
+
+		// norm
+		cur := eval.rmsNorm(inpL, layer.attentionNorm)
+
+		// self-attention
+		{
+			Qcur := eval.mulMat(layer.wq, cur)
+			Kcur := eval.mulMat(layer.wk, cur)
+			Vcur := eval.mulMat(layer.wv, cur)
+
+			Q := eval.ropeHeads(Qcur, headsCount, rotCount, ml.ROPE_MODE_NORMAL)
+			K := eval.ropeHeads(Kcur, kvHeadsCount, rotCount, ml.ROPE_MODE_NORMAL)
+
+			cur = eval.attention(il, Q, K, Vcur)
+
+			// projection (no bias)
+			cur = eval.mulMat(layer.wo, cur)
+		}
+
+		inpFF := ml.Add(ctx0, cur, inpSA)
+
+		// feed-forward network
+		if layer.router != nil {
+			cur = eval.experts(layer, eval.rmsNorm(inpFF, layer.ffn_norm))
+		} else {
+			cur = eval.rmsNorm(inpFF, layer.ffn_norm)
+
+			tmp := eval.mulMat(layer.w3, cur)
+
+			cur = eval.mulMat(layer.w1, cur)
+
+			// SILU activation
+			cur = ml.Silu(ctx0, cur)
+
+			cur = ml.Mul(ctx0, cur, tmp)
+
+			cur = eval.mulMat(layer.w2, cur)
+		}
+
+		// input for next layer
+		inpL = ml.Add(ctx0, cur, inpFF)
+	}
+
+	return eval.rmsNorm(inpL, model.norm)
+}
+
+// experts is the sparse feed-forward of Mixtral, where the router selects expertsUsed experts for each token
+// Their SwiGLU outputs are summed with weights from the softmax over router values of selected experts only
+func (eval *evalState) experts(layer *Layer, input *ml.Tensor) *ml.Tensor {
+
+	ctx0 := eval.ctx
+	expertsUsed := eval.model.hparams.expertsUsed
+
+	logits := eval.mulMat(layer.router, input)                     // [expertsCount, N]
+	selected := ml.TopK(ctx0, logits, expertsUsed)                 // [expertsUsed, N]
+	weights := ml.SoftMax(ctx0, ml.Gather(ctx0, logits, selected)) // [expertsUsed, N]
+
+	var result *ml.Tensor
+	for slot := uint32(0); slot < expertsUsed; slot++ {
+
+		tmp := ml.MulMatID(ctx0, layer.w3Experts, selected, slot, input)
+
+		cur := ml.MulMatID(ctx0, layer.w1Experts, selected, slot, input)
+		cur = ml.Silu(ctx0, cur)
+		cur = ml.Mul(ctx0, cur, tmp)
+		cur = ml.MulMatID(ctx0, layer.w2Experts, selected, slot, cur)
+
+		// weight of the expert for each token is broadcasted over its embeddings
+		weight := ml.View2D(ctx0, weights, 1, eval.N, weights.NB[1], slot)
+		cur = ml.Mul(ctx0, cur, ml.Repeat(ctx0, weight, cur))
+
+		if result == nil {
+			result = cur
+		} else {
+			result = ml.Add(ctx0, result, cur)
+		}
+	}
+
+	return result
+}
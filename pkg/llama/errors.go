@@ -0,0 +1,38 @@
+package llama
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// Errors returned by model loading and inference, check them with errors.Is
+var (
+	ErrInvalidFile   = errors.New("invalid model file")
+	ErrUnknownTensor = errors.New("unknown tensor")
+	ErrMissingTensor = errors.New("tensor is missing in model file")
+	ErrTruncatedFile = errors.New("model file is truncated")
+
+	ErrInvalidTokenizer = errors.New("invalid tokenizer file")
+
+	// the same values as in ml package, so either of them could be used for checks
+	ErrUnsupportedDType = ml.ErrUnsupportedDType
+	ErrUnsupportedOp    = ml.ErrUnsupportedOp
+	ErrShapeMismatch    = ml.ErrShapeMismatch
+)
+
+// TensorError describes the model tensor which failed to load
+type TensorError struct {
+	Name   string
+	Offset int64 // file offset of the tensor data
+	Err    error
+}
+
+func (e *TensorError) Error() string {
+	return fmt.Sprintf("tensor '%s' at offset %d: %v", e.Name, e.Offset, e.Err)
+}
+
+func (e *TensorError) Unwrap() error {
+	return e.Err
+}
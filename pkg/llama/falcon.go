@@ -0,0 +1,142 @@
+package llama
+
+import (
+	"fmt"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// falconArch is Falcon of TII, both 7B with multi-query attention and 40B with grouped-query one
+// Attention and feed-forward run in parallel over the normalized layer input,
+// query, key and value weights are fused into one matrix and there are no biases except LayerNorm ones
+// Falcon-40B normalizes the attention input separately with the second LayerNorm,
+// the loader tells it from 7B by the number of KV heads like the original convert script does
+type falconArch struct{}
+
+func (falconArch) name() string {
+	return "falcon"
+}
+
+func (falconArch) hparams(meta ggufMeta, hparams *HParams) error {
+	return nil
+}
+
+func (falconArch) tensorName(name string) string {
+	return name
+}
+
+func (falconArch) tensorShapes(hparams *HParams) map[string][4]uint32 {
+
+	embdSize := hparams.embdSize
+	kvEmbdSize := hparams.kvEmbdSize()
+	vocabSize := hparams.vocabSize
+	ffSize := hparams.ffSize
+
+	shapes := map[string][4]uint32{
+		"token_embd.weight":  {embdSize, vocabSize, 1, 1},
+		"output_norm.weight": {embdSize, 1, 1, 1},
+		"output_norm.bias":   {embdSize, 1, 1, 1},
+		"output.weight":      {embdSize, vocabSize, 1, 1},
+	}
+
+	for i := uint32(0); i < hparams.layersCount; i++ {
+
+		prefix := fmt.Sprintf("blk.%d.", i)
+
+		shapes[prefix+"attn_norm.weight"] = [4]uint32{embdSize, 1, 1, 1}
+		shapes[prefix+"attn_norm.bias"] = [4]uint32{embdSize, 1, 1, 1}
+
+		if hparams.kvHeadsCount > 1 {
+			shapes[prefix+"attn_norm_2.weight"] = [4]uint32{embdSize, 1, 1, 1}
+			shapes[prefix+"attn_norm_2.bias"] = [4]uint32{embdSize, 1, 1, 1}
+		}
+
+		shapes[prefix+"attn_qkv.weight"] = [4]uint32{embdSize, embdSize + 2*kvEmbdSize, 1, 1}
+		shapes[prefix+"attn_output.weight"] = [4]uint32{embdSize, embdSize, 1, 1}
+
+		shapes[prefix+"ffn_up.weight"] = [4]uint32{embdSize, ffSize, 1, 1}
+		shapes[prefix+"ffn_down.weight"] = [4]uint32{ffSize, embdSize, 1, 1}
+	}
+
+	return shapes
+}
+
+func (falconArch) bind(model *Model, get func(name string) *ml.Tensor) {
+
+	model.tokEmbeddings = get("token_embd.weight")
+	model.norm = get("output_norm.weight")
+	model.normBias = get("output_norm.bias")
+	model.output = get("output.weight")
+
+	for i := range model.layers {
+
+		prefix := fmt.Sprintf("blk.%d.", i)
+		layer := &model.layers[i]
+
+		layer.attentionNorm = get(prefix + "attn_norm.weight")
+		layer.attentionNormBias = get(prefix + "attn_norm.bias")
+
+		if model.hparams.kvHeadsCount > 1 {
+			layer.attentionNorm2 = get(prefix + "attn_norm_2.weight")
+			layer.attentionNorm2Bias = get(prefix + "attn_norm_2.bias")
+		}
+
+		layer.wqkv = get(prefix + "attn_qkv.weight")
+		layer.wo = get(prefix + "attn_output.weight")
+
+		layer.w3 = get(prefix + "ffn_up.weight")
+		layer.w2 = get(prefix + "ffn_down.weight")
+	}
+}
+
+func (falconArch) build(eval *evalState, inpL *ml.Tensor) *ml.Tensor {
+
+	ctx0 := eval.ctx
+	model := eval.model
+
+	N := eval.N
+	embdSize := model.hparams.embdSize
+	headsCount := model.hparams.headsCount
+	kvHeadsCount := model.hparams.kvHeadsCount
+	kvEmbdSize := model.hparams.kvEmbdSize()
+	headSize := embdSize / headsCount
+
+	for il := uint32(0); il < model.hparams.layersCount; il++ {
+
+		layer := &model.layers[il]
+
+		attnNorm := eval.layerNorm(inpL, layer.attentionNorm, layer.attentionNormBias)
+
+		cur := attnNorm
+		if layer.attentionNorm2 != nil {
+			cur = eval.layerNorm(inpL, layer.attentionNorm2, layer.attentionNorm2Bias)
+		}
+
+		// self-attention
+		{
+			cur = eval.mulMat(layer.wqkv, cur)
+
+			// fused values are all queries, then all keys and then all values
+			rowSize := cur.NB[1]
+			Qcur := ml.View3D(ctx0, cur, headSize, headsCount, N, headSize*4, rowSize, 0)
+			Kcur := ml.View3D(ctx0, cur, headSize, kvHeadsCount, N, headSize*4, rowSize, embdSize)
+			Vcur := ml.View2D(ctx0, cur, kvEmbdSize, N, rowSize, embdSize+kvEmbdSize)
+
+			Q := eval.ropeHeads(Qcur, headsCount, headSize, ml.ROPE_MODE_NEOX)
+			K := eval.ropeHeads(Kcur, kvHeadsCount, headSize, ml.ROPE_MODE_NEOX)
+
+			cur = eval.attention(il, Q, K, Vcur)
+
+			cur = eval.mulMat(layer.wo, cur)
+		}
+
+		// feed-forward network runs in parallel with attention
+		ff := eval.mulMat(layer.w3, attnNorm)
+		ff = ml.Gelu(ctx0, ff)
+		ff = eval.mulMat(layer.w2, ff)
+
+		inpL = ml.Add(ctx0, ml.Add(ctx0, ff, cur), inpL)
+	}
+
+	return eval.layerNorm(inpL, model.norm, model.normBias)
+}
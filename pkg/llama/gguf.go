@@ -0,0 +1,764 @@
+package llama
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/x448/float16"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// GGUF is the successor of ggjt format used by llama.cpp since August 2023
+// https://github.com/ggerganov/ggml/blob/master/docs/gguf.md
+
+const (
+	GGUF_MAGIC             = 0x46554747 // 'GGUF' in hex (little-endian)
+	GGUF_DEFAULT_ALIGNMENT = 32
+)
+
+// GGUF metadata value types
+const (
+	GGUF_TYPE_UINT8   = 0
+	GGUF_TYPE_INT8    = 1
+	GGUF_TYPE_UINT16  = 2
+	GGUF_TYPE_INT16   = 3
+	GGUF_TYPE_UINT32  = 4
+	GGUF_TYPE_INT32   = 5
+	GGUF_TYPE_FLOAT32 = 6
+	GGUF_TYPE_BOOL    = 7
+	GGUF_TYPE_STRING  = 8
+	GGUF_TYPE_ARRAY   = 9
+	GGUF_TYPE_UINT64  = 10
+	GGUF_TYPE_INT64   = 11
+	GGUF_TYPE_FLOAT64 = 12
+)
+
+// ggufType describes how tensors of some GGUF type are stored within the file
+type ggufType struct {
+	dtype     ml.DType
+	blockSize uint32                // elements per block
+	typeSize  uint32                // bytes per block
+	repack    func(dst, src []byte) // converts blocks into in-memory layout if it differs
+}
+
+// ggufTypes maps GGUF tensor types into types known to the loader
+// NB! K-quants and other exotic types are not supported yet
+var ggufTypes = map[uint32]ggufType{
+	0: {ml.TYPE_F32, 1, 4, nil},
+	1: {ml.TYPE_F16, 1, 2, nil},
+	2: {ml.TYPE_Q4_0, ml.QK, 2 + ml.QK/2, repackQ4_0},
+	3: {ml.TYPE_Q4_1, ml.QK, 2*2 + ml.QK/2, repackQ4_1},
+	8: {ml.TYPE_Q8_0, ml.QK, 2 + ml.QK, repackQ8_0},
+}
+
+// ggufNibble returns j-th 4-bit value of GGUF block where
+// the first half of values are in lower nibbles and the second one in upper
+func ggufNibble(qs []byte, j int) byte {
+	if j < ml.QK/2 {
+		return qs[j] & 0x0F
+	}
+	return qs[j-ml.QK/2] >> 4
+}
+
+// repackNibbles converts GGUF nibbles order into interleaved one of ggjt v1
+func repackNibbles(dst, src []byte) {
+	for j := 0; j < ml.QK/2; j++ {
+		dst[j] = ggufNibble(src, 2*j) | ggufNibble(src, 2*j+1)<<4
+	}
+}
+
+// repackQ4_0 converts blocks of FP16 scale and split nibbles into ml.TYPE_Q4_0 ones
+func repackQ4_0(dst, src []byte) {
+	for len(src) > 0 {
+		d := float16.Frombits(binary.LittleEndian.Uint16(src)).Float32()
+		binary.LittleEndian.PutUint32(dst, math.Float32bits(d))
+		repackNibbles(dst[4:], src[2:])
+		src = src[2+ml.QK/2:]
+		dst = dst[4+ml.QK/2:]
+	}
+}
+
+// repackQ4_1 converts blocks of FP16 scale, FP16 min and split nibbles into ml.TYPE_Q4_1 ones
+func repackQ4_1(dst, src []byte) {
+	for len(src) > 0 {
+		d := float16.Frombits(binary.LittleEndian.Uint16(src)).Float32()
+		m := float16.Frombits(binary.LittleEndian.Uint16(src[2:])).Float32()
+		binary.LittleEndian.PutUint32(dst, math.Float32bits(d))
+		binary.LittleEndian.PutUint32(dst[4:], math.Float32bits(m))
+		repackNibbles(dst[8:], src[4:])
+		src = src[2*2+ml.QK/2:]
+		dst = dst[4*2+ml.QK/2:]
+	}
+}
+
+// repackQ8_0 converts blocks of FP16 scale into ml.TYPE_Q8_0 ones with FP32 scale
+func repackQ8_0(dst, src []byte) {
+	for len(src) > 0 {
+		d := float16.Frombits(binary.LittleEndian.Uint16(src)).Float32()
+		binary.LittleEndian.PutUint32(dst, math.Float32bits(d))
+		copy(dst[4:4+ml.QK], src[2:2+ml.QK])
+		src = src[2+ml.QK:]
+		dst = dst[4+ml.QK:]
+	}
+}
+
+// ggufReader reads GGUF header remembering the first error and the current position
+type ggufReader struct {
+	r       *bufio.Reader
+	version uint32
+	pos     int64
+	size    int64 // of the whole file
+	err     error
+}
+
+func (gr *ggufReader) read(buf []byte) {
+	if gr.err != nil {
+		return
+	}
+	n, err := io.ReadFull(gr.r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w at offset %d", ErrTruncatedFile, gr.pos+int64(n))
+	}
+	gr.pos += int64(n)
+	gr.err = err
+}
+
+func (gr *ggufReader) u8() uint8 {
+	var buf [1]byte
+	gr.read(buf[:])
+	return buf[0]
+}
+
+func (gr *ggufReader) u16() uint16 {
+	var buf [2]byte
+	gr.read(buf[:])
+	return binary.LittleEndian.Uint16(buf[:])
+}
+
+func (gr *ggufReader) u32() uint32 {
+	var buf [4]byte
+	gr.read(buf[:])
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+func (gr *ggufReader) u64() uint64 {
+	var buf [8]byte
+	gr.read(buf[:])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// count reads the size of strings and arrays, GGUF v1 used 32-bit values there
+func (gr *ggufReader) count() uint64 {
+	if gr.version == 1 {
+		return uint64(gr.u32())
+	}
+	return gr.u64()
+}
+
+// countSize is the size of values count reads in bytes
+func (gr *ggufReader) countSize() uint64 {
+	if gr.version == 1 {
+		return 4
+	}
+	return 8
+}
+
+// fits checks whether count items of at least itemSize bytes each might be left in the file,
+// so corrupted counts are caught before anything is allocated for them
+func (gr *ggufReader) fits(count, itemSize uint64) bool {
+	left := gr.size - gr.pos
+	return left >= 0 && count <= uint64(left)/itemSize
+}
+
+func (gr *ggufReader) str() string {
+	size := gr.count()
+	if gr.err != nil {
+		return ""
+	}
+	if size > 1<<24 || !gr.fits(size, 1) {
+		gr.err = fmt.Errorf("too long string of %d bytes", size)
+		return ""
+	}
+	buf := make([]byte, size)
+	gr.read(buf)
+	return string(buf)
+}
+
+// value reads metadata value of the given type
+// Arrays of popular types are returned as typed slices
+func (gr *ggufReader) value(valueType uint32) interface{} {
+	switch valueType {
+	case GGUF_TYPE_UINT8:
+		return gr.u8()
+	case GGUF_TYPE_INT8:
+		return int8(gr.u8())
+	case GGUF_TYPE_UINT16:
+		return gr.u16()
+	case GGUF_TYPE_INT16:
+		return int16(gr.u16())
+	case GGUF_TYPE_UINT32:
+		return gr.u32()
+	case GGUF_TYPE_INT32:
+		return int32(gr.u32())
+	case GGUF_TYPE_FLOAT32:
+		return math.Float32frombits(gr.u32())
+	case GGUF_TYPE_BOOL:
+		return gr.u8() != 0
+	case GGUF_TYPE_STRING:
+		return gr.str()
+	case GGUF_TYPE_UINT64:
+		return gr.u64()
+	case GGUF_TYPE_INT64:
+		return int64(gr.u64())
+	case GGUF_TYPE_FLOAT64:
+		return math.Float64frombits(gr.u64())
+	case GGUF_TYPE_ARRAY:
+		itemType := gr.u32()
+		size := gr.count()
+		if gr.err != nil {
+			return nil
+		}
+		if size > 1<<28 || !gr.fits(size, 1) {
+			gr.err = fmt.Errorf("too long array of %d items", size)
+			return nil
+		}
+		switch itemType {
+		case GGUF_TYPE_STRING:
+			arr := make([]string, size)
+			for i := range arr {
+				arr[i] = gr.str()
+			}
+			return arr
+		case GGUF_TYPE_FLOAT32:
+			arr := make([]float32, size)
+			for i := range arr {
+				arr[i] = math.Float32frombits(gr.u32())
+			}
+			return arr
+		case GGUF_TYPE_INT32:
+			arr := make([]int32, size)
+			for i := range arr {
+				arr[i] = int32(gr.u32())
+			}
+			return arr
+		default:
+			arr := make([]interface{}, size)
+			for i := range arr {
+				arr[i] = gr.value(itemType)
+			}
+			return arr
+		}
+	default:
+		gr.err = fmt.Errorf("unknown metadata value type %d", valueType)
+		return nil
+	}
+}
+
+// ggufMeta is the key-value metadata from GGUF header
+type ggufMeta map[string]interface{}
+
+// uint returns any integer value as uint32
+func (meta ggufMeta) uint(key string) (uint32, bool) {
+	switch v := meta[key].(type) {
+	case uint8:
+		return uint32(v), true
+	case int8:
+		return uint32(v), true
+	case uint16:
+		return uint32(v), true
+	case int16:
+		return uint32(v), true
+	case uint32:
+		return v, true
+	case int32:
+		return uint32(v), true
+	case uint64:
+		return uint32(v), true
+	case int64:
+		return uint32(v), true
+	}
+	return 0, false
+}
+
+// float returns any float value as float32
+func (meta ggufMeta) float(key string) (float32, bool) {
+	switch v := meta[key].(type) {
+	case float32:
+		return v, true
+	case float64:
+		return float32(v), true
+	}
+	return 0, false
+}
+
+func (meta ggufMeta) str(key string) string {
+	v, _ := meta[key].(string)
+	return v
+}
+
+// readGGUF reads hparams, vocab and the table of tensors unless [vocabOnly] is set from GGUF file
+// The file should be positioned right after the magic
+func readGGUF(file *os.File, hparams *HParams, vocabOnly bool) (*ml.Vocab, []tensorInfo, error) {
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gr := &ggufReader{
+		r:    bufio.NewReaderSize(file, 1<<20),
+		pos:  4,
+		size: stat.Size(),
+	}
+
+	gr.version = gr.u32()
+	if gr.err == nil && (gr.version < 1 || gr.version > 3) {
+		return nil, nil, fmt.Errorf("unsupported GGUF version %d", gr.version)
+	}
+
+	tensorsCount := gr.count()
+	kvCount := gr.count()
+
+	if gr.err != nil {
+		return nil, nil, fmt.Errorf("failed to read GGUF header: %w", gr.err)
+	}
+
+	// each key takes its name, the type and one byte of the value at least,
+	// each tensor takes its name, dimensions count, one dimension, the type and the offset
+	kvSize := gr.countSize() + 4 + 1
+	tensorSize := gr.countSize() + 4 + gr.countSize() + 4 + 8
+	if !gr.fits(kvCount, kvSize) || !gr.fits(tensorsCount, tensorSize) ||
+		!gr.fits(kvCount*kvSize+tensorsCount*tensorSize, 1) {
+		return nil, nil, fmt.Errorf("%d metadata keys and %d tensors don't fit into the file of %d bytes", kvCount, tensorsCount, gr.size)
+	}
+
+	// --- read key-value metadata
+
+	meta := make(ggufMeta, kvCount)
+	for i := uint64(0); i < kvCount && gr.err == nil; i++ {
+		key := gr.str()
+		meta[key] = gr.value(gr.u32())
+	}
+
+	if gr.err != nil {
+		return nil, nil, fmt.Errorf("failed to read GGUF metadata: %w", gr.err)
+	}
+
+	arch, ok := architectures[meta.str("general.architecture")]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported model architecture '%s'", meta.str("general.architecture"))
+	}
+	hparams.arch = arch
+
+	// --- hparams
+
+	if err := ggufHParams(meta, arch.name(), hparams); err != nil {
+		return nil, nil, err
+	}
+	if err := arch.hparams(meta, hparams); err != nil {
+		return nil, nil, err
+	}
+	if hparams.expertsCount > 0 && arch.name() != "llama" {
+		return nil, nil, fmt.Errorf("mixture of experts is not supported for '%s' architecture", arch.name())
+	}
+
+	// --- vocab
+
+	vocab, err := ggufVocab(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hparams.vocabSize == 0 {
+		hparams.vocabSize = uint32(len(vocab.ID2Token))
+	}
+
+	if vocabOnly {
+		return vocab, nil, nil
+	}
+
+	// --- read tensors table
+
+	tensors := make([]tensorInfo, 0, tensorsCount)
+	for i := uint64(0); i < tensorsCount && gr.err == nil; i++ {
+
+		var info tensorInfo
+
+		info.name = arch.tensorName(gr.str())
+		info.dims = gr.u32()
+		if info.dims < 1 || info.dims > 4 {
+			return nil, nil, fmt.Errorf("tensor '%s' has wrong number of dimensions %d", info.name, info.dims)
+		}
+
+		info.ne = [4]uint32{1, 1, 1, 1}
+		for j := uint32(0); j < info.dims; j++ {
+			ne := gr.count() // 32-bit with GGUF v1 too
+			if ne > math.MaxUint32 {
+				return nil, nil, fmt.Errorf("tensor '%s' has too big dimension %d", info.name, ne)
+			}
+			info.ne[j] = uint32(ne)
+		}
+
+		typeID := gr.u32()
+		tensorType, ok := ggufTypes[typeID]
+		if !ok {
+			return nil, nil, fmt.Errorf("tensor '%s' of type %d: %w", info.name, typeID, ErrUnsupportedDType)
+		}
+
+		info.dtype = tensorType.dtype
+		info.size = info.nelements() * int64(tensorType.typeSize) / int64(tensorType.blockSize)
+		info.repack = tensorType.repack
+		info.offset = int64(gr.u64()) // relative to the start of data section for now
+
+		tensors = append(tensors, info)
+	}
+
+	if gr.err != nil {
+		return nil, nil, fmt.Errorf("failed to read GGUF tensors info: %w", gr.err)
+	}
+
+	// --- the data section starts right after the header aligned to general.alignment
+
+	alignment, ok := meta.uint("general.alignment")
+	if !ok || alignment == 0 {
+		alignment = GGUF_DEFAULT_ALIGNMENT
+	}
+
+	dataOffset := gr.pos
+	if rem := dataOffset % int64(alignment); rem != 0 {
+		dataOffset += int64(alignment) - rem
+	}
+
+	for i := range tensors {
+		tensors[i].offset += dataOffset
+	}
+
+	return vocab, tensors, nil
+}
+
+// ggufHParams fills model hyperparameters from GGUF metadata
+func ggufHParams(meta ggufMeta, arch string, hparams *HParams) error {
+
+	required := func(key string) (uint32, error) {
+		value, ok := meta.uint(arch + "." + key)
+		if !ok {
+			return 0, fmt.Errorf("model metadata has no '%s.%s' key", arch, key)
+		}
+		return value, nil
+	}
+
+	var err error
+
+	if hparams.embdSize, err = required("embedding_length"); err != nil {
+		return err
+	}
+	if hparams.ffSize, err = required("feed_forward_length"); err != nil {
+		return err
+	}
+	if hparams.headsCount, err = required("attention.head_count"); err != nil {
+		return err
+	}
+	if hparams.layersCount, err = required("block_count"); err != nil {
+		return err
+	}
+
+	hparams.vocabSize, _ = meta.uint(arch + ".vocab_size")
+	hparams.ctxTrain, _ = meta.uint(arch + ".context_length")
+	hparams.f16, _ = meta.uint("general.file_type")
+
+	hparams.kvHeadsCount = hparams.headsCount
+	if kvHeadsCount, ok := meta.uint(arch + ".attention.head_count_kv"); ok {
+		hparams.kvHeadsCount = kvHeadsCount
+	}
+	if hparams.headsCount == 0 || hparams.kvHeadsCount == 0 || hparams.headsCount%hparams.kvHeadsCount != 0 {
+		return fmt.Errorf("%d attention heads could not be grouped over %d KV heads", hparams.headsCount, hparams.kvHeadsCount)
+	}
+
+	// --- RoPE settings
+
+	hparams.rotCount = hparams.embdSize / hparams.headsCount
+	if rotCount, ok := meta.uint(arch + ".rope.dimension_count"); ok {
+		hparams.rotCount = rotCount
+	}
+
+	hparams.ropeFreqBase = 10000.0
+	if freqBase, ok := meta.float(arch + ".rope.freq_base"); ok {
+		hparams.ropeFreqBase = freqBase
+	}
+
+	hparams.ropeFreqScale = 1.0
+	if scale, ok := meta.float(arch + ".rope.scale_linear"); ok && scale != 0 && scale != 1 {
+		hparams.ropeFreqScale = 1.0 / scale
+		hparams.ropeScaling = ml.ROPE_SCALING_LINEAR
+	}
+
+	if scaling, ok := ropeScalings[meta.str(arch+".rope.scaling.type")]; ok {
+		hparams.ropeScaling = scaling
+		if factor, ok := meta.float(arch + ".rope.scaling.factor"); ok && factor != 0 {
+			hparams.ropeFreqScale = 1.0 / factor
+		}
+	}
+	hparams.ropeCtxOrig, _ = meta.uint(arch + ".rope.scaling.original_context_length")
+
+	// --- mixture of experts
+
+	hparams.expertsCount, _ = meta.uint(arch + ".expert_count")
+	hparams.expertsUsed, _ = meta.uint(arch + ".expert_used_count")
+	if hparams.expertsCount > 0 && (hparams.expertsUsed == 0 || hparams.expertsUsed > hparams.expertsCount) {
+		return fmt.Errorf("%d experts could not be used of %d ones", hparams.expertsUsed, hparams.expertsCount)
+	}
+	if hparams.expertsCount == 0 && hparams.expertsUsed > 0 {
+		return fmt.Errorf("%d experts used, but model metadata has no '%s.expert_count' key", hparams.expertsUsed, arch)
+	}
+
+	return nil
+}
+
+// ggufVocab builds vocab from tokenizer metadata
+// SentencePiece pieces are converted into the same form ggjt files store them:
+// the whitespace marker becomes a regular space and byte pieces like <0x0A> become raw bytes
+// Byte-level BPE pieces of GPT-2 tokenizer are decoded into raw bytes too and the vocab gets BPE tokenizer
+// made of merges, so tokens are scored by merge ranks instead of SentencePiece scores
+func ggufVocab(meta ggufMeta) (*ml.Vocab, error) {
+
+	model := meta.str("tokenizer.ggml.model")
+	if model != "llama" && model != "gpt2" {
+		return nil, fmt.Errorf("unsupported tokenizer model '%s'", model)
+	}
+
+	tokens, ok := meta["tokenizer.ggml.tokens"].([]string)
+	if !ok {
+		return nil, fmt.Errorf("model metadata has no tokenizer.ggml.tokens")
+	}
+
+	scores, _ := meta["tokenizer.ggml.scores"].([]float32)
+	types, _ := meta["tokenizer.ggml.token_type"].([]int32)
+
+	var tokenizer ml.Tokenizer
+	if model == "gpt2" {
+		var err error
+		if tokenizer, err = gpt2Tokenizer(meta); err != nil {
+			return nil, err
+		}
+		decoder := gpt2Decoder()
+		decoded := make([]string, len(tokens))
+		for i, piece := range tokens {
+			decoded[i] = gpt2Decode(decoder, piece)
+		}
+		tokens = decoded
+	}
+
+	vocab := newVocab(tokens, scores, types, model == "llama")
+	vocab.Tokenizer = tokenizer
+
+	// GPT-2 family has no common special tokens, so only LLaMA defaults are kept when the metadata has none
+	if model == "gpt2" {
+		vocab.BOS, vocab.EOS, vocab.UNK = ml.TOKEN_NONE, ml.TOKEN_NONE, ml.TOKEN_NONE
+	}
+
+	for key, id := range map[string]*uint32{
+		"tokenizer.ggml.bos_token_id":     &vocab.BOS,
+		"tokenizer.ggml.eos_token_id":     &vocab.EOS,
+		"tokenizer.ggml.unknown_token_id": &vocab.UNK,
+		"tokenizer.ggml.padding_token_id": &vocab.PAD,
+	} {
+		if value, ok := meta.uint(key); ok {
+			if value >= vocab.Size {
+				return nil, fmt.Errorf("%s %d is out of vocab of %d tokens", key, value, vocab.Size)
+			}
+			*id = value
+		}
+	}
+
+	return vocab, nil
+}
+
+// newVocab makes vocab of pieces with their scores and types, missing scores are zeros and types are normal
+// SentencePiece whitespace markers become regular spaces when [spaces] is set
+func newVocab(pieces []string, scores []float32, types []int32, spaces bool) *ml.Vocab {
+
+	vocab := ml.NewVocab(uint32(len(pieces)))
+
+	for i, piece := range pieces {
+
+		score := float32(0.0)
+		if i < len(scores) {
+			score = scores[i]
+		}
+
+		tokenType := ml.TOKEN_TYPE_NORMAL
+		if i < len(types) {
+			tokenType = ml.TokenType(types[i])
+		}
+
+		token := piece
+		switch tokenType {
+		case ml.TOKEN_TYPE_BYTE:
+			if b, ok := parseByteToken(piece); ok {
+				token = string([]byte{b})
+			}
+		case ml.TOKEN_TYPE_UNKNOWN:
+			token = " ⁇ "
+		case ml.TOKEN_TYPE_CONTROL:
+			// keep as is
+		default:
+			if spaces {
+				token = strings.ReplaceAll(piece, "▁", " ")
+			}
+		}
+
+		vocab.ID2Token[i] = ml.TokenScore{Token: token, Score: score, Type: tokenType}
+
+		// control tokens should never be produced from the user text
+		if tokenType != ml.TOKEN_TYPE_CONTROL {
+			vocab.Token2ID[token] = uint32(i)
+		}
+	}
+
+	return vocab
+}
+
+// gpt2Patterns are pre-tokenization patterns by tokenizer.ggml.pre values, GPT-2 one is the default
+var gpt2Patterns = map[string]string{
+	"default":   ml.BPE_PATTERN_GPT2,
+	"gpt-2":     ml.BPE_PATTERN_GPT2,
+	"llama-bpe": ml.BPE_PATTERN_LLAMA3,
+	"llama3":    ml.BPE_PATTERN_LLAMA3,
+}
+
+// gpt2Tokenizer makes BPE tokenizer of merges decoded into raw bytes the same way as vocab pieces
+func gpt2Tokenizer(meta ggufMeta) (*ml.BPE, error) {
+
+	lines, ok := meta["tokenizer.ggml.merges"].([]string)
+	if !ok {
+		return nil, fmt.Errorf("model metadata has no tokenizer.ggml.merges")
+	}
+
+	pattern := ml.BPE_PATTERN_GPT2
+	if pre := meta.str("tokenizer.ggml.pre"); pre != "" {
+		if pattern, ok = gpt2Patterns[pre]; !ok {
+			return nil, fmt.Errorf("unsupported pre-tokenizer '%s'", pre)
+		}
+	}
+
+	decoder := gpt2Decoder()
+	merges := make([][2]string, 0, len(lines))
+
+	for _, line := range lines {
+		left, right, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("wrong BPE merge '%s'", line)
+		}
+		merges = append(merges, [2]string{gpt2Decode(decoder, left), gpt2Decode(decoder, right)})
+	}
+
+	return ml.NewBPE(merges, pattern)
+}
+
+// gpt2Decoder maps printable unicode chars of GPT-2 pieces back into bytes
+// GPT-2 maps bytes into printable unicode chars, the ones printable already stay as they are
+func gpt2Decoder() map[rune]byte {
+	decoder := make(map[rune]byte, 256)
+	n := 0
+	for b := 0; b < 256; b++ {
+		if b >= '!' && b <= '~' || b >= 0xA1 && b <= 0xAC || b >= 0xAE && b <= 0xFF {
+			decoder[rune(b)] = byte(b)
+		} else {
+			decoder[rune(256+n)] = byte(b)
+			n++
+		}
+	}
+	return decoder
+}
+
+// gpt2Decode converts byte-level BPE piece into raw bytes
+func gpt2Decode(decoder map[rune]byte, piece string) string {
+	decoded := make([]byte, 0, len(piece))
+	for _, r := range piece {
+		b, ok := decoder[r]
+		if !ok {
+			// added tokens like <|endoftext|> are not byte-level encoded
+			return piece
+		}
+		decoded = append(decoded, b)
+	}
+	return string(decoded)
+}
+
+// parseByteToken decodes SentencePiece byte pieces like <0x0A>
+func parseByteToken(piece string) (byte, bool) {
+	if len(piece) != 6 || !strings.HasPrefix(piece, "<0x") || piece[5] != '>' {
+		return 0, false
+	}
+	b, err := strconv.ParseUint(piece[3:5], 16, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(b), true
+}
+
+// ggufLayerTensors maps GGUF names of layer tensors into ggjt ones
+var ggufLayerTensors = map[string]string{
+	"attn_norm.weight":    "attention_norm.weight",
+	"attn_q.weight":       "attention.wq.weight",
+	"attn_k.weight":       "attention.wk.weight",
+	"attn_v.weight":       "attention.wv.weight",
+	"attn_output.weight":  "attention.wo.weight",
+	"ffn_norm.weight":     "ffn_norm.weight",
+	"ffn_gate.weight":     "feed_forward.w1.weight",
+	"ffn_down.weight":     "feed_forward.w2.weight",
+	"ffn_up.weight":       "feed_forward.w3.weight",
+	"ffn_gate_inp.weight": "feed_forward.router.weight",
+}
+
+// ggufExpertTensors maps GGUF names of expert matrices like ffn_gate.E.weight into ggjt-like ones
+var ggufExpertTensors = map[string]string{
+	"ffn_gate": "w1",
+	"ffn_down": "w2",
+	"ffn_up":   "w3",
+}
+
+// ggufTensorName converts GGUF tensor name into the name used by ggjt files
+func ggufTensorName(name string) string {
+
+	switch name {
+	case "token_embd.weight":
+		return "tok_embeddings.weight"
+	case "output_norm.weight":
+		return "norm.weight"
+	case "output.weight":
+		return "output.weight"
+	}
+
+	// blk.N.attn_q.weight => layers.N.attention.wq.weight
+	if !strings.HasPrefix(name, "blk.") {
+		return name
+	}
+
+	parts := strings.SplitN(name[len("blk."):], ".", 2)
+	if len(parts) != 2 {
+		return name
+	}
+
+	layer, suffix := parts[0], parts[1]
+
+	if mapped, ok := ggufLayerTensors[suffix]; ok {
+		return "layers." + layer + "." + mapped
+	}
+
+	// blk.N.ffn_gate.E.weight => layers.N.feed_forward.experts.E.w1.weight
+	if parts := strings.Split(suffix, "."); len(parts) == 3 && parts[2] == "weight" {
+		if mapped, ok := ggufExpertTensors[parts[0]]; ok {
+			return "layers." + layer + ".feed_forward.experts." + parts[1] + "." + mapped + ".weight"
+		}
+	}
+
+	return name
+}
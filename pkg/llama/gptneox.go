@@ -0,0 +1,158 @@
+package llama
+
+import (
+	"fmt"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// gptNeoXArch is GPT-NeoX of EleutherAI and its descendants like Pythia, Dolly-v2 or RedPajama-INCITE
+// The differences from LLaMA are LayerNorm with biases, GELU feed-forward of two matrices,
+// fused query-key-value weights, RoPE over a part of head dims and the parallel residual,
+// where attention and feed-forward both read the same input of the layer
+type gptNeoXArch struct{}
+
+func (gptNeoXArch) name() string {
+	return "gptneox"
+}
+
+func (gptNeoXArch) hparams(meta ggufMeta, hparams *HParams) error {
+
+	if hparams.kvHeadsCount != hparams.headsCount {
+		return fmt.Errorf("GPT-NeoX has no grouped-query attention, but %d KV heads for %d heads", hparams.kvHeadsCount, hparams.headsCount)
+	}
+
+	hparams.parallelResidual = true
+	if parallel, ok := meta["gptneox.use_parallel_residual"].(bool); ok {
+		hparams.parallelResidual = parallel
+	}
+
+	return nil
+}
+
+func (gptNeoXArch) tensorName(name string) string {
+	return name
+}
+
+func (gptNeoXArch) tensorShapes(hparams *HParams) map[string][4]uint32 {
+
+	embdSize := hparams.embdSize
+	vocabSize := hparams.vocabSize
+	ffSize := hparams.ffSize
+
+	shapes := map[string][4]uint32{
+		"token_embd.weight":  {embdSize, vocabSize, 1, 1},
+		"output_norm.weight": {embdSize, 1, 1, 1},
+		"output_norm.bias":   {embdSize, 1, 1, 1},
+		"output.weight":      {embdSize, vocabSize, 1, 1},
+	}
+
+	for i := uint32(0); i < hparams.layersCount; i++ {
+
+		prefix := fmt.Sprintf("blk.%d.", i)
+
+		shapes[prefix+"attn_norm.weight"] = [4]uint32{embdSize, 1, 1, 1}
+		shapes[prefix+"attn_norm.bias"] = [4]uint32{embdSize, 1, 1, 1}
+
+		shapes[prefix+"attn_qkv.weight"] = [4]uint32{embdSize, 3 * embdSize, 1, 1}
+		shapes[prefix+"attn_qkv.bias"] = [4]uint32{3 * embdSize, 1, 1, 1}
+		shapes[prefix+"attn_output.weight"] = [4]uint32{embdSize, embdSize, 1, 1}
+		shapes[prefix+"attn_output.bias"] = [4]uint32{embdSize, 1, 1, 1}
+
+		shapes[prefix+"ffn_norm.weight"] = [4]uint32{embdSize, 1, 1, 1}
+		shapes[prefix+"ffn_norm.bias"] = [4]uint32{embdSize, 1, 1, 1}
+
+		shapes[prefix+"ffn_up.weight"] = [4]uint32{embdSize, ffSize, 1, 1}
+		shapes[prefix+"ffn_up.bias"] = [4]uint32{ffSize, 1, 1, 1}
+		shapes[prefix+"ffn_down.weight"] = [4]uint32{ffSize, embdSize, 1, 1}
+		shapes[prefix+"ffn_down.bias"] = [4]uint32{embdSize, 1, 1, 1}
+	}
+
+	return shapes
+}
+
+func (gptNeoXArch) bind(model *Model, get func(name string) *ml.Tensor) {
+
+	model.tokEmbeddings = get("token_embd.weight")
+	model.norm = get("output_norm.weight")
+	model.normBias = get("output_norm.bias")
+	model.output = get("output.weight")
+
+	for i := range model.layers {
+
+		prefix := fmt.Sprintf("blk.%d.", i)
+		layer := &model.layers[i]
+
+		layer.attentionNorm = get(prefix + "attn_norm.weight")
+		layer.attentionNormBias = get(prefix + "attn_norm.bias")
+
+		layer.wqkv = get(prefix + "attn_qkv.weight")
+		layer.bqkv = get(prefix + "attn_qkv.bias")
+		layer.wo = get(prefix + "attn_output.weight")
+		layer.bo = get(prefix + "attn_output.bias")
+
+		layer.ffn_norm = get(prefix + "ffn_norm.weight")
+		layer.ffnNormBias = get(prefix + "ffn_norm.bias")
+
+		layer.w3 = get(prefix + "ffn_up.weight")
+		layer.b3 = get(prefix + "ffn_up.bias")
+		layer.w2 = get(prefix + "ffn_down.weight")
+		layer.b2 = get(prefix + "ffn_down.bias")
+	}
+}
+
+func (gptNeoXArch) build(eval *evalState, inpL *ml.Tensor) *ml.Tensor {
+
+	ctx0 := eval.ctx
+	model := eval.model
+
+	N := eval.N
+	headsCount := model.hparams.headsCount
+	headSize := model.hparams.embdSize / headsCount
+	rotCount := model.hparams.rotCount
+
+	for il := uint32(0); il < model.hparams.layersCount; il++ {
+
+		layer := &model.layers[il]
+
+		cur := eval.layerNorm(inpL, layer.attentionNorm, layer.attentionNormBias)
+
+		// self-attention
+		{
+			cur = eval.bias(eval.mulMat(layer.wqkv, cur), layer.bqkv)
+
+			// fused values are interleaved per head: query, key and value of the first head, then the second one, etc
+			rowSize := cur.NB[1]
+			Qcur := ml.View3D(ctx0, cur, headSize, headsCount, N, rowSize/headsCount, rowSize, 0*headSize)
+			Kcur := ml.View3D(ctx0, cur, headSize, headsCount, N, rowSize/headsCount, rowSize, 1*headSize)
+			Vcur := ml.View3D(ctx0, cur, headSize, headsCount, N, rowSize/headsCount, rowSize, 2*headSize)
+
+			Q := eval.ropeHeads(Qcur, headsCount, rotCount, ml.ROPE_MODE_NEOX)
+			K := eval.ropeHeads(Kcur, headsCount, rotCount, ml.ROPE_MODE_NEOX)
+
+			cur = eval.attention(il, Q, K, Vcur)
+
+			cur = eval.bias(eval.mulMat(layer.wo, cur), layer.bo)
+		}
+
+		// with the parallel residual feed-forward reads the layer input instead of attention output
+		inpFF := inpL
+		if !model.hparams.parallelResidual {
+			inpFF = ml.Add(ctx0, cur, inpL)
+		}
+
+		// feed-forward network
+		ff := eval.layerNorm(inpFF, layer.ffn_norm, layer.ffnNormBias)
+		ff = eval.bias(eval.mulMat(layer.w3, ff), layer.b3)
+		ff = ml.Gelu(ctx0, ff)
+		ff = eval.bias(eval.mulMat(layer.w2, ff), layer.b2)
+
+		if model.hparams.parallelResidual {
+			inpL = ml.Add(ctx0, ml.Add(ctx0, ff, cur), inpL)
+		} else {
+			inpL = ml.Add(ctx0, ff, inpFF)
+		}
+	}
+
+	return eval.layerNorm(inpL, model.norm, model.normBias)
+}
@@ -0,0 +1,159 @@
+package llama
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// ModelTensor describes the tensor stored within the model file
+type ModelTensor struct {
+	Name   string
+	Type   ml.DType // data type within the file
+	Dims   uint32
+	NE     [4]uint32
+	Offset int64 // file offset of the tensor data
+	Size   int64 // size of the tensor data within the file in bytes
+}
+
+// ModelInfo describes the model file without loading its weights
+type ModelInfo struct {
+	Format       string // ggjt or gguf
+	Architecture string // llama, gptneox or falcon
+	Type         ModelType
+	FileType     uint32 // ftype of llama.cpp, the data type used for most of weights
+
+	VocabSize    uint32
+	EmbdSize     uint32
+	MultSize     uint32
+	FFSize       uint32
+	HeadsCount   uint32
+	KVHeadsCount uint32 // less than HeadsCount for grouped-query attention
+	LayersCount  uint32
+	RotCount     uint32
+	CtxTrain     uint32 // context size the model was trained with (GGUF only)
+	ExpertsCount uint32 // zero for dense models
+	ExpertsUsed  uint32 // experts selected for each token
+
+	RopeFreqBase  float32
+	RopeFreqScale float32
+	RopeScaling   ml.RopeScaling
+
+	Vocab   *ml.Vocab
+	Tensors []ModelTensor
+
+	// Problems are the reasons LoadModel would fail with the file:
+	// *TensorError for unknown, wrong shaped or truncated tensors and ErrMissingTensor for absent ones
+	Problems []error
+}
+
+// ReadModelInfo reads the header, vocab and the table of tensors from the model file skipping weights data
+func ReadModelInfo(fileName string) (*ModelInfo, error) {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hparams := &HParams{}
+	format, vocab, tensors, err := readModelFile(file, hparams, false)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ModelInfo{
+		Format:       format,
+		Architecture: hparams.arch.name(),
+		Type:         hparams.modelType(),
+		FileType:     hparams.f16,
+
+		VocabSize:    hparams.vocabSize,
+		EmbdSize:     hparams.embdSize,
+		MultSize:     hparams.multSize,
+		FFSize:       hparams.ffSize,
+		HeadsCount:   hparams.headsCount,
+		KVHeadsCount: hparams.kvHeadsCount,
+		LayersCount:  hparams.layersCount,
+		RotCount:     hparams.rotCount,
+		CtxTrain:     hparams.ctxTrain,
+		ExpertsCount: hparams.expertsCount,
+		ExpertsUsed:  hparams.expertsUsed,
+
+		RopeFreqBase:  hparams.ropeFreqBase,
+		RopeFreqScale: hparams.ropeFreqScale,
+		RopeScaling:   hparams.ropeScaling,
+
+		Vocab:   vocab,
+		Tensors: make([]ModelTensor, 0, len(tensors)),
+	}
+
+	// --- check tensors the same way LoadModel does
+
+	shapes := hparams.tensorShapes()
+
+	for i := range tensors {
+		tensor := &tensors[i]
+
+		info.Tensors = append(info.Tensors, ModelTensor{
+			Name:   tensor.name,
+			Type:   tensor.dtype,
+			Dims:   tensor.dims,
+			NE:     tensor.ne,
+			Offset: tensor.offset,
+			Size:   tensor.size,
+		})
+
+		if err := checkTensor(shapes, tensor); err != nil {
+			info.Problems = append(info.Problems, err)
+		} else if tensor.offset+tensor.size > stat.Size() {
+			info.Problems = append(info.Problems, &TensorError{Name: tensor.name, Offset: tensor.offset, Err: ErrTruncatedFile})
+		}
+
+		delete(shapes, tensor.name)
+	}
+
+	// all expected tensors left are missing in the file
+	missing := make([]string, 0, len(shapes))
+	for name := range shapes {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+
+	for _, name := range missing {
+		info.Problems = append(info.Problems, fmt.Errorf("%w: '%s'", ErrMissingTensor, name))
+	}
+
+	return info, nil
+}
+
+// WeightsSize returns how many bytes the weights take in memory once loaded
+// FP16 weights are converted into FP32, so they need twice as much as within the file
+func (info *ModelInfo) WeightsSize() int64 {
+	var size int64
+	for _, tensor := range info.Tensors {
+		dtype := ml.TYPE_F32
+		if ml.IsQuantized(tensor.Type) {
+			dtype = tensor.Type
+		}
+		nelements := int64(tensor.NE[0]) * int64(tensor.NE[1]) * int64(tensor.NE[2]) * int64(tensor.NE[3])
+		size += nelements * int64(ml.TYPE_SIZE[dtype]) / int64(ml.BLCK_SIZE[dtype])
+	}
+	return size
+}
+
+// EstimateRAM returns approximate memory in bytes needed to run the model with the given context size
+// It counts weights, the key-value cache and logits, but not the temporary tensors of compute graph
+func (info *ModelInfo) EstimateRAM(ctxSize uint32) int64 {
+	kvEmbdSize := int64(info.EmbdSize) / int64(info.HeadsCount) * int64(info.KVHeadsCount)
+	kvCache := 2 * kvEmbdSize * int64(info.LayersCount) * int64(ctxSize) * 4
+	logits := int64(info.VocabSize) * 4
+	return info.WeightsSize() + kvCache + logits
+}
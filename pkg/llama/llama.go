@@ -2,6 +2,8 @@ package llama
 
 import (
 	"container/ring"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -46,6 +48,12 @@ type ModelParams struct {
 	BatchSize    uint32 // batch size for prompt processing
 	KeepCount    uint32
 
+	// --- RoPE settings override the model ones when set
+
+	RopeFreqBase  float32 // base frequency [ 10000.0 for LLaMA ]
+	RopeFreqScale float32 // the context is extended 1 / RopeFreqScale times, linear scaling is used if the type is not set
+	RopeScaling   string  // none, linear, ntk or yarn
+
 	// --- sampling parameters
 
 	TopK          uint32  // 40
@@ -67,10 +75,14 @@ type ModelParams struct {
 	Instruct   bool // instruction mode (used for Alpaca models)
 	IgnoreEOS  bool // do not stop generating after eos
 	Perplexity bool // compute perplexity over the prompt
-	UseMLock   bool // use mlock to keep model in memory
+	UseMMap    bool // map model file into memory instead of reading it, tensors of matching types are not copied
+	UseMLock   bool // use mlock to keep model in memory, works together with UseMMap
 	MemTest    bool // compute maximum memory usage
+	VocabOnly  bool // load only the vocab, LoadModel returns no model then
 
 	VerbosePrompt bool
+
+	LoraAdapters []LoraAdapter // merged into weights one by one after loading the model
 }
 
 // pair is a C++ inspired struct
@@ -85,12 +97,16 @@ type Context struct {
 	Logits    []float32 // decode output 2D array [tokensCount][vocabSize]
 	Embedding []float32 // input embedding 1D array [embdSize]
 	MLContext *ml.Context
+
+	Adapters []*Adapter // LoRA adapters Eval applies on top of the shared model weights
+
+	plan *plan // the graph of the last Eval call, it's reused while the batch fits it
 }
 
 // NewContext creates a new context.
 func NewContext(model *Model, params *ModelParams) *Context {
 	dt := ml.TYPE_F32
-	size := model.hparams.embdSize * model.hparams.layersCount * params.CtxSize
+	size := model.hparams.kvEmbdSize() * model.hparams.layersCount * params.CtxSize
 	return &Context{
 		kvSelf: KVCache{
 			K: ml.NewTensor1D(nil, dt, size), // Fixed OK
@@ -119,16 +135,19 @@ type ContextParams struct {
 	PartsCount int    // -1 for default
 	Seed       int    // RNG seed, 0 for random
 	LogitsAll  bool   // the llama_eval() call computes all logits, not just the last one
-	VocabOnly  bool   // only load the vocabulary, no weights
 	UseLock    bool   // force system to keep model in RAM
 	Embedding  bool   // embedding mode only
 }
 
 // Layer is a single layer of the model.
+// Architectures use only the tensors they need, others are left nil
 type Layer struct {
 
 	// normalization
-	attentionNorm *ml.Tensor
+	attentionNorm      *ml.Tensor
+	attentionNormBias  *ml.Tensor
+	attentionNorm2     *ml.Tensor // Falcon-40B normalizes attention input separately
+	attentionNorm2Bias *ml.Tensor
 
 	// attention
 	wq *ml.Tensor
@@ -136,25 +155,54 @@ type Layer struct {
 	wv *ml.Tensor
 	wo *ml.Tensor
 
+	wqkv *ml.Tensor // query, key and value fused into one matrix
+	bqkv *ml.Tensor
+	bo   *ml.Tensor
+
 	// normalization
-	ffn_norm *ml.Tensor
+	ffn_norm    *ml.Tensor
+	ffnNormBias *ml.Tensor
 
 	// ff
-	w1 *ml.Tensor
-	w2 *ml.Tensor
-	w3 *ml.Tensor
+	w1 *ml.Tensor // gate
+	w2 *ml.Tensor // down
+	w3 *ml.Tensor // up
+
+	b2 *ml.Tensor
+	b3 *ml.Tensor
+
+	// mixture of experts replaces w1, w2 and w3 with the same matrices of each expert
+	router    *ml.Tensor // scores experts for each token
+	w1Experts []*ml.Tensor
+	w2Experts []*ml.Tensor
+	w3Experts []*ml.Tensor
 }
 
 // HParams are the hyperparameters of the model (LLaMA-7B commented as example).
 type HParams struct {
-	ctxSize     uint32
-	vocabSize   uint32 // 32000
-	embdSize    uint32 // 4096
-	multSize    uint32 // 256
-	headsCount  uint32 // 32
-	layersCount uint32 // 32
-	rotCount    uint32 // 64
-	f16         uint32
+	arch architecture
+
+	ctxSize      uint32
+	ctxTrain     uint32 // context size the model was trained with (GGUF only)
+	vocabSize    uint32 // 32000
+	embdSize     uint32 // 4096
+	multSize     uint32 // 256
+	ffSize       uint32 // 11008
+	headsCount   uint32 // 32
+	kvHeadsCount uint32 // 32, less than headsCount for grouped-query attention (8 for LLaMA-2 70B)
+	layersCount  uint32 // 32
+	rotCount     uint32 // 64
+	f16          uint32
+
+	ropeFreqBase  float32 // 10000.0
+	ropeFreqScale float32 // 1.0
+	ropeScaling   ml.RopeScaling
+	ropeCtxOrig   uint32 // context size before scaling, used by YaRN
+
+	expertsCount uint32 // 8 for Mixtral, zero for dense models
+	expertsUsed  uint32 // 2 for Mixtral, experts selected for each token
+
+	parallelResidual bool // GPT-NeoX feeds attention and feed-forward with the same layer input
 }
 
 // ModelType is the type of the model.
@@ -167,8 +215,57 @@ const (
 	MODEL_13B
 	MODEL_30B
 	MODEL_65B
+	MODEL_3B
+	MODEL_70B
+	MODEL_8x7B
 )
 
+func (mt ModelType) String() string {
+	switch mt {
+	case MODEL_3B:
+		return "3B"
+	case MODEL_7B:
+		return "7B"
+	case MODEL_13B:
+		return "13B"
+	case MODEL_30B:
+		return "30B"
+	case MODEL_65B:
+		return "65B"
+	case MODEL_70B:
+		return "70B"
+	case MODEL_8x7B:
+		return "8x7B"
+	}
+	return "unknown"
+}
+
+// modelType guesses the model size by the number of layers the same way as llama.cpp does
+func (hparams *HParams) modelType() ModelType {
+	if hparams.arch != nil && hparams.arch.name() != "llama" {
+		return MODEL_UNKNOWN
+	}
+	switch hparams.layersCount {
+	case 26:
+		return MODEL_3B
+	case 32:
+		if hparams.expertsCount == 8 {
+			return MODEL_8x7B
+		}
+		return MODEL_7B
+	case 40:
+		return MODEL_13B
+	case 60:
+		return MODEL_30B
+	case 80:
+		if hparams.kvHeadsCount < hparams.headsCount {
+			return MODEL_70B
+		}
+		return MODEL_65B
+	}
+	return MODEL_UNKNOWN
+}
+
 // KVCache is a key-value cache for the self attention.
 type KVCache struct {
 	K *ml.Tensor
@@ -185,11 +282,14 @@ type Model struct {
 
 	tokEmbeddings *ml.Tensor
 	norm          *ml.Tensor
+	normBias      *ml.Tensor
 	output        *ml.Tensor
 
 	layers []Layer
 
 	tensors map[string]*ml.Tensor
+
+	mapping []byte // memory mapped model file, when some tensors point straight into it
 }
 
 // NewModel creates a new model with default hyperparameters.
@@ -203,7 +303,25 @@ func NewModel(params *ModelParams) *Model {
 	}
 }
 
-// Eval runs one inference iteration over the LLaMA model
+// Release unmaps the model file, so the model should not be used after that
+func (model *Model) Release() error {
+	model.tokEmbeddings = nil
+	model.norm = nil
+	model.normBias = nil
+	model.output = nil
+	model.layers = nil
+	model.tensors = make(map[string]*ml.Tensor)
+
+	if model.mapping == nil {
+		return nil
+	}
+	mapping := model.mapping
+	model.mapping = nil
+	return munmapFile(mapping)
+}
+
+// Eval runs one inference iteration over the model of any supported architecture
+// The graph is kept within the context and computed again for next batches of the same size
 // lctx = model context with all LLaMA data
 // tokens = new batch of tokens to process
 // pastCount = the context size so far
@@ -218,175 +336,41 @@ func Eval(
 ) error {
 
 	N := uint32(len(tokens))
-	kvSelf := lctx.kvSelf
 
 	embdSize := model.hparams.embdSize
-	layersCount := model.hparams.layersCount
-	ctxSize := model.hparams.ctxSize
-	headsCount := model.hparams.headsCount
 	vocabSize := model.hparams.vocabSize
-	rotCount := model.hparams.embdSize / model.hparams.headsCount
 
-	ctx0 := lctx.MLContext
-
-	graph := &ml.Graph{
-		//MaxThreads: params.MaxThreads,
-		//UseNEON:    params.UseNEON,
-		//UseAVX:     params.UseAVX,
-	}
-
-	// Initialize the embd tensor with the tokensFloat32 data
-	embd := ml.NewTensor1D(ctx0, ml.TYPE_F32, uint32(len(tokens))) // Reusable OK
-	for i, token := range tokens {
-		embd.Data[i] = float32(token)
+	if N == 0 || pastCount+N > model.hparams.ctxSize {
+		return fmt.Errorf("%d tokens after %d past ones don't fit the context of %d: %w",
+			N, pastCount, model.hparams.ctxSize, ErrShapeMismatch)
 	}
 
-	inpL := ml.GetRows(ctx0, model.tokEmbeddings, embd)
-
-	for il := uint32(0); il < layersCount; il++ {
-
-		//if il > 0 {
-		//	break // DEBUG
-		//}
-
-		inpSA := inpL
-
-		// norm
-		cur := ml.RMSNorm(ctx0, inpL)
-
-		// cur = attention_norm*cur
-		rep := ml.Repeat(ctx0, model.layers[il].attentionNorm, cur)
-		cur = ml.Mul(ctx0, rep, cur)
-
-		// self-attention
-		{
-			Qcur := ml.MulMat(ctx0, model.layers[il].wq, cur)
-			Kcur := ml.MulMat(ctx0, model.layers[il].wk, cur)
-			Vcur := ml.MulMat(ctx0, model.layers[il].wv, cur)
-
-			// store key and value to memory
-			if N >= 1 {
-
-				////struct ggml_tensor * k = ggml_view_1d(ctx0, kv_self.k, N*n_embd, (ggml_element_size(kv_self.k)*n_embd)*(il*n_ctx + n_past));
-				////struct ggml_tensor * v = ggml_view_1d(ctx0, kv_self.v, N*n_embd, (ggml_element_size(kv_self.v)*n_embd)*(il*n_ctx + n_past));
-
-				// NB! ggml_element_size(kv_self.k) = 2 for FP16
-				k := ml.View1D(ctx0, kvSelf.K, N*embdSize, embdSize*(il*ctxSize+pastCount))
-				v := ml.View1D(ctx0, kvSelf.V, N*embdSize, embdSize*(il*ctxSize+pastCount))
-
-				ml.BuildForwardExpand(graph, ml.Copy(ctx0, Kcur, k))
-				ml.BuildForwardExpand(graph, ml.Copy(ctx0, Vcur, v))
-			}
-
-			Q :=
-				ml.Permute(ctx0,
-					ml.Rope(ctx0,
-						ml.Copy(ctx0,
-							Qcur,
-							ml.NewTensor3D(ctx0, ml.TYPE_F32, embdSize/headsCount, headsCount, N)), // Reusable OK
-						pastCount, rotCount, 0),
-					0, 2, 1, 3)
-
-			K :=
-				ml.Permute(ctx0,
-					ml.Rope(ctx0,
-						ml.Reshape3D(ctx0,
-							ml.View1D(ctx0, kvSelf.K, (pastCount+N)*embdSize, il*ctxSize*embdSize),
-							embdSize/headsCount, headsCount, pastCount+N),
-						pastCount, rotCount, 1),
-					0, 2, 1, 3)
-
-			// K * Q
-			KQ := ml.MulMat(ctx0, K, Q)
-
-			// KQ_scaled = KQ / sqrt(n_embd/n_head)
-			KQScaled :=
-				ml.Scale(ctx0,
-					KQ,
-					ml.NewFP32(ctx0, float32(1.0/math.Sqrt(float64(embdSize)/float64(headsCount)))),
-				)
-
-			// KQ_masked = mask_past(KQ_scaled)
-			KQMasked := ml.DiagMaskInf(ctx0, KQScaled, pastCount)
-
-			// KQ = soft_max(KQ_masked)
-			KQSoftMax := ml.SoftMax(ctx0, KQMasked)
-
-			VTrans :=
-				ml.Copy(ctx0,
-					ml.Permute(ctx0,
-						ml.Reshape3D(ctx0,
-							ml.View1D(ctx0, kvSelf.V, (pastCount+N)*embdSize, il*ctxSize*embdSize),
-							embdSize/headsCount, headsCount, pastCount+N),
-						1, 2, 0, 3),
-					ml.NewTensor3D(ctx0, ml.TYPE_F32 /* kv_self.v->type */, pastCount+N, embdSize/headsCount, headsCount))
-
-			// KQV = transpose(V) * KQ_soft_max
-			KQV := ml.MulMat(ctx0, VTrans, KQSoftMax)
-
-			// KQV_merged = KQV.permute(0, 2, 1, 3)
-			KQVMerged := ml.Permute(ctx0, KQV, 0, 2, 1, 3)
-
-			// cur = KQV_merged.contiguous().view(n_embd, N)
-			cur = ml.Copy(ctx0,
-				KQVMerged,
-				ml.NewTensor2D(ctx0, ml.TYPE_F32, embdSize, N)) // Reusable OK
-
-			// projection (no bias)
-			cur = ml.MulMat(ctx0, model.layers[il].wo, cur)
-
-		}
-
-		inpFF := ml.Add(ctx0, cur, inpSA)
-
-		// feed-forward network
-		{
-			// norm
-			{
-				cur = ml.RMSNorm(ctx0, inpFF)
-
-				// cur = ffn_norm*cur
-				cur = ml.Mul(ctx0,
-					ml.Repeat(ctx0, model.layers[il].ffn_norm, cur),
-					cur)
-			}
-
-			tmp := ml.MulMat(ctx0, model.layers[il].w3, cur)
-
-			cur = ml.MulMat(ctx0, model.layers[il].w1, cur)
-
-			// SILU activation
-			cur = ml.Silu(ctx0, cur)
-
-			cur = ml.Mul(ctx0, cur, tmp)
+	ctx0 := lctx.MLContext
 
-			cur = ml.MulMat(ctx0, model.layers[il].w2, cur)
+	// the graph is built once and then computed for next tokens until the batch or the cache length changes
+	kvLen := kvLength(model.hparams, N, pastCount)
+	if lctx.plan == nil || !lctx.plan.fits(lctx, N, kvLen) {
+		if lctx.plan != nil {
+			// It really helps to eliminate degradation of performance when
+			// the garbage collector frees the previous graph before the new one is built
+			lctx.plan = nil
+			runtime.GC()
 		}
-
-		cur = ml.Add(ctx0, cur, inpFF)
-
-		// input for next layer
-		inpL = cur
+		lctx.plan = buildPlan(lctx, model, N, kvLen)
 	}
 
-	// --- norm
-
-	inpL = ml.RMSNorm(ctx0, inpL)
-
-	// inpL = norm*inpL
-	inpL = ml.Mul(ctx0,
-		ml.Repeat(ctx0, model.norm, inpL),
-		inpL)
-
-	embeddings := inpL
-
-	// lm_head
-	inpL = ml.MulMat(ctx0, model.output, inpL)
+	plan := lctx.plan
+	if err := plan.bind(tokens, pastCount); err != nil {
+		return err
+	}
 
 	// run the computation
-	ml.BuildForwardExpand(graph, inpL)
+	if err := ml.GraphCompute(ctx0, plan.graph); err != nil {
+		return err
+	}
 
-	ml.GraphCompute(ctx0, graph)
+	inpL := plan.logits
+	embeddings := plan.embeddings
 
 	// --- extract logits
 
@@ -394,8 +378,7 @@ func Eval(
 	for i := uint32(0); i < vocabSize; i++ {
 		srcIndex := vocabSize*(N-1) + i
 		if i >= uint32(len(lctx.Logits)) || srcIndex >= uint32(len(inpL.Data)) {
-			fmt.Println("Error: Index out of bounds during Logits copy")
-			os.Exit(1)
+			return fmt.Errorf("logits index %d is out of bounds: %w", srcIndex, ErrShapeMismatch)
 		}
 		lctx.Logits[i] = inpL.Data[srcIndex]
 	}
@@ -418,10 +401,6 @@ func Eval(
 		}
 	}
 
-	// It really helps to eliminate degradation of performance when
-	// the garbage collector do it job more often
-	runtime.GC()
-
 	return nil
 }
 
@@ -707,77 +686,224 @@ func SampleTopPTopK(
 }
 
 // LoadModel loads a model's weights from a file
-// See convert-pth-to-ggml.py for details on format
+// Both ggjt (see convert-pth-to-ggml.py for details) and GGUF formats are supported,
+// the format is detected by the magic in the file header
 // func LoadModel(fileName string, params ModelParams, silent bool) (*Context, error) {
 func LoadModel(fileName string, params *ModelParams, silent bool) (*ml.Vocab, *Model, error) {
 
+	if params.VocabOnly {
+		vocab, err := LoadVocab(fileName)
+		return vocab, nil, err
+	}
+
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer file.Close()
 
-	// --- check header magic and format version
+	model := NewModel(params)
 
-	magic := readInt(file)
+	// --- check header magic and read hparams, vocab and the table of tensors
 
-	if magic == LLAMA_FILE_MAGIC_UNVERSIONED || magic == LLAMA_FILE_MAGIC_OLD {
-		fmt.Printf("\n[ERROR] Invalid model file '%s'! Too old, regenerate!", fileName)
-		return nil, nil, fmt.Errorf("invalid model file")
+	if !silent && runtime.GOOS == "windows" {
+		Colorize("[magenta][ INIT ][white] Loading vocab...")
 	}
 
-	if magic != LLAMA_FILE_MAGIC {
-		fmt.Printf("\n[ERROR] Invalid model file '%s'! Wrong MAGIC in header", fileName)
-		return nil, nil, fmt.Errorf("invalid model file")
+	_, vocab, tensors, err := readModelFile(file, model.hparams, false)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	version := readInt(file)
+	model.Type = model.hparams.modelType()
 
-	if version != LLAMA_FILE_VERSION {
-		fmt.Printf("\n[ERROR] Invalid model file '%s'! Unsupported version", fileName)
-		return nil, nil, fmt.Errorf("invalid model file")
+	if err := model.hparams.setRope(params); err != nil {
+		return nil, nil, err
 	}
 
-	// --- load hparams
+	if ml.DEBUG {
+		fmt.Printf("\nvocab  = %d", model.hparams.vocabSize)
+		fmt.Printf("\nembd   = %d", model.hparams.embdSize)
+		fmt.Printf("\nmult   = %d", model.hparams.multSize)
+		fmt.Printf("\nheads  = %d", model.hparams.headsCount)
+		fmt.Printf("\nkv     = %d", model.hparams.kvHeadsCount)
+		fmt.Printf("\nlayers = %d", model.hparams.layersCount)
+		fmt.Printf("\nff     = %d", model.hparams.ffSize)
+		fmt.Printf("\nrot    = %d", model.hparams.rotCount)
+		fmt.Printf("\nf16    = %d", model.hparams.f16)
+	}
 
-	vocabSize := readInt(file)   // vocab_size
-	embdSize := readInt(file)    // dim
-	multSize := readInt(file)    // multiple_of
-	headsCount := readInt(file)  // n_heads
-	layersCount := readInt(file) // n_layers
-	rotCount := readInt(file)    // [obsolete] rot = dim // n_heads
-	f16 := readInt(file)         // ftype
+	// --- load weights
 
-	model := NewModel(params)
+	if !silent /* && runtime.GOOS == "windows" */ {
+		//Colorize("[magenta][ INIT ][white] Loading model - please wait ...")
+		Colorize("[light_magenta][ INIT ][light_blue] Loading model, please wait ")
+	}
 
-	model.hparams.vocabSize = vocabSize
-	model.hparams.embdSize = embdSize
-	model.hparams.multSize = multSize
-	model.hparams.headsCount = headsCount
-	model.hparams.layersCount = layersCount
-	model.hparams.rotCount = rotCount
-	model.hparams.f16 = f16
+	var mapping []byte
+	if params.UseMMap {
+		if mapping, err = mmapFile(file); err != nil {
+			return nil, nil, fmt.Errorf("failed to map model file: %w", err)
+		}
+	}
 
-	ffSize := ((2*(4*embdSize)/3 + multSize - 1) / multSize) * multSize
+	mapped, err := loadTensors(file, mapping, model, tensors, silent)
+	if err != nil {
+		if mapping != nil {
+			munmapFile(mapping)
+		}
+		return nil, nil, err
+	}
 
-	vocab := ml.NewVocab(vocabSize)
+	// keep the mapping only while there are tensors pointing into it
+	if mapping != nil && mapped == 0 {
+		munmapFile(mapping)
+	} else if mapping != nil {
+		model.mapping = mapping
+		if params.UseMLock {
+			if err := mlockFile(mapping); err != nil && !silent {
+				Colorize("\n[magenta][ WARN ][white] Failed to lock model in memory: %s ", err.Error())
+			}
+		}
+	}
 
-	if ml.DEBUG {
-		fmt.Printf("\nvocab  = %d", vocabSize)
-		fmt.Printf("\nembd   = %d", embdSize)
-		fmt.Printf("\nmult   = %d", multSize)
-		fmt.Printf("\nheads  = %d", headsCount)
-		fmt.Printf("\nlayers = %d", layersCount)
-		fmt.Printf("\nff     = %d", ffSize)
-		fmt.Printf("\nrot    = %d", rotCount)
-		fmt.Printf("\nf16    = %d", f16)
+	if err := model.bindTensors(); err != nil {
+		model.Release()
+		return nil, nil, err
 	}
 
-	// --- load vocab
+	for _, adapter := range params.LoraAdapters {
+		if !silent {
+			Colorize("\n[light_magenta][ INIT ][light_blue] Applying LoRA adapter [light_magenta]%s[light_blue] with scale [light_magenta]%.2f[light_blue] ", adapter.Path, adapter.Scale)
+		}
+		if err := model.applyLora(adapter, params.MaxThreads); err != nil {
+			model.Release()
+			return nil, nil, err
+		}
+	}
 
-	if !silent && runtime.GOOS == "windows" {
-		Colorize("[magenta][ INIT ][white] Loading vocab...")
+	return vocab, model, nil
+}
+
+// LoadVocab reads only the header and vocab of the model file, so texts could be tokenized without loading weights
+func LoadVocab(fileName string) (*ml.Vocab, error) {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
+
+	_, vocab, _, err := readModelFile(file, &HParams{}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return vocab, nil
+}
+
+// readModelFile checks the header magic and reads hparams, vocab and the table of tensors
+// It returns the name of file format, the file position is left somewhere after the header
+// The table of tensors is not read at all with [vocabOnly] set
+func readModelFile(file *os.File, hparams *HParams, vocabOnly bool) (string, *ml.Vocab, []tensorInfo, error) {
+
+	var format string
+	var vocab *ml.Vocab
+	var tensors []tensorInfo
+	var err error
+
+	magic, err := readInt(file)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	switch magic {
+	case LLAMA_FILE_MAGIC:
+		format = "ggjt"
+		vocab, tensors, err = readGGJT(file, hparams, vocabOnly)
+	case GGUF_MAGIC:
+		format = "gguf"
+		vocab, tensors, err = readGGUF(file, hparams, vocabOnly)
+	case LLAMA_FILE_MAGIC_UNVERSIONED, LLAMA_FILE_MAGIC_OLD:
+		return "", nil, nil, fmt.Errorf("%w: format is too old, regenerate it", ErrInvalidFile)
+	default:
+		return "", nil, nil, fmt.Errorf("%w: wrong magic 0x%08x in header", ErrInvalidFile, magic)
+	}
+
+	if err != nil {
+		if errors.Is(err, ErrTruncatedFile) {
+			return "", nil, nil, err
+		}
+		return "", nil, nil, fmt.Errorf("%w: %w", ErrInvalidFile, err)
+	}
+
+	return format, vocab, tensors, nil
+}
+
+// tensorInfo describes a single tensor stored within the model file
+type tensorInfo struct {
+	name   string
+	dims   uint32
+	ne     [4]uint32
+	dtype  ml.DType // data type within the file
+	offset int64    // absolute file offset of the tensor data
+	size   int64    // size of the tensor data in bytes
+
+	repack func(dst, src []byte) // converts quantized blocks from the file layout into in-memory one
+}
+
+// nelements returns the number of tensor elements
+func (info *tensorInfo) nelements() int64 {
+	return int64(info.ne[0]) * int64(info.ne[1]) * int64(info.ne[2]) * int64(info.ne[3])
+}
+
+// nbytes computes the size of tensor data for ggml data types
+func (info *tensorInfo) nbytes() int64 {
+	return info.nelements() * int64(ml.TYPE_SIZE[info.dtype]) / int64(ml.BLCK_SIZE[info.dtype])
+}
+
+// readGGJT reads hparams, vocab and the table of tensors unless [vocabOnly] is set from ggjt file
+// The file should be positioned right after the magic
+func readGGJT(file *os.File, hparams *HParams, vocabOnly bool) (*ml.Vocab, []tensorInfo, error) {
+
+	version, err := readInt(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if version != LLAMA_FILE_VERSION {
+		return nil, nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	// --- load hparams
+
+	for _, value := range []*uint32{
+		&hparams.vocabSize,   // vocab_size
+		&hparams.embdSize,    // dim
+		&hparams.multSize,    // multiple_of
+		&hparams.headsCount,  // n_heads
+		&hparams.layersCount, // n_layers
+		&hparams.rotCount,    // [obsolete] rot = dim // n_heads
+		&hparams.f16,         // ftype
+	} {
+		if *value, err = readInt(file); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if hparams.multSize == 0 || hparams.headsCount == 0 || hparams.embdSize%hparams.headsCount != 0 {
+		return nil, nil, fmt.Errorf("wrong hparams in header")
+	}
+
+	// ggjt format was never used for anything but LLaMA
+	hparams.arch = llamaArch{}
+
+	hparams.ffSize = ggjtFFSize(hparams.embdSize, hparams.multSize)
+	hparams.ropeFreqBase = 10000.0
+	hparams.ropeFreqScale = 1.0
+
+	// --- load vocab
+
 	/*
 	       // https://pkg.go.dev/github.com/schollz/progressbar/v3#Option
 	   	vocabBar := progressbar.NewOptions(
@@ -796,15 +922,48 @@ func LoadModel(fileName string, params *ModelParams, silent bool) (*ml.Vocab, *M
 	   			BarEnd:        "[dark_gray]║[reset]",
 	   		}))
 	*/
-	for i := uint32(0); i < vocabSize; i++ {
+
+	// each token takes at least 8 bytes for its length and score, so corrupted sizes are caught before anything is allocated for them
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, err
+	}
+	left := stat.Size() - offset
+
+	if uint64(hparams.vocabSize) > uint64(left)/8 {
+		return nil, nil, fmt.Errorf("too big vocab of %d tokens", hparams.vocabSize)
+	}
+
+	vocab := ml.NewVocab(hparams.vocabSize)
+
+	for i := uint32(0); i < hparams.vocabSize; i++ {
 
 		//if !silent && runtime.GOOS != "windows" && i%100 == 0 {
 		//	vocabBar.Set(int(i))
 		//}
 
-		length := readInt(file)
-		token := readString(file, length)
-		score := readFP32(file)
+		length, err := readInt(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if left -= 4; int64(length) > left {
+			return nil, nil, fmt.Errorf("too long token %d of %d bytes", i, length)
+		}
+		left -= int64(length) + 4
+
+		token, err := readString(file, length)
+		if err != nil {
+			return nil, nil, err
+		}
+		score, err := readFP32(file)
+		if err != nil {
+			return nil, nil, err
+		}
 
 		vocab.Token2ID[token] = i
 		vocab.ID2Token[i] = ml.TokenScore{Token: token, Score: score}
@@ -815,57 +974,176 @@ func LoadModel(fileName string, params *ModelParams, silent bool) (*ml.Vocab, *M
 	//	fmt.Printf("\n")
 	//}
 
-	// --- prepare memory for the weights
-	{
-		model.tokEmbeddings = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, embdSize, vocabSize) // Fixed OK
+	if vocabOnly {
+		return vocab, nil, nil
+	}
 
-		model.norm = ml.NewTensor1D(nil, ml.TYPE_F32, embdSize)                        // Fixed OK
-		model.output = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, embdSize, vocabSize) // Fixed OK
+	// --- read the table of tensors skipping their data
 
-		// map by name
-		model.tensors["tok_embeddings.weight"] = model.tokEmbeddings
+	tensors := make([]tensorInfo, 0)
+	for {
+		start, err := file.Seek(0, io.SeekCurrent) // of the tensor header
+		if err != nil {
+			return nil, nil, err
+		}
+		if start >= stat.Size() {
+			break
+		}
 
-		model.tensors["norm.weight"] = model.norm
-		model.tensors["output.weight"] = model.output
+		dims, err := readInt(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if dims < 1 || dims > 2 {
+			break
+		}
 
-		model.layers = make([]Layer, layersCount)
-		for i := uint32(0); i < layersCount; i++ {
+		var header [2]uint32 // length of the name and data type
+		for i := range header {
+			if header[i], err = readInt(file); err != nil {
+				return nil, nil, err
+			}
+		}
+		nameLength, dtype := header[0], ml.DType(header[1])
 
-			model.layers[i].attentionNorm = ml.NewTensor1D(nil, ml.TYPE_F32, embdSize) // Fixed OK
+		if dtype >= ml.TYPE_COUNT || ml.BLCK_SIZE[dtype] == 0 {
+			return nil, nil, fmt.Errorf("tensor of type %d: %w", dtype, ErrUnsupportedDType)
+		}
 
-			model.layers[i].wq = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, embdSize, embdSize) // Fixed OK
-			model.layers[i].wk = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, embdSize, embdSize) // Fixed OK
-			model.layers[i].wv = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, embdSize, embdSize) // Fixed OK
-			model.layers[i].wo = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, embdSize, embdSize) // Fixed OK
+		info := tensorInfo{
+			dims:  dims,
+			ne:    [4]uint32{1, 1, 1, 1},
+			dtype: dtype,
+		}
 
-			model.layers[i].ffn_norm = ml.NewTensor1D(nil, ml.TYPE_F32, embdSize)
+		for i := 0; i < int(dims); i++ {
+			if info.ne[i], err = readInt(file); err != nil {
+				return nil, nil, err
+			}
+		}
 
-			model.layers[i].w1 = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, embdSize, ffSize) // Fixed OK
-			model.layers[i].w2 = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, ffSize, embdSize) // Fixed OK
-			model.layers[i].w3 = ml.NewTensor2D(nil, ml.TYPE_F32 /*wtype*/, embdSize, ffSize) // Fixed OK
+		if int64(nameLength) > stat.Size()-start {
+			return nil, nil, fmt.Errorf("too long tensor name of %d bytes", nameLength)
+		}
+		if info.name, err = readString(file, nameLength); err != nil {
+			return nil, nil, err
+		}
+		info.size = info.nbytes()
 
-			// map by name
-			prefix := fmt.Sprintf("layers.%d.", i)
+		// --- All tensors in file are aligned for 32 bytes
 
-			model.tensors[prefix+"attention_norm.weight"] = model.layers[i].attentionNorm
+		alignment := int64(32)
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rem := offset % alignment; rem != 0 {
+			offset += alignment - rem
+		}
+		info.offset = offset
 
-			model.tensors[prefix+"attention.wq.weight"] = model.layers[i].wq
-			model.tensors[prefix+"attention.wk.weight"] = model.layers[i].wk
-			model.tensors[prefix+"attention.wv.weight"] = model.layers[i].wv
-			model.tensors[prefix+"attention.wo.weight"] = model.layers[i].wo
+		if _, err := file.Seek(offset+info.size, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
 
-			model.tensors[prefix+"ffn_norm.weight"] = model.layers[i].ffn_norm
+		tensors = append(tensors, info)
+	}
+
+	// --- ggjt header has no number of KV heads, so take it from the shape of keys projection
+	// LLaMA-2 70B feed-forward size doesn't follow multSize either, so it's taken from the weights too
 
-			model.tensors[prefix+"feed_forward.w1.weight"] = model.layers[i].w1
-			model.tensors[prefix+"feed_forward.w2.weight"] = model.layers[i].w2
-			model.tensors[prefix+"feed_forward.w3.weight"] = model.layers[i].w3
+	hparams.kvHeadsCount = hparams.headsCount
+	for _, info := range tensors {
+		switch info.name {
+		case "layers.0.attention.wk.weight":
+			headSize := hparams.embdSize / hparams.headsCount
+			if kvHeadsCount := info.ne[1] / headSize; kvHeadsCount > 0 && info.ne[1]%headSize == 0 && hparams.headsCount%kvHeadsCount == 0 {
+				hparams.kvHeadsCount = kvHeadsCount
+			}
+		case "layers.0.feed_forward.w1.weight":
+			hparams.ffSize = info.ne[1]
 		}
 	}
 
-	if !silent /* && runtime.GOOS == "windows" */ {
-		//Colorize("[magenta][ INIT ][white] Loading model - please wait ...")
-		Colorize("[light_magenta][ INIT ][light_blue] Loading model, please wait ")
+	return vocab, tensors, nil
+}
+
+// ropeScalings are the names of RoPE scaling types
+var ropeScalings = map[string]ml.RopeScaling{
+	"none":   ml.ROPE_SCALING_NONE,
+	"linear": ml.ROPE_SCALING_LINEAR,
+	"ntk":    ml.ROPE_SCALING_NTK,
+	"yarn":   ml.ROPE_SCALING_YARN,
+}
+
+// setRope overrides RoPE settings read from the model file with the user ones
+func (hparams *HParams) setRope(params *ModelParams) error {
+
+	if params.RopeFreqBase != 0 {
+		hparams.ropeFreqBase = params.RopeFreqBase
+	}
+
+	if params.RopeFreqScale != 0 {
+		hparams.ropeFreqScale = params.RopeFreqScale
+		if hparams.ropeScaling == ml.ROPE_SCALING_NONE {
+			hparams.ropeScaling = ml.ROPE_SCALING_LINEAR
+		}
+	}
+
+	if params.RopeScaling != "" {
+		scaling, ok := ropeScalings[params.RopeScaling]
+		if !ok {
+			return fmt.Errorf("unknown RoPE scaling '%s', should be one of none, linear, ntk or yarn", params.RopeScaling)
+		}
+		hparams.ropeScaling = scaling
+	}
+
+	// YaRN needs the trained context, guess it from the scale when the model doesn't tell
+	if hparams.ropeCtxOrig == 0 {
+		hparams.ropeCtxOrig = hparams.ctxTrain
+	}
+	if hparams.ropeCtxOrig == 0 {
+		hparams.ropeCtxOrig = uint32(float32(hparams.ctxSize) * hparams.ropeFreqScale)
 	}
+
+	return nil
+}
+
+// kvEmbdSize returns the size of keys and values for one token, it's less than embdSize for grouped-query attention
+func (hparams *HParams) kvEmbdSize() uint32 {
+	return hparams.embdSize / hparams.headsCount * hparams.kvHeadsCount
+}
+
+// tensorShapes returns the expected shapes of all model tensors by their names
+func (hparams *HParams) tensorShapes() map[string][4]uint32 {
+	return hparams.arch.tensorShapes(hparams)
+}
+
+// checkTensor returns *TensorError if the tensor is not expected by the model or has the wrong shape
+func checkTensor(shapes map[string][4]uint32, info *tensorInfo) error {
+
+	shape, ok := shapes[info.name]
+	if !ok {
+		return &TensorError{Name: info.name, Offset: info.offset, Err: ErrUnknownTensor}
+	}
+
+	if shape != info.ne {
+		err := fmt.Errorf("%w %v, expected %v", ErrShapeMismatch, info.ne, shape)
+		return &TensorError{Name: info.name, Offset: info.offset, Err: err}
+	}
+
+	if ml.IsQuantized(info.dtype) && info.ne[0]%ml.BLCK_SIZE[info.dtype] != 0 {
+		err := fmt.Errorf("%w: rows of %d elements can't be split into quantized blocks", ErrShapeMismatch, info.ne[0])
+		return &TensorError{Name: info.name, Offset: info.offset, Err: err}
+	}
+
+	return nil
+}
+
+// loadTensors reads tensors from the file, or points them straight into the mapped file when possible
+// It returns how many tensors are sharing the memory of mapping
+func loadTensors(file *os.File, mapping []byte, model *Model, tensors []tensorInfo, silent bool) (int, error) {
+
 	/*
 		// https://pkg.go.dev/github.com/schollz/progressbar/v3#Option
 		bar := progressbar.NewOptions(int(layersCount*9),
@@ -884,80 +1162,68 @@ func LoadModel(fileName string, params *ModelParams, silent bool) (*ml.Vocab, *M
 			}))
 	*/
 
-	// --- load weights
-	var tensorsCount uint32
-	for {
-		dims := readInt(file)
-		if dims < 1 || dims > 2 { // TODO Check for EOF
-			break
-		}
-
-		nameLength := readInt(file)
-		shardType := ml.DType(readInt(file))
+	shapes := model.hparams.tensorShapes()
 
-		nelements := 1
-		ne := [2]uint32{1, 1}
-		for i := 0; i < int(dims); i++ {
-			ne[i] = readInt(file)
-			nelements *= int(ne[i])
-		}
+	var tensorsCount uint32
+	var mappedCount int
+	for _, info := range tensors {
 
-		name := readString(file, nameLength)
-		tensor, ok := model.tensors[name]
-		if !ok {
-			fmt.Printf("\n[ERROR] Unknown tensor '%s' in model file", name)
-			os.Exit(1)
+		if err := checkTensor(shapes, &info); err != nil {
+			return mappedCount, err
 		}
 
 		if ml.DEBUG {
 			typeStr := "FP32"
-			if shardType == ml.TYPE_F16 {
+			switch info.dtype {
+			case ml.TYPE_F16:
 				typeStr = "FP16"
+			case ml.TYPE_Q4_0:
+				typeStr = "Q4_0"
+			case ml.TYPE_Q4_1:
+				typeStr = "Q4_1"
+			case ml.TYPE_Q8_0:
+				typeStr = "Q8_0"
 			}
-			memStr := fmt.Sprintf("%dM", nelements*4/1024/1024)
-			fmt.Printf("\n=== LAYER #%d === %s | %s | %s ===", tensorsCount, typeStr, name, memStr)
+			memStr := fmt.Sprintf("%dM", info.size/1024/1024)
+			fmt.Printf("\n=== LAYER #%d === %s | %s | %s ===", tensorsCount, typeStr, info.name, memStr)
 		}
 
-		tensorSize := tensor.Nelements()
-
-		// --- All tensors in file are aligned for 32 bytes
-
-		// TODO: Align with one modulo operation
-		alignment := int64(32)
-		offset, _ := file.Seek(0, io.SeekCurrent)
-		for ; offset%alignment != 0; offset++ {
+		// quantized weights are kept as is, all others are converted into FP32
+		dtype := ml.TYPE_F32
+		if ml.IsQuantized(info.dtype) {
+			dtype = info.dtype
 		}
-		_, err = file.Seek(offset, io.SeekStart)
-		if err != nil {
-			return nil, nil, err
+
+		var raw []byte // tensor data within the mapped file
+		if mapping != nil {
+			if info.offset+info.size > int64(len(mapping)) {
+				return mappedCount, &TensorError{Name: info.name, Offset: info.offset, Err: ErrTruncatedFile}
+			}
+			raw = mapping[info.offset : info.offset+info.size : info.offset+info.size]
 		}
 
-		// --- Read tensor into memory
+		// --- Zero-copy: data of the same type as used for compute is taken right from the mapped file
 
-		switch shardType {
-		case ml.TYPE_F16:
-			for n := uint32(0); n < tensorSize; n++ {
-				tensor.Data[n] = readFP16ToFP32(file)
-			}
-		case ml.TYPE_F32:
-			var fake []byte
-			fakeHeader := (*reflect.SliceHeader)(unsafe.Pointer(&fake))
-			dataHeader := (*reflect.SliceHeader)(unsafe.Pointer(&tensor.Data))
-
-			fakeHeader.Data = dataHeader.Data
-			fakeHeader.Len = int(tensorSize * 4)
-			fakeHeader.Cap = int(tensorSize * 4)
-
-			if count, err := io.ReadFull(file, fake); err != nil || count != int(tensorSize*4) {
-				fmt.Printf("\n[ERROR] Failed to read BIG FP32 chunk from model!")
-				fmt.Printf("\n[ERROR] COUNT = %d | ERR = %s", count, err.Error())
-				os.Exit(1)
+		var tensor *ml.Tensor
+		switch {
+		case raw != nil && info.dtype == ml.TYPE_F32 && info.offset%4 == 0:
+			data := unsafe.Slice((*float32)(unsafe.Pointer(&raw[0])), info.nelements())
+			tensor = ml.NewTensor(nil, dtype, info.dims, info.ne[0], info.ne[1], info.ne[2], info.ne[3], data)
+		case raw != nil && ml.IsQuantized(info.dtype) && info.repack == nil:
+			tensor = ml.NewQuantizedTensor(nil, dtype, info.dims, info.ne[0], info.ne[1], info.ne[2], info.ne[3], raw)
+		}
+
+		if tensor != nil {
+			mappedCount++
+		} else {
+			tensor = ml.NewTensor(nil, dtype, info.dims, info.ne[0], info.ne[1], info.ne[2], info.ne[3], nil) // Fixed OK
+			if err := readTensor(file, raw, &info, tensor); err != nil {
+				return mappedCount, err
 			}
-		default:
-			fmt.Printf("\n[ERROR] Tensor data type is not supported yet!")
-			os.Exit(0)
 		}
 
+		model.tensors[info.name] = tensor
+
 		// TODO: Implement just simple dots increasing count for Windows
 		tensorsCount++
 		if !silent && tensorsCount%10 == 0 {
@@ -972,7 +1238,104 @@ func LoadModel(fileName string, params *ModelParams, silent bool) (*ml.Vocab, *M
 	// bar.Finish()
 	// }
 
-	return vocab, model, nil
+	return mappedCount, nil
+}
+
+// readTensor copies tensor data into memory converting it into the type of tensor
+// Data is taken from raw bytes of the mapped file if they are given, or read from the file otherwise
+func readTensor(file *os.File, raw []byte, info *tensorInfo, tensor *ml.Tensor) error {
+
+	tensorSize := tensor.Nelements()
+
+	// readFull reads the whole tensor data into given buffer
+	readFull := func(buf []byte) error {
+		if _, err := file.Seek(info.offset, io.SeekStart); err != nil {
+			return &TensorError{Name: info.name, Offset: info.offset, Err: err}
+		}
+		if _, err := io.ReadFull(file, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrTruncatedFile
+			}
+			return &TensorError{Name: info.name, Offset: info.offset, Err: err}
+		}
+		return nil
+	}
+
+	switch info.dtype {
+	case ml.TYPE_F16:
+		if raw == nil {
+			raw = make([]byte, info.size)
+			if err := readFull(raw); err != nil {
+				return err
+			}
+		}
+		for n := uint32(0); n < tensorSize; n++ {
+			tensor.Data[n] = float16.Frombits(binary.LittleEndian.Uint16(raw[n*2:])).Float32()
+		}
+	case ml.TYPE_F32:
+		if raw != nil {
+			for n := uint32(0); n < tensorSize; n++ {
+				tensor.Data[n] = math.Float32frombits(binary.LittleEndian.Uint32(raw[n*4:]))
+			}
+			break
+		}
+
+		var fake []byte
+		fakeHeader := (*reflect.SliceHeader)(unsafe.Pointer(&fake))
+		dataHeader := (*reflect.SliceHeader)(unsafe.Pointer(&tensor.Data))
+
+		fakeHeader.Data = dataHeader.Data
+		fakeHeader.Len = int(tensorSize * 4)
+		fakeHeader.Cap = int(tensorSize * 4)
+
+		if err := readFull(fake); err != nil {
+			return err
+		}
+	case ml.TYPE_Q4_0, ml.TYPE_Q4_1, ml.TYPE_Q8_0:
+		// GGUF blocks differ from in-memory ones and should be repacked
+		blocks := raw
+		if blocks == nil {
+			blocks = tensor.Blocks
+			if info.repack != nil {
+				blocks = make([]byte, info.size)
+			}
+			if err := readFull(blocks); err != nil {
+				return err
+			}
+		}
+
+		if info.repack != nil {
+			info.repack(tensor.Blocks, blocks)
+		} else if raw != nil {
+			copy(tensor.Blocks, raw)
+		}
+	default:
+		return &TensorError{Name: info.name, Offset: info.offset, Err: fmt.Errorf("type %d: %w", info.dtype, ErrUnsupportedDType)}
+	}
+
+	return nil
+}
+
+// bindTensors links loaded tensors with model layers checking nothing is missing
+func (model *Model) bindTensors() error {
+
+	var missing string
+	get := func(name string) *ml.Tensor {
+		tensor, ok := model.tensors[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return tensor
+	}
+
+	model.layers = make([]Layer, model.hparams.layersCount)
+	model.hparams.arch.bind(model, get)
+
+	if missing != "" {
+		return fmt.Errorf("%w: '%s'", ErrMissingTensor, missing)
+	}
+
+	return nil
 }
 
 // max returns the maximum of two float32 values
@@ -983,43 +1346,38 @@ func max(a, b float32) float32 {
 	return b
 }
 
+// readFull fills the buffer from the file, short reads are ErrTruncatedFile at the offset where the file ends
+func readFull(file *os.File, buf []byte) error {
+	_, err := io.ReadFull(file, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		offset, _ := file.Seek(0, io.SeekCurrent)
+		return fmt.Errorf("%w at offset %d", ErrTruncatedFile, offset)
+	}
+	return err
+}
+
 // readInt reads 32-bit integer from the file
-func readInt(file *os.File) uint32 {
+func readInt(file *os.File) (uint32, error) {
 	buf := make([]byte, 4)
-	if count, err := file.Read(buf); err != nil || count != 4 {
-		return 0
+	if err := readFull(file, buf); err != nil {
+		return 0, err
 	}
-	return uint32(buf[3])<<24 | uint32(buf[2])<<16 | uint32(buf[1])<<8 | uint32(buf[0])
+	return uint32(buf[3])<<24 | uint32(buf[2])<<16 | uint32(buf[1])<<8 | uint32(buf[0]), nil
 }
 
 // readString reads a string from the file
-func readString(file *os.File, len uint32) string {
+func readString(file *os.File, len uint32) (string, error) {
 	buf := make([]byte, len)
-	if count, err := file.Read(buf); err != nil || count != int(len) {
-		return ""
+	if err := readFull(file, buf); err != nil {
+		return "", err
 	}
-	return string(buf)
-}
-
-// readFP16ToFP32 reads a 16-bit float from the file and converts it to 32-bit
-func readFP16ToFP32(file *os.File) float32 {
-	buf := make([]byte, 2)
-	if count, err := file.Read(buf); err != nil || count != 2 {
-		return 0.0
-	}
-	bits := uint16(buf[1])<<8 | uint16(buf[0])
-	f16 := float16.Frombits(bits)
-	return f16.Float32()
+	return string(buf), nil
 }
 
 // readFP32 reads a 32-bit float from the file
-func readFP32(file *os.File) float32 {
-	buf := make([]byte, 4)
-	if count, err := file.Read(buf); err != nil || count != 4 {
-		return 0.0
-	}
-	bits := uint32(buf[3])<<24 | uint32(buf[2])<<16 | uint32(buf[1])<<8 | uint32(buf[0])
-	return math.Float32frombits(bits)
+func readFP32(file *os.File) (float32, error) {
+	bits, err := readInt(file)
+	return math.Float32frombits(bits), err
 }
 
 // ExtractTokens is a function to extract a slice of tokens from the ring buffer
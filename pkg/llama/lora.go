@@ -0,0 +1,390 @@
+package llama
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/x448/float16"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+const (
+	LORA_FILE_MAGIC   = 0x67676c61 // 'ggla' in hex
+	LORA_FILE_VERSION = 1
+)
+
+// LoraAdapter is the file with LoRA weights and the factor they are scaled with before merging
+type LoraAdapter struct {
+	Path  string
+	Scale float32 // 1.0 applies adapter as it was trained
+}
+
+// loraTargets are the names of layer tensors adapters are allowed to change
+var loraTargets = []string{
+	"attention.wq.weight",
+	"attention.wk.weight",
+	"attention.wv.weight",
+	"attention.wo.weight",
+	"feed_forward.w1.weight",
+	"feed_forward.w2.weight",
+	"feed_forward.w3.weight",
+}
+
+// loraTensor is the low-rank matrix A or B read from adapter file
+// Both of them have the rank as the first dimension: A is [rank x in] and B is [rank x out]
+type loraTensor struct {
+	name   string
+	offset int64
+	ne     [2]uint32
+	data   []float32
+}
+
+// loraWeights are pairs of A and B matrices for each of the base weights
+type loraWeights struct {
+	rank  uint32
+	alpha uint32
+	a     map[string]*loraTensor // by the name of base tensor
+	b     map[string]*loraTensor
+}
+
+// readLora reads the adapter in ggla format produced by llama.cpp convert-lora-to-ggml.py
+func readLora(fileName string) (*loraWeights, error) {
+
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := 0
+	truncated := false
+	u32 := func() uint32 {
+		if pos+4 > len(buf) {
+			truncated = true
+			return 0
+		}
+		value := binary.LittleEndian.Uint32(buf[pos:])
+		pos += 4
+		return value
+	}
+
+	if magic := u32(); magic != LORA_FILE_MAGIC {
+		return nil, fmt.Errorf("%w: wrong magic 0x%08x in LoRA header", ErrInvalidFile, magic)
+	}
+	if version := u32(); version != LORA_FILE_VERSION {
+		return nil, fmt.Errorf("%w: unsupported LoRA version %d", ErrInvalidFile, version)
+	}
+
+	adapter := &loraWeights{
+		rank:  u32(),
+		alpha: u32(),
+		a:     make(map[string]*loraTensor),
+		b:     make(map[string]*loraTensor),
+	}
+
+	if truncated {
+		return nil, ErrTruncatedFile
+	}
+	if adapter.rank == 0 {
+		return nil, fmt.Errorf("%w: LoRA rank should not be zero", ErrInvalidFile)
+	}
+
+	for pos < len(buf) {
+
+		dims := u32()
+		nameLength := u32()
+		dtype := ml.DType(u32())
+
+		tensor := &loraTensor{ne: [2]uint32{1, 1}}
+		if dims < 1 || dims > 2 {
+			return nil, fmt.Errorf("%w: LoRA tensor with %d dimensions", ErrInvalidFile, dims)
+		}
+		for i := uint32(0); i < dims; i++ {
+			tensor.ne[i] = u32()
+		}
+
+		if truncated || pos+int(nameLength) > len(buf) {
+			return nil, ErrTruncatedFile
+		}
+		tensor.name = string(buf[pos : pos+int(nameLength)])
+		pos += int(nameLength)
+
+		// --- tensors data is aligned for 32 bytes
+
+		if rem := pos % 32; rem != 0 {
+			pos += 32 - rem
+		}
+		tensor.offset = int64(pos)
+
+		if dtype != ml.TYPE_F32 && dtype != ml.TYPE_F16 {
+			err := fmt.Errorf("type %d instead of FP32 or FP16: %w", dtype, ErrUnsupportedDType)
+			return nil, &TensorError{Name: tensor.name, Offset: tensor.offset, Err: err}
+		}
+
+		count := int(tensor.ne[0]) * int(tensor.ne[1])
+		size := count * int(ml.TYPE_SIZE[dtype])
+		if pos+size > len(buf) {
+			return nil, &TensorError{Name: tensor.name, Offset: tensor.offset, Err: ErrTruncatedFile}
+		}
+
+		tensor.data = make([]float32, count)
+		for i := range tensor.data {
+			if dtype == ml.TYPE_F16 {
+				tensor.data[i] = float16.Frombits(binary.LittleEndian.Uint16(buf[pos+i*2:])).Float32()
+			} else {
+				tensor.data[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[pos+i*4:]))
+			}
+		}
+		pos += size
+
+		// --- names are like layers.0.attention.wq.weight.loraA
+
+		switch {
+		case strings.HasSuffix(tensor.name, ".loraA"):
+			adapter.a[strings.TrimSuffix(tensor.name, ".loraA")] = tensor
+		case strings.HasSuffix(tensor.name, ".loraB"):
+			adapter.b[strings.TrimSuffix(tensor.name, ".loraB")] = tensor
+		default:
+			return nil, &TensorError{Name: tensor.name, Offset: tensor.offset, Err: ErrUnknownTensor}
+		}
+	}
+
+	return adapter, nil
+}
+
+// applyLora merges the adapter into the model weights: W += scale * alpha / rank * B * A
+// Quantized weights are decoded row by row and quantized again after merging
+func (model *Model) applyLora(adapter LoraAdapter, threads int) error {
+
+	lora, err := readLora(adapter.Path)
+	if err == nil {
+		err = model.checkLora(lora)
+	}
+	if err != nil {
+		return fmt.Errorf("LoRA adapter '%s': %w", adapter.Path, err)
+	}
+
+	scale := adapter.Scale * float32(lora.alpha) / float32(lora.rank)
+
+	for name, a := range lora.a {
+		tensor := model.tensors[name]
+		model.unmapTensor(tensor)
+		if err := mergeLora(tensor, a.data, lora.b[name].data, int(lora.rank), scale, threads); err != nil {
+			return fmt.Errorf("LoRA adapter '%s' for '%s': %w", adapter.Path, name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkLora verifies all pairs of the adapter match the model before any of weights are changed
+func (model *Model) checkLora(lora *loraWeights) error {
+
+	allowed := make(map[string]bool)
+	for i := uint32(0); i < model.hparams.layersCount; i++ {
+		for _, target := range loraTargets {
+			allowed[fmt.Sprintf("layers.%d.%s", i, target)] = true
+		}
+	}
+
+	for name, a := range lora.a {
+
+		b, ok := lora.b[name]
+		if !ok {
+			return fmt.Errorf("%w: '%s.loraB'", ErrMissingTensor, name)
+		}
+
+		tensor, ok := model.tensors[name]
+		if !ok || !allowed[name] {
+			return &TensorError{Name: a.name, Offset: a.offset, Err: ErrUnknownTensor}
+		}
+
+		for _, t := range []*loraTensor{a, b} {
+			if t.ne[0] != lora.rank {
+				err := fmt.Errorf("%w: rank %d, expected %d", ErrShapeMismatch, t.ne[0], lora.rank)
+				return &TensorError{Name: t.name, Offset: t.offset, Err: err}
+			}
+		}
+
+		if a.ne[1] != tensor.NE[0] || b.ne[1] != tensor.NE[1] {
+			err := fmt.Errorf("%w: B x A is %dx%d, but weights are %dx%d", ErrShapeMismatch, b.ne[1], a.ne[1], tensor.NE[1], tensor.NE[0])
+			return &TensorError{Name: a.name, Offset: a.offset, Err: err}
+		}
+	}
+
+	for name := range lora.b {
+		if _, ok := lora.a[name]; !ok {
+			return fmt.Errorf("%w: '%s.loraA'", ErrMissingTensor, name)
+		}
+	}
+
+	return nil
+}
+
+// mergeLora adds scale * B * A to the weights splitting rows between threads
+func mergeLora(tensor *ml.Tensor, a, b []float32, rank int, scale float32, threads int) error {
+
+	in := int(tensor.NE[0])
+	out := int(tensor.NE[1])
+
+	if threads < 1 {
+		threads = 1
+	}
+	rowsPerThread := (out + threads - 1) / threads
+
+	// each thread keeps its own error
+	errs := make([]error, threads)
+
+	var wg sync.WaitGroup
+	for start := 0; start < out; start += rowsPerThread {
+		end := start + rowsPerThread
+		if end > out {
+			end = out
+		}
+
+		wg.Add(1)
+		go func(start, end int, err *error) {
+			defer wg.Done()
+
+			quantized := ml.IsQuantized(tensor.Type)
+			rowSize := int(tensor.NB[1])
+
+			row := make([]float32, in)
+			for o := start; o < end; o++ {
+
+				if quantized {
+					if *err = ml.DequantizeRow(tensor.Type, tensor.Blocks[o*rowSize:(o+1)*rowSize], row); *err != nil {
+						return
+					}
+				} else {
+					row = tensor.Data[o*in : (o+1)*in]
+				}
+
+				bo := b[o*rank : (o+1)*rank]
+				for i := 0; i < in; i++ {
+					ai := a[i*rank : (i+1)*rank]
+					sum := float32(0.0)
+					for k := range bo {
+						sum += bo[k] * ai[k]
+					}
+					row[i] += scale * sum
+				}
+
+				if quantized {
+					if *err = ml.QuantizeRow(tensor.Type, row, tensor.Blocks[o*rowSize:(o+1)*rowSize]); *err != nil {
+						return
+					}
+				}
+			}
+		}(start, end, &errs[start/rowsPerThread])
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmapTensor copies tensor data out of read-only mapped file, so it could be changed
+func (model *Model) unmapTensor(tensor *ml.Tensor) {
+
+	if len(model.mapping) == 0 {
+		return
+	}
+
+	start := uintptr(unsafe.Pointer(&model.mapping[0]))
+	end := start + uintptr(len(model.mapping))
+
+	if ml.IsQuantized(tensor.Type) {
+		if ptr := uintptr(unsafe.Pointer(&tensor.Blocks[0])); ptr >= start && ptr < end {
+			tensor.Blocks = append([]byte(nil), tensor.Blocks...)
+		}
+		return
+	}
+
+	if ptr := uintptr(unsafe.Pointer(&tensor.Data[0])); ptr >= start && ptr < end {
+		tensor.Data = append([]float32(nil), tensor.Data...)
+	}
+}
+
+// Adapter is the LoRA adapter kept apart from the model weights, so jobs sharing one model might use different adapters
+// Eval adds low-rank side paths scale * B * (A * x) to the projections for each adapter of the Context
+type Adapter struct {
+	Path  string
+	Scale float32 // user scale multiplied by alpha / rank
+
+	pairs map[*ml.Tensor]adapterPair // by base weights
+}
+
+// adapterPair is the pair of low-rank matrices prepared for multiplication within the compute graph
+type adapterPair struct {
+	a *ml.Tensor // A transposed into [in x rank] to be multiplied with the input
+	b *ml.Tensor // B as it is [rank x out]
+}
+
+// LoadAdapter reads the adapter and checks it matches the model, the model weights are left untouched
+func LoadAdapter(model *Model, adapter LoraAdapter) (*Adapter, error) {
+
+	lora, err := readLora(adapter.Path)
+	if err == nil {
+		err = model.checkLora(lora)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LoRA adapter '%s': %w", adapter.Path, err)
+	}
+
+	result := &Adapter{
+		Path:  adapter.Path,
+		Scale: adapter.Scale * float32(lora.alpha) / float32(lora.rank),
+		pairs: make(map[*ml.Tensor]adapterPair, len(lora.a)),
+	}
+
+	rank := lora.rank
+	for name, a := range lora.a {
+
+		in := a.ne[1]
+		b := lora.b[name]
+
+		pair := adapterPair{
+			a: ml.NewTensor2D(nil, ml.TYPE_F32, in, rank),
+			b: ml.NewTensor(nil, ml.TYPE_F32, 2, rank, b.ne[1], 1, 1, b.data),
+		}
+
+		for i := uint32(0); i < in; i++ {
+			for k := uint32(0); k < rank; k++ {
+				pair.a.Data[k*in+i] = a.data[i*rank+k]
+			}
+		}
+
+		result.pairs[model.tensors[name]] = pair
+	}
+
+	return result, nil
+}
+
+// mulMat multiplies weights with the input adding side paths of adapters which have the pair for these weights
+func mulMat(ctx *ml.Context, adapters []*Adapter, weights, input *ml.Tensor) *ml.Tensor {
+
+	result := ml.MulMat(ctx, weights, input)
+
+	for _, adapter := range adapters {
+		pair, ok := adapter.pairs[weights]
+		if !ok {
+			continue
+		}
+		side := ml.MulMat(ctx, pair.b, ml.MulMat(ctx, pair.a, input))
+		result = ml.Add(ctx, result, ml.Scale(ctx, side, ml.NewFP32(ctx, adapter.Scale)))
+	}
+
+	return result
+}
@@ -0,0 +1,22 @@
+//go:build !unix && !windows
+
+package llama
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoMMap = errors.New("memory mapping is not supported on this platform")
+
+func mmapFile(file *os.File) ([]byte, error) {
+	return nil, errNoMMap
+}
+
+func munmapFile(data []byte) error {
+	return errNoMMap
+}
+
+func mlockFile(data []byte) error {
+	return errNoMMap
+}
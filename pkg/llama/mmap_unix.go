@@ -0,0 +1,34 @@
+//go:build unix
+
+package llama
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps the whole file into memory for reading only
+// Shared mapping allows processes loading the same model to use one copy from the page cache
+func mmapFile(file *os.File) ([]byte, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, fmt.Errorf("file of %d bytes can't be mapped into memory", size)
+	}
+	return unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+// munmapFile releases the memory mapping
+func munmapFile(data []byte) error {
+	return unix.Munmap(data)
+}
+
+// mlockFile pins mapped pages into RAM, so the model is never swapped out
+func mlockFile(data []byte) error {
+	return unix.Mlock(data)
+}
@@ -0,0 +1,48 @@
+//go:build windows
+
+package llama
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// mmapFile maps the whole file into memory for reading only
+// Shared mapping allows processes loading the same model to use one copy from the page cache
+func mmapFile(file *os.File) ([]byte, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, fmt.Errorf("file of %d bytes can't be mapped into memory", size)
+	}
+
+	mapping, err := windows.CreateFileMapping(windows.Handle(file.Fd()), nil, windows.PAGE_READONLY, uint32(size>>32), uint32(size), nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	// the view keeps the mapping object alive, so the handle is not needed anymore
+	defer windows.CloseHandle(mapping)
+
+	addr, err := windows.MapViewOfFile(mapping, windows.FILE_MAP_READ, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+
+	return unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&addr))), int(size)), nil
+}
+
+// munmapFile releases the memory mapping
+func munmapFile(data []byte) error {
+	return windows.UnmapViewOfFile(uintptr(unsafe.Pointer(&data[0])))
+}
+
+// mlockFile pins mapped pages into RAM, so the model is never swapped out
+func mlockFile(data []byte) error {
+	return windows.VirtualLock(uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)))
+}
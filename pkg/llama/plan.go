@@ -0,0 +1,151 @@
+package llama
+
+import (
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// kvBlockSize is the step the length of cache positions attention runs over grows with,
+// so decoding rebuilds the graph once per that many tokens
+const kvBlockSize = 256
+
+// kvStore is the view of the cache where the copy node puts keys or values of new tokens
+type kvStore struct {
+	cache  *ml.Tensor
+	view   *ml.Tensor
+	copy   *ml.Tensor
+	offset uint32 // the layer start within the cache
+	size   uint32 // values per token
+}
+
+// plan is the graph of Eval built once for the batch size and the length of the cache attention runs over
+// It's computed again and again with the token ids and the past count bound to it
+type plan struct {
+	graph *ml.Graph
+
+	N        uint32 // tokens in the batch
+	kvLen    uint32 // the plan serves any pastCount up to kvLen - N
+	adapters []*Adapter
+
+	tokens     *ml.Tensor // ids of tokens as floats
+	past       []*ml.Tensor
+	stores     []kvStore
+	logits     *ml.Tensor
+	embeddings *ml.Tensor
+
+	scratch int // peak memory of temporary tensors in bytes
+}
+
+// kvLength returns the count of cache positions attention covers for the batch
+func kvLength(hparams *HParams, N, pastCount uint32) uint32 {
+	kvLen := (pastCount + N + kvBlockSize - 1) / kvBlockSize * kvBlockSize
+	if kvLen > hparams.ctxSize {
+		kvLen = hparams.ctxSize
+	}
+	return kvLen
+}
+
+// buildPlan creates the graph for N tokens with the attention over kvLen positions of the cache
+func buildPlan(lctx *Context, model *Model, N, kvLen uint32) *plan {
+
+	ctx0 := lctx.MLContext
+
+	graph := &ml.Graph{
+		//MaxThreads: params.MaxThreads,
+		//UseNEON:    params.UseNEON,
+		//UseAVX:     params.UseAVX,
+	}
+
+	eval := &evalState{
+		ctx:   ctx0,
+		graph: graph,
+		lctx:  lctx,
+		model: model,
+		N:     N,
+		kvLen: kvLen,
+		rope: ml.RopeParams{
+			FreqBase:  model.hparams.ropeFreqBase,
+			FreqScale: model.hparams.ropeFreqScale,
+			Scaling:   model.hparams.ropeScaling,
+			CtxOrig:   model.hparams.ropeCtxOrig,
+		},
+	}
+
+	// token ids are bound to the embd tensor before every compute
+	embd := ml.NewTensor1D(ctx0, ml.TYPE_F32, N) // Reusable OK
+
+	inpL := ml.GetRows(ctx0, model.tokEmbeddings, embd)
+
+	// transformer blocks and the final norm are specific for the model architecture
+	inpL = model.hparams.arch.build(eval, inpL)
+
+	embeddings := inpL
+
+	// lm_head
+	inpL = ml.MulMat(ctx0, model.output, inpL)
+
+	ml.BuildForwardExpand(graph, inpL)
+
+	// temporary tensors share the arena of the context, logits and embeddings are read after the compute
+	scratch := ctx0.Allocator.Plan(graph, embeddings, inpL)
+
+	return &plan{
+		graph:      graph,
+		N:          N,
+		kvLen:      kvLen,
+		adapters:   lctx.Adapters,
+		tokens:     embd,
+		past:       eval.past,
+		stores:     eval.stores,
+		logits:     inpL,
+		embeddings: embeddings,
+		scratch:    scratch,
+	}
+}
+
+// MemTest builds the graph of Eval for the worst case of the full batch at the end of the context
+// and returns the peak memory of its temporary tensors in bytes, the arena of the context grows to hold them
+func MemTest(lctx *Context, model *Model, params *ModelParams) int {
+	N := params.BatchSize
+	if N == 0 || N > model.hparams.ctxSize {
+		N = model.hparams.ctxSize
+	}
+	return buildPlan(lctx, model, N, model.hparams.ctxSize).scratch
+}
+
+// fits checks whether the plan computes the batch of N tokens, context adapters might be changed since it was built
+func (plan *plan) fits(lctx *Context, N, kvLen uint32) bool {
+
+	if plan.N != N || plan.kvLen != kvLen || len(plan.adapters) != len(lctx.Adapters) {
+		return false
+	}
+
+	for i, adapter := range plan.adapters {
+		if lctx.Adapters[i] != adapter {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bind puts token ids into the graph and moves positions of RoPE, the mask and cache stores to pastCount
+func (plan *plan) bind(tokens []uint32, pastCount uint32) error {
+
+	for i, token := range tokens {
+		plan.tokens.Data[i] = float32(token)
+	}
+
+	for _, node := range plan.past {
+		if err := ml.SetPast(node, pastCount); err != nil {
+			return err
+		}
+	}
+
+	for _, store := range plan.stores {
+		// the copy node is the view of the same data
+		store.view.Data = store.cache.Data[store.offset+pastCount*store.size:]
+		store.copy.Data = store.view.Data
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package llama
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/x448/float16"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// fileTypes are the values of ftype header field used by llama.cpp for models of mostly one type
+var fileTypes = map[ml.DType]uint32{
+	ml.TYPE_F32:  0,
+	ml.TYPE_F16:  1,
+	ml.TYPE_Q4_0: 2,
+	ml.TYPE_Q4_1: 3,
+	ml.TYPE_Q8_0: 7,
+}
+
+// QuantizeStats shows how precisely the tensor was converted
+type QuantizeStats struct {
+	Name     string
+	Type     ml.DType // resulting type, tensors which can't be quantized are kept in FP32
+	NE       [4]uint32
+	RMSE     float64 // root-mean-square error
+	MaxError float64 // maximum absolute error
+}
+
+// QuantizeModel converts FP32 or FP16 ggjt model into the new one with weights of given type
+// Tensors are read, re-encoded and written one by one, so the whole model is never kept in memory
+// The optional report callback is called after each tensor is written
+func QuantizeModel(inName, outName string, dtype ml.DType, report func(stats QuantizeStats)) error {
+
+	ftype, ok := fileTypes[dtype]
+	if !ok || dtype == ml.TYPE_F32 {
+		return fmt.Errorf("quantization into data type %d is not supported", dtype)
+	}
+
+	in, err := os.Open(inName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if magic, err := readInt(in); err != nil {
+		return err
+	} else if magic != LLAMA_FILE_MAGIC {
+		return fmt.Errorf("%w: '%s' is not in ggjt format", ErrInvalidFile, inName)
+	}
+
+	hparams := &HParams{}
+	vocab, tensors, err := readGGJT(in, hparams, false)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(outName)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	bufWriter := bufio.NewWriterSize(out, 1<<20)
+	gw := &ggjtWriter{w: bufWriter}
+
+	gw.header(hparams, ftype)
+	gw.vocab(vocab)
+
+	for _, info := range tensors {
+
+		data, err := readTensorFP32(in, &info)
+		if err != nil {
+			return err
+		}
+
+		stats := QuantizeStats{
+			Name: info.name,
+			Type: ml.TYPE_F32,
+			NE:   info.ne,
+		}
+
+		// only matrices are quantized, while small vectors like norms are kept in FP32
+		if info.dims == 2 && info.ne[0]%ml.BLCK_SIZE[dtype] == 0 {
+			stats.Type = dtype
+		}
+
+		gw.tensorHeader(info.name, info.dims, info.ne, stats.Type)
+
+		// --- encode data and decode it back to see the difference
+
+		restored := data
+		switch {
+		case ml.IsQuantized(stats.Type):
+			blocks := make([]byte, info.nelements()*int64(ml.TYPE_SIZE[dtype])/int64(ml.BLCK_SIZE[dtype]))
+			if err := ml.QuantizeRow(dtype, data, blocks); err != nil {
+				return err
+			}
+			gw.write(blocks)
+			restored = make([]float32, len(data))
+			if err := ml.DequantizeRow(dtype, blocks, restored); err != nil {
+				return err
+			}
+		case stats.Type == ml.TYPE_F16:
+			gw.floats(data, ml.TYPE_F16)
+			restored = make([]float32, len(data))
+			for i, value := range data {
+				restored[i] = float16.Fromfloat32(value).Float32()
+			}
+		default:
+			gw.floats(data, ml.TYPE_F32)
+		}
+
+		if gw.err != nil {
+			return gw.err
+		}
+
+		sum := 0.0
+		for i := range data {
+			diff := math.Abs(float64(data[i]) - float64(restored[i]))
+			sum += diff * diff
+			stats.MaxError = math.Max(stats.MaxError, diff)
+		}
+		stats.RMSE = math.Sqrt(sum / float64(len(data)))
+
+		if report != nil {
+			report(stats)
+		}
+	}
+
+	if err := bufWriter.Flush(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// readTensorFP32 reads FP32 or FP16 tensor data from the file converting it into FP32
+func readTensorFP32(file *os.File, info *tensorInfo) ([]float32, error) {
+
+	if info.dtype != ml.TYPE_F32 && info.dtype != ml.TYPE_F16 {
+		err := fmt.Errorf("type %d instead of FP32 or FP16: %w", info.dtype, ErrUnsupportedDType)
+		return nil, &TensorError{Name: info.name, Offset: info.offset, Err: err}
+	}
+
+	buf := make([]byte, info.size)
+	if _, err := file.ReadAt(buf, info.offset); err != nil {
+		if err == io.EOF {
+			err = ErrTruncatedFile
+		}
+		return nil, &TensorError{Name: info.name, Offset: info.offset, Err: err}
+	}
+
+	data := make([]float32, info.nelements())
+	for i := range data {
+		if info.dtype == ml.TYPE_F16 {
+			data[i] = float16.Frombits(binary.LittleEndian.Uint16(buf[i*2:])).Float32()
+		} else {
+			data[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:]))
+		}
+	}
+
+	return data, nil
+}
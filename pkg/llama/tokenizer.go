@@ -0,0 +1,784 @@
+package llama
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// LoadTokenizer reads vocab with its tokenizer from HuggingFace tokenizer.json or SentencePiece tokenizer.model file,
+// so texts could be tokenized without the model itself
+// Unlike vocabs of model files such vocab normalizes the text by itself, there is no need to add the leading space
+// Special tokens of tokenizer.json are taken from tokenizer_config.json of the same dir when there is one
+// Only BPE models are supported, neither Unigram SentencePiece models nor WordPiece or Unigram ones of tokenizer.json
+func LoadTokenizer(fileName string) (*ml.Vocab, error) {
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var vocab *ml.Vocab
+	if strings.HasSuffix(strings.ToLower(fileName), ".json") {
+		config, configErr := os.ReadFile(filepath.Join(filepath.Dir(fileName), "tokenizer_config.json"))
+		if configErr != nil && !errors.Is(configErr, os.ErrNotExist) {
+			return nil, configErr
+		}
+		vocab, err = readTokenizerJSON(data, config)
+	} else {
+		vocab, err = readSentencePiece(data)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTokenizer, err)
+	}
+
+	return vocab, nil
+}
+
+// normalizers applies all text normalization steps one by one
+type normalizers []func(text string) string
+
+func (steps normalizers) normalize(text string) string {
+	for _, step := range steps {
+		text = step(text)
+	}
+	return text
+}
+
+// unicodeNormalizers are Unicode normalization forms by their names in tokenizer files
+var unicodeNormalizers = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFD":  norm.NFD,
+	"NFKC": norm.NFKC,
+	"NFKD": norm.NFKD,
+}
+
+// ---- SentencePiece
+
+// SentencePiece model files are protobuf messages, only the fields needed for tokenization are read
+// https://github.com/google/sentencepiece/blob/master/src/sentencepiece_model.proto
+const (
+	spModelPieces     = 1 // ModelProto.pieces
+	spModelTrainer    = 2 // ModelProto.trainer_spec
+	spModelNormalizer = 3 // ModelProto.normalizer_spec
+
+	spPieceText  = 1 // SentencePiece.piece
+	spPieceScore = 2 // SentencePiece.score
+	spPieceType  = 3 // SentencePiece.type, the same values as GGUF token types
+
+	spTrainerModelType    = 3  // TrainerSpec.model_type
+	spTrainerByteFallback = 35 // TrainerSpec.byte_fallback
+	spTrainerUnkID        = 40 // TrainerSpec.unk_id
+	spTrainerBosID        = 41 // TrainerSpec.bos_id
+	spTrainerEosID        = 42 // TrainerSpec.eos_id
+	spTrainerPadID        = 43 // TrainerSpec.pad_id
+
+	spNormalizerName             = 1 // NormalizerSpec.name
+	spNormalizerDummyPrefix      = 3 // NormalizerSpec.add_dummy_prefix
+	spNormalizerExtraWhitespaces = 4 // NormalizerSpec.remove_extra_whitespaces
+)
+
+// SentencePiece model types, only BPE one of LLaMA is supported by ml.SentencePiece tokenizer
+const (
+	spModelUnigram = 1
+	spModelBPE     = 2
+)
+
+// readSentencePiece reads SentencePiece model like tokenizer.model of LLaMA
+func readSentencePiece(data []byte) (*ml.Vocab, error) {
+
+	var pieces []string
+	var scores []float32
+	var types []int32
+
+	modelType := uint64(spModelUnigram)
+	byteFallback := false
+
+	// ids are int32 with -1 for disabled tokens, the defaults are the ones of LLaMA
+	specials := map[int]int32{spTrainerUnkID: ml.TOKEN_UNK, spTrainerBosID: ml.TOKEN_BOS, spTrainerEosID: ml.TOKEN_EOS, spTrainerPadID: -1}
+
+	normalizer := "identity"
+	dummyPrefix := true
+	extraWhitespaces := true
+
+	err := readProto(data, func(field, wire int, value uint64, bytes []byte) error {
+		switch field {
+
+		case spModelPieces:
+			piece, score, tokenType := "", float32(0), int32(ml.TOKEN_TYPE_NORMAL)
+			err := readProto(bytes, func(field, wire int, value uint64, bytes []byte) error {
+				switch field {
+				case spPieceText:
+					piece = string(bytes)
+				case spPieceScore:
+					score = math.Float32frombits(uint32(value))
+				case spPieceType:
+					tokenType = int32(value)
+				}
+				return nil
+			})
+			pieces = append(pieces, piece)
+			scores = append(scores, score)
+			types = append(types, tokenType)
+			return err
+
+		case spModelTrainer:
+			return readProto(bytes, func(field, wire int, value uint64, bytes []byte) error {
+				switch field {
+				case spTrainerModelType:
+					modelType = value
+				case spTrainerByteFallback:
+					byteFallback = value != 0
+				case spTrainerUnkID, spTrainerBosID, spTrainerEosID, spTrainerPadID:
+					specials[field] = int32(value)
+				}
+				return nil
+			})
+
+		case spModelNormalizer:
+			return readProto(bytes, func(field, wire int, value uint64, bytes []byte) error {
+				switch field {
+				case spNormalizerName:
+					normalizer = string(bytes)
+				case spNormalizerDummyPrefix:
+					dummyPrefix = value != 0
+				case spNormalizerExtraWhitespaces:
+					extraWhitespaces = value != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pieces) == 0 {
+		return nil, fmt.Errorf("SentencePiece model has no pieces")
+	}
+
+	if modelType != spModelBPE {
+		return nil, fmt.Errorf("unsupported SentencePiece model type %d, only BPE is supported", modelType)
+	}
+
+	// byte pieces are the same <0xXX> ones with or without fallback, just never used without it
+	if !byteFallback {
+		for i := range types {
+			if types[i] == int32(ml.TOKEN_TYPE_BYTE) {
+				types[i] = int32(ml.TOKEN_TYPE_UNUSED)
+			}
+		}
+	}
+
+	var steps normalizers
+
+	// NMT rules are close enough to NFKC for texts without control chars
+	switch normalizer {
+	case "identity":
+	case "nfkc", "nmt_nfkc":
+		steps = append(steps, norm.NFKC.String)
+	case "nfkc_cf", "nmt_nfkc_cf":
+		steps = append(steps, norm.NFKC.String, strings.ToLower)
+	default:
+		return nil, fmt.Errorf("unsupported SentencePiece normalizer '%s'", normalizer)
+	}
+
+	// the vocab keeps regular spaces instead of whitespace markers, so only extra spaces and the prefix are left
+	if extraWhitespaces {
+		steps = append(steps, func(text string) string {
+			return strings.Join(strings.FieldsFunc(text, func(r rune) bool { return r == ' ' }), " ")
+		})
+	}
+
+	vocab := newVocab(pieces, scores, types, true)
+	vocab.Normalize = steps.normalize
+
+	if dummyPrefix {
+		vocab.Prefix = func(text string) string {
+			if text == "" {
+				return text
+			}
+			return " " + text
+		}
+	}
+
+	for field, id := range map[int]*uint32{
+		spTrainerUnkID: &vocab.UNK,
+		spTrainerBosID: &vocab.BOS,
+		spTrainerEosID: &vocab.EOS,
+		spTrainerPadID: &vocab.PAD,
+	} {
+		*id = ml.TOKEN_NONE
+		if value := specials[field]; value >= 0 && int(value) < len(pieces) {
+			*id = uint32(value)
+		}
+	}
+
+	return vocab, nil
+}
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// readProto calls [fn] for each field of protobuf message
+// Numbers of any wire type are passed as [value], length-delimited fields as [bytes]
+func readProto(data []byte, fn func(field, wire int, value uint64, bytes []byte) error) error {
+
+	for len(data) > 0 {
+
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("wrong protobuf field key")
+		}
+		data = data[n:]
+
+		field, wire := int(key>>3), int(key&7)
+
+		var value uint64
+		var bytes []byte
+
+		switch wire {
+		case protoVarint:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("wrong protobuf varint of field %d", field)
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("protobuf field %d is truncated", field)
+			}
+			value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("protobuf field %d is truncated", field)
+			}
+			value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case protoBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return fmt.Errorf("protobuf field %d is truncated", field)
+			}
+			bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d of field %d", wire, field)
+		}
+
+		if err := fn(field, wire, value, bytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ---- HuggingFace tokenizers
+
+// hfTokenizer is tokenizer.json of HuggingFace tokenizers library, only BPE models are supported
+// https://huggingface.co/docs/tokenizers/api/tokenizer
+type hfTokenizer struct {
+	AddedTokens []struct {
+		ID      int    `json:"id"`
+		Content string `json:"content"`
+		Special bool   `json:"special"`
+	} `json:"added_tokens"`
+
+	Normalizer   *hfNormalizer   `json:"normalizer"`
+	PreTokenizer *hfPreTokenizer `json:"pre_tokenizer"`
+
+	PostProcessor *hfPostProcessor `json:"post_processor"`
+
+	Model struct {
+		Type         string          `json:"type"`
+		Vocab        json.RawMessage `json:"vocab"`  // map of pieces to ids for BPE, but a list for Unigram
+		Merges       json.RawMessage `json:"merges"` // either "a b" strings or ["a", "b"] pairs
+		ByteFallback bool            `json:"byte_fallback"`
+		UnkToken     *string         `json:"unk_token"`
+	} `json:"model"`
+}
+
+type hfNormalizer struct {
+	Type        string         `json:"type"`
+	Normalizers []hfNormalizer `json:"normalizers"` // Sequence
+	Prepend     string         `json:"prepend"`     // Prepend
+	Pattern     hfPattern      `json:"pattern"`     // Replace
+	Content     string         `json:"content"`     // Replace
+	StripLeft   bool           `json:"strip_left"`  // Strip
+	StripRight  bool           `json:"strip_right"` // Strip
+}
+
+type hfPreTokenizer struct {
+	Type           string           `json:"type"`
+	PreTokenizers  []hfPreTokenizer `json:"pretokenizers"`    // Sequence
+	AddPrefixSpace *bool            `json:"add_prefix_space"` // ByteLevel and old Metaspace
+	UseRegex       *bool            `json:"use_regex"`        // ByteLevel
+	Replacement    string           `json:"replacement"`      // Metaspace
+	PrependScheme  string           `json:"prepend_scheme"`   // Metaspace
+	Split          *bool            `json:"split"`            // Metaspace
+	Pattern        hfPattern        `json:"pattern"`          // Split
+	Behavior       string           `json:"behavior"`         // Split
+	Invert         bool             `json:"invert"`           // Split
+}
+
+// hfPostProcessor adds special tokens around the text, so BOS is the one placed before it
+type hfPostProcessor struct {
+	Type       string            `json:"type"`
+	Processors []hfPostProcessor `json:"processors"` // Sequence
+	Single     []struct {
+		SpecialToken *struct {
+			ID string `json:"id"`
+		} `json:"SpecialToken"`
+		Sequence *struct{} `json:"Sequence"`
+	} `json:"single"` // TemplateProcessing
+	SpecialTokens map[string]struct {
+		IDs []int `json:"ids"`
+	} `json:"special_tokens"` // TemplateProcessing
+}
+
+// bos returns the id of the special token added before the text, -1 if there is none
+func (processor *hfPostProcessor) bos() int {
+
+	if processor.Type == "Sequence" {
+		for i := range processor.Processors {
+			if id := processor.Processors[i].bos(); id >= 0 {
+				return id
+			}
+		}
+	}
+
+	if processor.Type != "TemplateProcessing" || len(processor.Single) == 0 || processor.Single[0].SpecialToken == nil {
+		return -1
+	}
+
+	if special := processor.SpecialTokens[processor.Single[0].SpecialToken.ID]; len(special.IDs) == 1 {
+		return special.IDs[0]
+	}
+
+	return -1
+}
+
+type hfPattern struct {
+	String *string `json:"String"`
+	Regex  *string `json:"Regex"`
+}
+
+// regexp returns the pattern as regular expression, plain strings are quoted
+func (pattern *hfPattern) regexp() (string, error) {
+	switch {
+	case pattern.String != nil:
+		return regexp.QuoteMeta(*pattern.String), nil
+	case pattern.Regex != nil:
+		return *pattern.Regex, nil
+	}
+	return "", fmt.Errorf("pattern has neither String nor Regex")
+}
+
+// bpePatternMetaspace splits words before each space keeping the space with the word after it
+const bpePatternMetaspace = ` ?[^ ]+| `
+
+// hfSetup is what tokenizer.json settings turn into
+type hfSetup struct {
+	steps     normalizers
+	prefix    func(text string) string // the leading space only the text at the very start gets
+	byteLevel bool                     // pieces and merges are byte-level encoded like GPT-2 ones
+	spaces    bool                     // whitespace markers are used instead of spaces
+	pattern   string                   // pre-tokenization regexp
+}
+
+// readTokenizerJSON reads tokenizer.json of HuggingFace tokenizers with optional tokenizer_config.json
+// Both byte-level BPE of GPT-2 family and BPE with byte fallback like LLaMA one are supported
+func readTokenizerJSON(data, config []byte) (*ml.Vocab, error) {
+
+	var hf hfTokenizer
+	if err := json.Unmarshal(data, &hf); err != nil {
+		return nil, err
+	}
+
+	if hf.Model.Type != "BPE" && hf.Model.Type != "" {
+		return nil, fmt.Errorf("unsupported tokenizer model '%s', only BPE is supported", hf.Model.Type)
+	}
+
+	var ids map[string]int
+	if err := json.Unmarshal(hf.Model.Vocab, &ids); err != nil {
+		return nil, fmt.Errorf("wrong BPE vocab: %w", err)
+	}
+
+	merges, err := hfMerges(hf.Model.Merges)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := &hfSetup{}
+	if hf.Normalizer != nil {
+		if err := setup.normalizer(hf.Normalizer); err != nil {
+			return nil, err
+		}
+	}
+	if hf.PreTokenizer != nil {
+		if err := setup.preTokenizer(hf.PreTokenizer); err != nil {
+			return nil, err
+		}
+	}
+
+	// --- pieces of the model and added tokens by their ids
+
+	size := 0
+	for _, id := range ids {
+		if id >= size {
+			size = id + 1
+		}
+	}
+	for _, added := range hf.AddedTokens {
+		if added.ID >= size {
+			size = added.ID + 1
+		}
+	}
+
+	pieces := make([]string, size)
+	types := make([]int32, size)
+	for i := range pieces {
+		pieces[i] = fmt.Sprintf("[PAD%d]", i)
+		types[i] = int32(ml.TOKEN_TYPE_UNUSED)
+	}
+
+	decoder := gpt2Decoder()
+	for piece, id := range ids {
+		if id < 0 {
+			return nil, fmt.Errorf("wrong id %d of piece '%s'", id, piece)
+		}
+		types[id] = int32(ml.TOKEN_TYPE_NORMAL)
+		switch {
+		case setup.byteLevel:
+			piece = gpt2Decode(decoder, piece)
+		case hf.Model.ByteFallback:
+			if _, ok := parseByteToken(piece); ok {
+				types[id] = int32(ml.TOKEN_TYPE_BYTE)
+			}
+		}
+		if hf.Model.UnkToken != nil && piece == *hf.Model.UnkToken {
+			types[id] = int32(ml.TOKEN_TYPE_UNKNOWN)
+		}
+		pieces[id] = piece
+	}
+
+	for _, added := range hf.AddedTokens {
+		if added.ID < 0 {
+			return nil, fmt.Errorf("wrong id %d of added token '%s'", added.ID, added.Content)
+		}
+		pieces[added.ID] = added.Content
+		types[added.ID] = int32(ml.TOKEN_TYPE_USER_DEFINED)
+		if added.Special {
+			types[added.ID] = int32(ml.TOKEN_TYPE_CONTROL)
+		}
+	}
+
+	// --- merges are pieces too, so they get the same encoding
+
+	for i := range merges {
+		for j := range merges[i] {
+			switch {
+			case setup.byteLevel:
+				merges[i][j] = gpt2Decode(decoder, merges[i][j])
+			case setup.spaces:
+				merges[i][j] = strings.ReplaceAll(merges[i][j], "▁", " ")
+			}
+		}
+	}
+
+	bpe, err := ml.NewBPE(merges, setup.pattern)
+	if err != nil {
+		return nil, err
+	}
+	bpe.CharLevel = !setup.byteLevel
+
+	steps := setup.steps
+	if setup.spaces {
+		steps = append(steps, func(text string) string {
+			return strings.ReplaceAll(text, "▁", " ")
+		})
+	}
+
+	vocab := newVocab(pieces, nil, types, setup.spaces)
+	vocab.Tokenizer = bpe
+	vocab.Normalize = steps.normalize
+	vocab.Prefix = setup.prefix
+
+	// --- tokenizer.json knows only the unknown token and the one added before the text, the rest are in the config
+
+	for _, added := range hf.AddedTokens {
+		ids[added.Content] = added.ID
+	}
+
+	vocab.BOS, vocab.EOS, vocab.UNK = ml.TOKEN_NONE, ml.TOKEN_NONE, ml.TOKEN_NONE
+	if hf.Model.UnkToken != nil {
+		if id, ok := ids[*hf.Model.UnkToken]; ok {
+			vocab.UNK = uint32(id)
+		}
+	}
+	if hf.PostProcessor != nil {
+		if id := hf.PostProcessor.bos(); id >= 0 && id < size {
+			vocab.BOS = uint32(id)
+		}
+	}
+
+	if config != nil {
+		if err := hfSpecialTokens(vocab, ids, config); err != nil {
+			return nil, fmt.Errorf("tokenizer_config.json: %w", err)
+		}
+	}
+
+	return vocab, nil
+}
+
+// hfSpecialTokens sets special tokens of vocab from tokenizer_config.json by the ids of their text
+// Tokens are given either as their text or as objects of added tokens
+func hfSpecialTokens(vocab *ml.Vocab, ids map[string]int, data []byte) error {
+
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	for key, id := range map[string]*uint32{
+		"bos_token": &vocab.BOS,
+		"eos_token": &vocab.EOS,
+		"unk_token": &vocab.UNK,
+		"pad_token": &vocab.PAD,
+	} {
+
+		raw, ok := config[key]
+		if !ok {
+			continue
+		}
+
+		var text string
+		var added struct {
+			Content string `json:"content"`
+		}
+
+		switch {
+		case string(raw) == "null":
+			*id = ml.TOKEN_NONE
+			continue
+		case json.Unmarshal(raw, &text) == nil:
+		case json.Unmarshal(raw, &added) == nil:
+			text = added.Content
+		default:
+			return fmt.Errorf("wrong %s", key)
+		}
+
+		index, ok := ids[text]
+		if !ok {
+			return fmt.Errorf("%s '%s' is not in vocab", key, text)
+		}
+		*id = uint32(index)
+	}
+
+	return nil
+}
+
+// hfMerges reads merges of either form
+func hfMerges(data json.RawMessage) ([][2]string, error) {
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var pairs [][2]string
+	if err := json.Unmarshal(data, &pairs); err == nil {
+		return pairs, nil
+	}
+
+	var lines []string
+	if err := json.Unmarshal(data, &lines); err != nil {
+		return nil, fmt.Errorf("wrong BPE merges: %w", err)
+	}
+
+	pairs = make([][2]string, 0, len(lines))
+	for _, line := range lines {
+		left, right, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("wrong BPE merge '%s'", line)
+		}
+		pairs = append(pairs, [2]string{left, right})
+	}
+
+	return pairs, nil
+}
+
+// normalizer adds text normalization steps, Replace into the whitespace marker switches the vocab to spaces
+func (setup *hfSetup) normalizer(normalizer *hfNormalizer) error {
+
+	switch normalizer.Type {
+
+	case "Sequence":
+		for i := range normalizer.Normalizers {
+			if err := setup.normalizer(&normalizer.Normalizers[i]); err != nil {
+				return err
+			}
+		}
+
+	case "Prepend":
+		prepend := normalizer.Prepend
+		setup.steps = append(setup.steps, func(text string) string {
+			if text == "" {
+				return text
+			}
+			return prepend + text
+		})
+
+	case "Replace":
+		pattern, err := normalizer.Pattern.regexp()
+		if err != nil {
+			return err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		content := normalizer.Content
+		setup.steps = append(setup.steps, func(text string) string {
+			return re.ReplaceAllLiteralString(text, content)
+		})
+		if content == "▁" {
+			setup.spaces = true
+		}
+
+	case "NFC", "NFD", "NFKC", "NFKD":
+		setup.steps = append(setup.steps, unicodeNormalizers[normalizer.Type].String)
+
+	case "Lowercase":
+		setup.steps = append(setup.steps, strings.ToLower)
+
+	case "Strip":
+		left, right := normalizer.StripLeft, normalizer.StripRight
+		setup.steps = append(setup.steps, func(text string) string {
+			if left {
+				text = strings.TrimLeftFunc(text, unicode.IsSpace)
+			}
+			if right {
+				text = strings.TrimRightFunc(text, unicode.IsSpace)
+			}
+			return text
+		})
+
+	case "StripAccents":
+		// accents are separate marks after NFD, the same way HF expects it
+		setup.steps = append(setup.steps, func(text string) string {
+			return strings.Map(func(r rune) rune {
+				if unicode.Is(unicode.Mn, r) {
+					return -1
+				}
+				return r
+			}, text)
+		})
+
+	default:
+		return fmt.Errorf("unsupported normalizer '%s'", normalizer.Type)
+	}
+
+	return nil
+}
+
+// preTokenizer sets the pattern splitting text into words and adds prefix spaces to normalization
+func (setup *hfSetup) preTokenizer(pre *hfPreTokenizer) error {
+
+	switch pre.Type {
+
+	case "Sequence":
+		for i := range pre.PreTokenizers {
+			if err := setup.preTokenizer(&pre.PreTokenizers[i]); err != nil {
+				return err
+			}
+		}
+
+	case "ByteLevel":
+		setup.byteLevel = true
+		if pre.UseRegex == nil || *pre.UseRegex {
+			if setup.pattern != "" {
+				return fmt.Errorf("only one pre-tokenization pattern is supported")
+			}
+			setup.pattern = ml.BPE_PATTERN_GPT2
+		}
+		if pre.AddPrefixSpace != nil && *pre.AddPrefixSpace {
+			setup.steps = append(setup.steps, func(text string) string {
+				if text == "" || strings.HasPrefix(text, " ") {
+					return text
+				}
+				return " " + text
+			})
+		}
+
+	case "Split":
+		if pre.Behavior != "Isolated" || pre.Invert {
+			return fmt.Errorf("unsupported behavior '%s' of Split pre-tokenizer", pre.Behavior)
+		}
+		if setup.pattern != "" {
+			return fmt.Errorf("only one pre-tokenization pattern is supported")
+		}
+		pattern, err := pre.Pattern.regexp()
+		if err != nil {
+			return err
+		}
+		setup.pattern = pattern
+
+	case "Metaspace":
+		if pre.Replacement != "▁" {
+			return fmt.Errorf("unsupported Metaspace replacement '%s'", pre.Replacement)
+		}
+		setup.spaces = true
+
+		scheme := pre.PrependScheme
+		if scheme == "" {
+			scheme = "always"
+			if pre.AddPrefixSpace != nil && !*pre.AddPrefixSpace {
+				scheme = "never"
+			}
+		}
+
+		prefix := func(text string) string {
+			if text == "" || strings.HasPrefix(text, " ") || strings.HasPrefix(text, "▁") {
+				return text
+			}
+			return " " + text
+		}
+
+		// "always" adds the space to the text after each special token too, "first" only to the text at the very start
+		switch scheme {
+		case "always":
+			setup.steps = append(setup.steps, prefix)
+		case "first":
+			setup.prefix = prefix
+		}
+
+		if pre.Split == nil || *pre.Split {
+			setup.pattern = bpePatternMetaspace
+		}
+
+	default:
+		return fmt.Errorf("unsupported pre-tokenizer '%s'", pre.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package llama
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// appendProtoBytes appends the length-delimited protobuf field
+func appendProtoBytes(data []byte, field int, value []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(field<<3|protoBytes))
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+// appendProtoVarint appends the varint protobuf field
+func appendProtoVarint(data []byte, field int, value uint64) []byte {
+	data = binary.AppendUvarint(data, uint64(field<<3|protoVarint))
+	return binary.AppendUvarint(data, value)
+}
+
+// testSentencePiece is BPE model with the dummy prefix like the one of LLaMA, [INST] and [/INST] are user-defined
+func testSentencePiece() []byte {
+
+	var model []byte
+	for _, piece := range []struct {
+		text      string
+		score     float32
+		tokenType ml.TokenType
+	}{
+		{"<unk>", 0, ml.TOKEN_TYPE_UNKNOWN},
+		{"<s>", 0, ml.TOKEN_TYPE_CONTROL},
+		{"</s>", 0, ml.TOKEN_TYPE_CONTROL},
+		{"[INST]", 0, ml.TOKEN_TYPE_USER_DEFINED},
+		{"[/INST]", 0, ml.TOKEN_TYPE_USER_DEFINED},
+		{"▁", -3, ml.TOKEN_TYPE_NORMAL},
+		{"h", -3, ml.TOKEN_TYPE_NORMAL},
+		{"i", -3, ml.TOKEN_TYPE_NORMAL},
+		{"▁h", -1, ml.TOKEN_TYPE_NORMAL},
+		{"▁hi", -0.5, ml.TOKEN_TYPE_NORMAL},
+		{"hi", -2, ml.TOKEN_TYPE_NORMAL},
+	} {
+		var message []byte
+		message = appendProtoBytes(message, spPieceText, []byte(piece.text))
+		message = binary.AppendUvarint(message, uint64(spPieceScore<<3|protoFixed32))
+		message = binary.LittleEndian.AppendUint32(message, math.Float32bits(piece.score))
+		message = appendProtoVarint(message, spPieceType, uint64(piece.tokenType))
+		model = appendProtoBytes(model, spModelPieces, message)
+	}
+
+	model = appendProtoBytes(model, spModelTrainer, appendProtoVarint(nil, spTrainerModelType, spModelBPE))
+
+	var normalizer []byte
+	normalizer = appendProtoBytes(normalizer, spNormalizerName, []byte("identity"))
+	normalizer = appendProtoVarint(normalizer, spNormalizerDummyPrefix, 1)
+	normalizer = appendProtoVarint(normalizer, spNormalizerExtraWhitespaces, 0)
+
+	return appendProtoBytes(model, spModelNormalizer, normalizer)
+}
+
+// testTokenizerJSON is BPE model of tokenizer.json with Metaspace pre-tokenizer of the given prepend scheme
+func testTokenizerJSON(scheme string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"added_tokens": [
+			{"id": 6, "content": "[INST]", "special": true},
+			{"id": 7, "content": "[/INST]", "special": true}
+		],
+		"pre_tokenizer": {"type": "Metaspace", "replacement": "▁", "prepend_scheme": "%s", "split": false},
+		"model": {
+			"type": "BPE",
+			"vocab": {"▁": 0, "h": 1, "i": 2, "▁h": 3, "▁hi": 4, "hi": 5},
+			"merges": ["▁ h", "▁h i", "h i"]
+		}
+	}`, scheme))
+}
+
+func TestTokenizeSpecialPrefix(t *testing.T) {
+
+	sentencePiece, err := readSentencePiece(testSentencePiece())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := readTokenizerJSON(testTokenizerJSON("first"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	always, err := readTokenizerJSON(testTokenizerJSON("always"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		vocab *ml.Vocab
+		text  string
+		want  []uint32
+	}{
+		// <s> [INST] ▁hi ▁ [/INST]
+		{"SentencePiece", sentencePiece, "<s>[INST] hi [/INST]", []uint32{1, 3, 9, 5, 4}},
+		// ▁hi </s> hi
+		{"SentencePieceFirst", sentencePiece, "hi</s>hi", []uint32{9, 2, 10}},
+		// [INST] hi [/INST] hi
+		{"MetaspaceFirst", first, "[INST]hi[/INST]hi", []uint32{6, 5, 7, 5}},
+		// ▁hi [INST] hi
+		{"MetaspaceFirstStart", first, "hi[INST]hi", []uint32{4, 6, 5}},
+		// [INST] ▁hi [/INST] ▁hi
+		{"MetaspaceAlways", always, "[INST]hi[/INST]hi", []uint32{6, 4, 7, 4}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ml.TokenizeSpecial(test.vocab, test.text, false); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("'%s' is %v, want %v", test.text, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package llama
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/x448/float16"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// ggjtWriter writes model files in ggjt v1 format
+// It remembers the first error and the current position needed for tensors alignment
+type ggjtWriter struct {
+	w   io.Writer
+	pos int64
+	err error
+	buf []byte
+}
+
+func (gw *ggjtWriter) write(data []byte) {
+	if gw.err != nil {
+		return
+	}
+	n, err := gw.w.Write(data)
+	gw.pos += int64(n)
+	gw.err = err
+}
+
+func (gw *ggjtWriter) u32(value uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], value)
+	gw.write(buf[:])
+}
+
+func (gw *ggjtWriter) f32(value float32) {
+	gw.u32(math.Float32bits(value))
+}
+
+// header writes magic, version and hparams
+func (gw *ggjtWriter) header(hparams *HParams, ftype uint32) {
+	gw.u32(LLAMA_FILE_MAGIC)
+	gw.u32(LLAMA_FILE_VERSION)
+	gw.u32(hparams.vocabSize)
+	gw.u32(hparams.embdSize)
+	gw.u32(hparams.multSize)
+	gw.u32(hparams.headsCount)
+	gw.u32(hparams.layersCount)
+	gw.u32(hparams.rotCount)
+	gw.u32(ftype)
+}
+
+// vocab writes all tokens with their scores
+func (gw *ggjtWriter) vocab(vocab *ml.Vocab) {
+	for _, token := range vocab.ID2Token {
+		gw.u32(uint32(len(token.Token)))
+		gw.write([]byte(token.Token))
+		gw.f32(token.Score)
+	}
+}
+
+// tensorHeader writes the tensor record header and pads the file for its data to be aligned for 32 bytes
+func (gw *ggjtWriter) tensorHeader(name string, dims uint32, ne [4]uint32, dtype ml.DType) {
+	gw.u32(dims)
+	gw.u32(uint32(len(name)))
+	gw.u32(uint32(dtype))
+	for i := uint32(0); i < dims; i++ {
+		gw.u32(ne[i])
+	}
+	gw.write([]byte(name))
+
+	alignment := int64(32)
+	if rem := gw.pos % alignment; rem != 0 {
+		gw.write(make([]byte, alignment-rem))
+	}
+}
+
+// floats writes FP32 values converting them into the given type, which should be F32 or F16
+func (gw *ggjtWriter) floats(data []float32, dtype ml.DType) {
+	const chunk = 1 << 16
+	size := int(ml.TYPE_SIZE[dtype])
+	if cap(gw.buf) < chunk*size {
+		gw.buf = make([]byte, chunk*size)
+	}
+	for len(data) > 0 && gw.err == nil {
+		n := chunk
+		if len(data) < n {
+			n = len(data)
+		}
+		buf := gw.buf[:n*size]
+		for i, value := range data[:n] {
+			if dtype == ml.TYPE_F16 {
+				binary.LittleEndian.PutUint16(buf[i*2:], float16.Fromfloat32(value).Bits())
+			} else {
+				binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(value))
+			}
+		}
+		gw.write(buf)
+		data = data[n:]
+	}
+}
+
+// SaveModel writes the model with its vocab in ggjt v1 format, so it could be read back with LoadModel
+// Weights are saved in the same types they are kept in memory, FP32 or quantized ones
+// The writer should be at the start of file, because tensors data is aligned relative to the first written byte
+// GGUF only settings like RoPE frequencies or token types can't be stored in ggjt and are lost
+func SaveModel(w io.Writer, vocab *ml.Vocab, model *Model) error {
+
+	if name := model.hparams.arch.name(); name != "llama" {
+		return fmt.Errorf("ggjt format supports only LLaMA models, not %s", name)
+	}
+	if model.hparams.expertsCount > 0 {
+		return fmt.Errorf("ggjt format has no place for %d experts of the model", model.hparams.expertsCount)
+	}
+
+	hparams := *model.hparams
+	hparams.vocabSize = uint32(len(vocab.ID2Token))
+
+	// GGUF files have no multiple_of value, so find the one giving the same size of feed-forward layers
+	if hparams.multSize == 0 || ggjtFFSize(hparams.embdSize, hparams.multSize) != hparams.ffSize {
+		hparams.multSize = 0
+		for mult := uint32(8192); mult > 0; mult-- {
+			if ggjtFFSize(hparams.embdSize, mult) == hparams.ffSize {
+				hparams.multSize = mult
+				break
+			}
+		}
+		if hparams.multSize == 0 {
+			return fmt.Errorf("feed-forward size %d can't be stored in ggjt format", hparams.ffSize)
+		}
+	}
+
+	if hparams.rotCount == 0 {
+		hparams.rotCount = hparams.embdSize / hparams.headsCount
+	}
+
+	// --- ftype shows the type used for most of weights
+
+	names := model.tensorNames()
+
+	counts := make(map[ml.DType]int)
+	for _, name := range names {
+		if tensor := model.tensors[name]; tensor.Dims == 2 {
+			counts[tensor.Type]++
+		}
+	}
+	var dtype ml.DType
+	for dt, count := range counts {
+		if count > counts[dtype] || count == counts[dtype] && dt > dtype {
+			dtype = dt
+		}
+	}
+
+	gw := &ggjtWriter{w: w}
+	gw.header(&hparams, fileTypes[dtype])
+	gw.vocab(vocab)
+
+	for _, name := range names {
+		tensor := model.tensors[name]
+		gw.tensorHeader(name, tensor.Dims, tensor.NE, tensor.Type)
+		switch {
+		case ml.IsQuantized(tensor.Type):
+			gw.write(tensor.Blocks)
+		case tensor.Type == ml.TYPE_F32:
+			gw.floats(tensor.Data[:tensor.Nelements()], ml.TYPE_F32)
+		default:
+			return &TensorError{Name: name, Offset: gw.pos, Err: fmt.Errorf("type %d: %w", tensor.Type, ErrUnsupportedDType)}
+		}
+		if gw.err != nil {
+			return gw.err
+		}
+	}
+
+	return nil
+}
+
+// ggjtFFSize computes the size of feed-forward layers the same way as readGGJT does
+func ggjtFFSize(embdSize, multSize uint32) uint32 {
+	return ((2*(4*embdSize)/3 + multSize - 1) / multSize) * multSize
+}
+
+// tensorNames returns names of model tensors with global ones first, then layers ordered by their index
+func (model *Model) tensorNames() []string {
+
+	layer := func(name string) int {
+		if !strings.HasPrefix(name, "layers.") {
+			return -1
+		}
+		index, _ := strconv.Atoi(strings.SplitN(name, ".", 3)[1])
+		return index
+	}
+
+	names := make([]string, 0, len(model.tensors))
+	for name := range model.tensors {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		li, lj := layer(names[i]), layer(names[j])
+		if li != lj {
+			return li < lj
+		}
+		return names[i] < names[j]
+	})
+
+	return names
+}
@@ -0,0 +1,215 @@
+package llama
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/extrame/llama.go/pkg/ml"
+)
+
+// testModel creates a small LLaMA model with random weights, matrices are stored in the given type
+func testModel(t *testing.T, dtype ml.DType) (*ml.Vocab, *Model) {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(1))
+
+	vocab := ml.NewVocab(40)
+	for i := range vocab.ID2Token {
+		token := fmt.Sprintf("tok%d", i)
+		vocab.ID2Token[i] = ml.TokenScore{Token: token, Score: -float32(i) / 4}
+		vocab.Token2ID[token] = uint32(i)
+	}
+
+	model := NewModel(&ModelParams{CtxSize: 32})
+	model.hparams = &HParams{
+		arch:          llamaArch{},
+		ctxSize:       32,
+		vocabSize:     vocab.Size,
+		embdSize:      64,
+		multSize:      32,
+		ffSize:        ggjtFFSize(64, 32),
+		headsCount:    4,
+		kvHeadsCount:  4,
+		layersCount:   2,
+		rotCount:      16,
+		ropeFreqBase:  10000.0,
+		ropeFreqScale: 1.0,
+		ropeCtxOrig:   32, // LoadModel takes the context size when the file has none
+	}
+
+	for name, ne := range model.hparams.tensorShapes() {
+
+		data := make([]float32, ne[0]*ne[1])
+		for i := range data {
+			data[i] = float32(rnd.NormFloat64())
+		}
+
+		// vectors like norms are always FP32
+		if ne[1] == 1 {
+			model.tensors[name] = ml.NewTensor(nil, ml.TYPE_F32, 1, ne[0], 1, 1, 1, data)
+			continue
+		}
+
+		if !ml.IsQuantized(dtype) {
+			model.tensors[name] = ml.NewTensor(nil, dtype, 2, ne[0], ne[1], 1, 1, data)
+			continue
+		}
+
+		tensor := ml.NewQuantizedTensor(nil, dtype, 2, ne[0], ne[1], 1, 1, nil)
+		if err := ml.QuantizeRow(dtype, data, tensor.Blocks); err != nil {
+			t.Fatal(err)
+		}
+		model.tensors[name] = tensor
+	}
+
+	if err := model.bindTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	return vocab, model
+}
+
+func TestSaveModelRoundTrip(t *testing.T) {
+
+	for _, test := range []struct {
+		name  string
+		dtype ml.DType
+	}{
+		{"F32", ml.TYPE_F32},
+		{"Q4_0", ml.TYPE_Q4_0},
+		{"Q8_0", ml.TYPE_Q8_0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+
+			vocab, model := testModel(t, test.dtype)
+
+			path := filepath.Join(t.TempDir(), "model.bin")
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := SaveModel(file, vocab, model); err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			vocab2, model2, err := LoadModel(path, &ModelParams{CtxSize: 32}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer model2.Release()
+
+			// --- hparams
+
+			got, want := *model2.hparams, *model.hparams
+			got.f16, want.f16 = 0, 0 // ftype is derived from the weights on save
+			if got != want {
+				t.Errorf("hparams %+v, want %+v", got, want)
+			}
+
+			// --- vocab
+
+			if len(vocab2.ID2Token) != len(vocab.ID2Token) {
+				t.Fatalf("vocab of %d tokens, want %d", len(vocab2.ID2Token), len(vocab.ID2Token))
+			}
+			for i, token := range vocab.ID2Token {
+				if vocab2.ID2Token[i] != token || vocab2.Token2ID[token.Token] != uint32(i) {
+					t.Errorf("token %d is %+v, want %+v", i, vocab2.ID2Token[i], token)
+				}
+			}
+
+			// --- tensors
+
+			if len(model2.tensors) != len(model.tensors) {
+				t.Errorf("%d tensors, want %d", len(model2.tensors), len(model.tensors))
+			}
+			for name, tensor := range model.tensors {
+
+				loaded, ok := model2.tensors[name]
+				if !ok {
+					t.Errorf("tensor '%s' is missing", name)
+					continue
+				}
+
+				if loaded.Type != tensor.Type || loaded.Dims != tensor.Dims || loaded.NE != tensor.NE {
+					t.Errorf("tensor '%s' of type %d %v, want type %d %v", name, loaded.Type, loaded.NE, tensor.Type, tensor.NE)
+					continue
+				}
+
+				if ml.IsQuantized(tensor.Type) {
+					if !bytes.Equal(loaded.Blocks, tensor.Blocks) {
+						t.Errorf("tensor '%s' blocks differ", name)
+					}
+					continue
+				}
+
+				for i, value := range tensor.Data[:tensor.Nelements()] {
+					if math.Float32bits(loaded.Data[i]) != math.Float32bits(value) {
+						t.Errorf("tensor '%s' value #%d is %v, want %v", name, i, loaded.Data[i], value)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLoadVocabCorrupted(t *testing.T) {
+
+	vocab, model := testModel(t, ml.TYPE_F32)
+
+	var buf bytes.Buffer
+	if err := SaveModel(&buf, vocab, model); err != nil {
+		t.Fatal(err)
+	}
+
+	// magic, version and 7 hparams go before the first token, vocab_size is the first of hparams
+	const vocabSizeOffset, tokenOffset = 8, 36
+
+	// each token is its length, text and score
+	vocabEnd := tokenOffset
+	for _, token := range vocab.ID2Token {
+		vocabEnd += 8 + len(token.Token)
+	}
+	lastToken := vocabEnd - 8 - len(vocab.ID2Token[vocab.Size-1].Token)
+
+	for _, test := range []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		err     error
+	}{
+		{"Header", func(data []byte) []byte { return data[:20] }, ErrTruncatedFile},
+		{"Length", func(data []byte) []byte { return data[:lastToken+2] }, ErrTruncatedFile},
+		{"Score", func(data []byte) []byte { return data[:vocabEnd-2] }, ErrTruncatedFile},
+		{"VocabSize", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[vocabSizeOffset:], 0xFFFFFFF0)
+			return data
+		}, ErrInvalidFile},
+		{"TokenLength", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[tokenOffset:], 0xFFFFFFF0)
+			return data
+		}, ErrInvalidFile},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+
+			path := filepath.Join(t.TempDir(), "model.bin")
+			data := test.corrupt(bytes.Clone(buf.Bytes()))
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := LoadVocab(path); !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
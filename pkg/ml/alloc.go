@@ -0,0 +1,276 @@
+package ml
+
+import (
+	"sync"
+)
+
+// Allocator places intermediate tensors of graphs into one arena of FP32 values
+// Graph nodes are created without buffers, Plan places them into the arena after the graph is built,
+// so the memory is taken by the peak of live tensors instead of all of them
+// Graphs planned by the same allocator share the arena, thus they should be computed one after another
+// and their outputs are valid only until the next compute
+type Allocator struct {
+	sync.Mutex
+
+	Pool     []float32 // the arena, it grows to the largest peak of planned graphs
+	PoolSize int       // peak memory of the last planned graph in bytes
+}
+
+func NewAllocator() *Allocator {
+	return &Allocator{}
+}
+
+// buffer is the memory of tensor owning it together with the range of graph nodes using it
+type buffer struct {
+	tensor *Tensor
+	size   uint32 // in floats
+	offset uint32 // within the arena
+
+	first int // the node which writes the buffer first
+	last  int // the last node which reads or writes it
+}
+
+// block is the free part of the arena
+type block struct {
+	offset uint32
+	size   uint32
+}
+
+// arena keeps free blocks sorted by offsets, top is the end of the used part
+type arena struct {
+	free []block
+	top  uint32
+}
+
+// alloc takes the smallest free block large enough for the size or grows the arena
+func (a *arena) alloc(size uint32) uint32 {
+
+	best := -1
+	for i, b := range a.free {
+		if b.size >= size && (best < 0 || b.size < a.free[best].size) {
+			best = i
+		}
+	}
+
+	if best >= 0 {
+		offset := a.free[best].offset
+		if a.free[best].size == size {
+			a.free = append(a.free[:best], a.free[best+1:]...)
+		} else {
+			a.free[best].offset += size
+			a.free[best].size -= size
+		}
+		return offset
+	}
+
+	// the last free block is extended when it ends the arena
+	if last := len(a.free) - 1; last >= 0 && a.free[last].offset+a.free[last].size == a.top {
+		offset := a.free[last].offset
+		a.free = a.free[:last]
+		a.top = offset + size
+		return offset
+	}
+
+	offset := a.top
+	a.top += size
+	return offset
+}
+
+// release returns the block to the free list merging it with neighbours
+func (a *arena) release(offset, size uint32) {
+
+	i := 0
+	for i < len(a.free) && a.free[i].offset < offset {
+		i++
+	}
+
+	a.free = append(a.free, block{})
+	copy(a.free[i+1:], a.free[i:])
+	a.free[i] = block{offset, size}
+
+	if i+1 < len(a.free) && a.free[i].offset+a.free[i].size == a.free[i+1].offset {
+		a.free[i].size += a.free[i+1].size
+		a.free = append(a.free[:i+1], a.free[i+2:]...)
+	}
+
+	if i > 0 && a.free[i-1].offset+a.free[i-1].size == a.free[i].offset {
+		a.free[i-1].size += a.free[i].size
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	}
+}
+
+// owner returns the tensor which buffer is shared by views
+func owner(tensor *Tensor) *Tensor {
+	for tensor.view != nil {
+		tensor = tensor.view
+	}
+	return tensor
+}
+
+// Plan moves buffers of intermediate tensors of the graph into the arena and returns its peak size in bytes
+// Planned are buffers of graph nodes with their scratch tensors and of leafs fully overwritten by copy nodes before anything reads them,
+// other leafs like inputs, weights and caches stay where they are
+// The buffer lives from the node writing it first till the last node using it directly or through views,
+// buffers whose lifetimes don't overlap share the same memory
+// Outputs read after the compute are kept alive till the end of the graph
+func (a *Allocator) Plan(graph *Graph, outputs ...*Tensor) int {
+
+	buffers := make(map[*Tensor]*buffer)
+	order := make([]*buffer, 0, graph.NodesCount)
+
+	// the first use of each tensor, leafs read before they are written are inputs
+	used := make(map[*Tensor]int)
+
+	nodes := graph.Nodes[:graph.NodesCount]
+
+	for i, node := range nodes {
+
+		for _, src := range sources(node) {
+			if _, ok := used[owner(src)]; !ok {
+				used[owner(src)] = i
+			}
+		}
+
+		var tensor *Tensor
+		switch {
+		case node.view == nil && node.op != OP_NONE:
+			tensor = node
+		case node.op == OP_CPY && node.src1.view == nil && node.src1.op == OP_NONE &&
+			node.src0.Nelements() == node.src1.Nelements():
+			if first, ok := used[node.src1]; ok && first < i {
+				continue
+			}
+			tensor = node.src1
+		}
+
+		// scratch tensors live within the node only
+		for _, tmp := range node.scratch {
+			buf := &buffer{tensor: tmp, size: tmp.Nelements(), first: i, last: i}
+			buffers[tmp] = buf
+			order = append(order, buf)
+		}
+
+		if tensor == nil || tensor.Blocks != nil || buffers[tensor] != nil {
+			continue
+		}
+
+		buf := &buffer{tensor: tensor, size: tensor.Nelements(), first: i, last: i}
+		buffers[tensor] = buf
+		order = append(order, buf)
+	}
+
+	// --- lifetimes
+
+	for i, node := range nodes {
+		if buf, ok := buffers[owner(node)]; ok {
+			buf.last = i
+		}
+		for _, src := range sources(node) {
+			if buf, ok := buffers[owner(src)]; ok && buf.last < i {
+				buf.last = i
+			}
+		}
+	}
+
+	for _, output := range outputs {
+		if buf, ok := buffers[owner(output)]; ok {
+			buf.last = len(nodes)
+		}
+	}
+
+	// --- offsets, buffers are allocated before the ones of the same node are released,
+	// so the node never writes over its sources
+
+	var mem arena
+	next := 0
+	for i := range nodes {
+		for ; next < len(order) && order[next].first == i; next++ {
+			order[next].offset = mem.alloc(order[next].size)
+		}
+		for _, buf := range order {
+			if buf.last == i {
+				mem.release(buf.offset, buf.size)
+			}
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if uint32(len(a.Pool)) < mem.top {
+		a.Pool = make([]float32, mem.top)
+	}
+	a.PoolSize = int(mem.top) * 4
+
+	for _, buf := range order {
+		buf.tensor.Data = a.Pool[buf.offset : buf.offset+buf.size]
+		buf.tensor.Reusable = true
+	}
+
+	// views follow buffers they share, sources always go before nodes using them
+	for _, leaf := range graph.Leafs[:graph.LeafsCount] {
+		rebindView(leaf, buffers)
+	}
+	for _, node := range nodes {
+		rebindView(node, buffers)
+	}
+
+	return a.PoolSize
+}
+
+// rebindView points Data of the view to the new place of the planned buffer it shares
+func rebindView(tensor *Tensor, buffers map[*Tensor]*buffer) {
+	if tensor.view == nil || buffers[owner(tensor)] == nil {
+		return
+	}
+	rebindView(tensor.view, buffers)
+	tensor.Data = tensor.view.Data[tensor.viewOffs:]
+}
+
+// allocNodes gives own memory to nodes of the graph computed without Plan and binds their views to it,
+// nodes which have memory already are left as they are
+func allocNodes(graph *Graph) {
+	for _, node := range graph.Nodes[:graph.NodesCount] {
+		allocData(node)
+		for _, tmp := range node.scratch {
+			allocData(tmp)
+		}
+	}
+}
+
+// allocData allocates Data of the tensor or takes it from the tensor it views
+func allocData(tensor *Tensor) {
+	if tensor.Data != nil || tensor.Blocks != nil {
+		return
+	}
+	if tensor.view == nil {
+		tensor.Data = make([]float32, tensor.Nelements())
+		return
+	}
+	allocData(tensor.view)
+	tensor.Data = viewData(tensor.view, tensor.viewOffs)
+}
+
+// sources returns all tensors the node reads
+func sources(node *Tensor) []*Tensor {
+	srcs := make([]*Tensor, 0, 2+MAX_OPT+len(node.srcs))
+	for _, src := range []*Tensor{node.src0, node.src1} {
+		if src != nil {
+			srcs = append(srcs, src)
+		}
+	}
+	for _, opt := range node.opt {
+		if opt != nil {
+			srcs = append(srcs, opt)
+		}
+	}
+	return append(srcs, node.srcs...)
+}
+
+// Reset drops the arena, tensors planned into it keep their memory until they are gone too
+func (a *Allocator) Reset() {
+	a.Lock()
+	a.Pool = nil
+	a.PoolSize = 0
+	a.Unlock()
+}
@@ -0,0 +1,163 @@
+package ml
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// planGraph builds the graph where in-place ops write over views of tensors read again later
+func planGraph(ctx *Context, x, w *Tensor) (*Graph, *Tensor) {
+
+	a := MulMat(ctx, w, x)
+	b := Silu(ctx, a)
+	c := ScaleInplace(ctx, b, NewFP32(ctx, 0.5)) // the view of b
+	d := Mul(ctx, a, a)
+	e := Add(ctx, c, d)
+	f := SoftMax(ctx, e) // the view of e
+	g := Sqr(ctx, f)
+	out := Add(ctx, g, c) // b lives till here through c
+
+	graph := &Graph{}
+	BuildForwardExpand(graph, out)
+
+	return graph, out
+}
+
+func TestAllocatorPlan(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+
+	x := NewTensor2D(nil, TYPE_F32, 8, 4)
+	w := NewTensor2D(nil, TYPE_F32, 8, 6)
+	for _, tensor := range []*Tensor{x, w} {
+		for i := range tensor.Data {
+			tensor.Data[i] = float32(rnd.NormFloat64())
+		}
+	}
+
+	ctx := NewContext(2, false, false)
+
+	// --- the graph computed with own memory of nodes is the reference
+
+	graph, want := planGraph(ctx, x, w)
+	if err := GraphCompute(ctx, graph); err != nil {
+		t.Fatal(err)
+	}
+
+	graph, out := planGraph(ctx, x, w)
+	nodes := graph.Nodes[:graph.NodesCount]
+
+	for i, node := range nodes {
+		if node.view == nil && node.Data != nil {
+			t.Errorf("node #%d of op %s has memory before Plan", i, opNames[node.op])
+		}
+	}
+
+	peak := ctx.Allocator.Plan(graph, out)
+
+	// --- lifetimes of buffers follow views to the tensors owning them
+
+	first := make(map[*Tensor]int)
+	last := make(map[*Tensor]int)
+	for i, node := range nodes {
+		if !owner(node).Reusable {
+			continue
+		}
+		if _, ok := first[owner(node)]; !ok {
+			first[owner(node)] = i
+		}
+		last[owner(node)] = i
+		for _, src := range sources(node) {
+			if owner(src).Reusable {
+				last[owner(src)] = i
+			}
+		}
+	}
+	last[owner(out)] = len(nodes)
+
+	// slices of the arena end where it ends, so offsets follow from capacities
+	pool := ctx.Allocator.Pool
+	offset := func(tensor *Tensor) int { return len(pool) - cap(tensor.Data) }
+
+	total := 0
+	for tensor := range first {
+		total += int(tensor.Nelements()) * 4
+		if offset(tensor)+int(tensor.Nelements()) > len(pool) || offset(tensor) < 0 {
+			t.Errorf("buffer of op %s is outside of the arena", opNames[tensor.op])
+		}
+	}
+
+	if peak <= 0 || peak >= total {
+		t.Errorf("peak of %d bytes for %d bytes of buffers", peak, total)
+	}
+
+	for t0 := range first {
+		for t1 := range first {
+			if t0 == t1 || last[t0] < first[t1] || last[t1] < first[t0] {
+				continue
+			}
+			if offset(t0) < offset(t1)+int(t1.Nelements()) && offset(t1) < offset(t0)+int(t0.Nelements()) {
+				t.Errorf("live buffers of ops %s [%d, %d] and %s [%d, %d] share memory",
+					opNames[t0.op], first[t0], last[t0], opNames[t1.op], first[t1], last[t1])
+			}
+		}
+	}
+
+	// --- the planned graph gets the same values
+
+	if err := GraphCompute(ctx, graph); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, value := range want.Data {
+		if math.Float32bits(out.Data[i]) != math.Float32bits(value) {
+			t.Fatalf("value #%d is %v, want %v", i, out.Data[i], value)
+		}
+	}
+}
+
+func TestAllocatorPlanInplaceView(t *testing.T) {
+
+	ctx := NewContext(1, false, false)
+
+	x := NewTensor1D(nil, TYPE_F32, 4)
+	for i := range x.Data {
+		x.Data[i] = float32(i + 1)
+	}
+
+	b := Sqr(ctx, x)
+	c := NegInplace(ctx, b)                   // writes over b
+	d := Add(ctx, x, x)                       // the first node after the last direct use of b
+	out := Add(ctx, d, Sqr(ctx, Abs(ctx, c))) // reads b through the view
+
+	graph := &Graph{}
+	BuildForwardExpand(graph, out)
+	ctx.Allocator.Plan(graph, out)
+
+	if !b.Reusable || c.Reusable {
+		t.Fatalf("planned are b %v and its view %v", b.Reusable, c.Reusable)
+	}
+
+	if &c.Data[0] != &b.Data[0] {
+		t.Errorf("the view is not bound to the planned buffer of its parent")
+	}
+
+	for _, tensor := range []*Tensor{d, out} {
+		offs, parent := len(ctx.Allocator.Pool)-cap(tensor.Data), len(ctx.Allocator.Pool)-cap(b.Data)
+		if offs < parent+int(b.Nelements()) && parent < offs+int(tensor.Nelements()) {
+			t.Errorf("buffer of op %s shares memory with the parent of the live view", opNames[tensor.op])
+		}
+	}
+
+	if err := GraphCompute(ctx, graph); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, value := range out.Data {
+		x := float32(i + 1)
+		if want := 2*x + x*x*x*x; value != want {
+			t.Errorf("value #%d is %v, want %v", i, value, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package ml
+
+import (
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// Fused self-attention of ggml_flash_attn
+// Scores of each query are computed by tiles of keys and folded into the output with the online softmax,
+// so neither KQ matrix nor transposed values are ever stored and the memory doesn't grow with the context
+
+// flashTile is the count of keys which scores are kept at once
+const flashTile = 64
+
+// FlashAttn returns softmax(scale * K * Q) * V with the causal mask as [headSize, heads, N] tensor
+// Queries [q] are [headSize, heads, N], keys [k] and values [v] are [headSize, kvHeads, M] like the cache keeps them
+// With grouped-query attention each KV head is shared by heads / kvHeads heads of queries
+// The query i attends to keys up to past + i, positions of the cache after them are never read
+func FlashAttn(ctx *Context, q, k, v *Tensor, past uint32, scale float32) *Tensor {
+
+	result := newNode(ctx, TYPE_F32, 3, q.NE[0], q.NE[1], q.NE[2], 1)
+
+	// past and scale are params like the ones of Rope, SetPast changes the first one
+	params := NewTensor1D(ctx, TYPE_F32, 2) // Reusable OK
+	params.Data[0] = float32(past)
+	params.Data[1] = scale
+
+	result.op = OP_FLASH_ATTN
+	result.grad = nil
+	result.src0 = q
+	result.src1 = k
+	result.opt[0] = v
+	result.opt[1] = params
+
+	return result
+}
+
+// ggml_compute_forward_flash_attn_f32
+// Rows of the result are pairs of the query and the head, they are split between threads
+func ComputeForwardFlashAttnFP32(params *ComputeParams, q, k, v, dst *Tensor) error {
+
+	if q.Type != TYPE_F32 || k.Type != TYPE_F32 || v.Type != TYPE_F32 {
+		return ErrUnsupportedDType
+	}
+
+	if q.NB[0] != 4 {
+		return fmt.Errorf("[q] %w", ErrNotContiguous)
+	}
+
+	if k.NB[0] != 4 {
+		return fmt.Errorf("[k] %w", ErrNotContiguous)
+	}
+
+	if v.NB[0] != 4 {
+		return fmt.Errorf("[v] %w", ErrNotContiguous)
+	}
+
+	if !dst.IsContiguous() {
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
+	}
+
+	if k.NE[0] != q.NE[0] || v.NE != k.NE || k.NE[1] == 0 || q.NE[1]%k.NE[1] != 0 || q.NE[3] != 1 || k.NE[3] != 1 {
+		return fmt.Errorf("[q] %v, [k] %v and [v] %v: %w", q.NE, k.NE, v.NE, ErrShapeMismatch)
+	}
+
+	if dst.NE != q.NE {
+		return fmt.Errorf("[dst] %v for [q] %v: %w", dst.NE, q.NE, ErrShapeMismatch)
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	ith := params.ith
+	nth := params.nth
+
+	D := q.NE[0]
+	heads := q.NE[1]
+	group := heads / k.NE[1] // heads of queries per KV head
+	M := k.NE[2]
+
+	past := uint32(dst.opt[1].Data[0])
+	scale := dst.opt[1].Data[1]
+
+	// the assembly dot product needs 8 values at least
+	simd := (params.UseAVX || params.UseNEON) && D >= 8
+
+	nr := dst.Nrows()
+
+	// rows per thread
+	dr := (nr + nth - 1) / nth
+
+	// row range for this thread
+	ir0 := dr * ith
+	ir1 := uint32(min(int(ir0+dr), int(nr)))
+
+	var scores [flashTile]float32
+
+	for ir := ir0; ir < ir1; ir++ {
+
+		h := ir % heads
+		i := ir / heads
+
+		qRow := q.Data[(h*q.NB[1]+i*q.NB[2])/4:]
+		kOffs := (h / group) * k.NB[1] / 4
+		vOffs := (h / group) * v.NB[1] / 4
+
+		// the output row accumulates values weighted by exp(score - maxScore)
+		y := dst.Data[ir*dst.NB[1]/4 : ir*dst.NB[1]/4+D]
+		for i0 := range y {
+			y[i0] = 0
+		}
+
+		maxScore := float32(math.Inf(-1))
+		sum := float32(0.0)
+
+		// causal mask
+		keys := min(int(past+i+1), int(M))
+
+		for j0 := 0; j0 < keys; j0 += flashTile {
+
+			j1 := min(j0+flashTile, keys)
+
+			tileMax := maxScore
+			for j := j0; j < j1; j++ {
+				kRow := k.Data[kOffs+uint32(j)*k.NB[2]/4:]
+				var s float32
+				if simd {
+					vdot(unsafe.Pointer(&qRow[0]), unsafe.Pointer(&kRow[0]), uint64(D), unsafe.Pointer(&s))
+				} else {
+					s = VecDotFP32(D, qRow, kRow)
+				}
+				s *= scale
+				scores[j-j0] = s
+				tileMax = maxFloat(tileMax, s)
+			}
+
+			// rescale what was accumulated so far to the new maximum
+			if tileMax > maxScore {
+				if sum > 0 {
+					correction := float32(math.Exp(float64(maxScore - tileMax)))
+					VecScaleFP32(D, y, correction)
+					sum *= correction
+				}
+				maxScore = tileMax
+			}
+
+			for j := j0; j < j1; j++ {
+				scores[j-j0] = float32(math.Exp(float64(scores[j-j0] - maxScore)))
+				sum += scores[j-j0]
+			}
+
+			// values of 4 keys are added at once, so the output row is loaded and stored 4 times less
+			j := j0
+			for ; j+4 <= j1; j += 4 {
+				p := scores[j-j0 : j-j0+4]
+				v0 := v.Data[vOffs+uint32(j)*v.NB[2]/4:][:len(y)]
+				v1 := v.Data[vOffs+uint32(j+1)*v.NB[2]/4:][:len(y)]
+				v2 := v.Data[vOffs+uint32(j+2)*v.NB[2]/4:][:len(y)]
+				v3 := v.Data[vOffs+uint32(j+3)*v.NB[2]/4:][:len(y)]
+				for i0 := range y {
+					y[i0] += p[0]*v0[i0] + p[1]*v1[i0] + p[2]*v2[i0] + p[3]*v3[i0]
+				}
+			}
+			for ; j < j1; j++ {
+				VecMadFP32(D, y, v.Data[vOffs+uint32(j)*v.NB[2]/4:], scores[j-j0])
+			}
+		}
+
+		if sum > 0 {
+			VecScaleFP32(D, y, 1.0/sum)
+		}
+	}
+
+	return nil
+}
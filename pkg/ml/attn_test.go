@@ -0,0 +1,90 @@
+package ml
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// unfusedAttn is attention of the head h the way it was computed before FlashAttn:
+// KQ, scale, causal mask, softmax and then V, keys and values are taken for positions up to past + N only
+func unfusedAttn(ctx *Context, q, k, v *Tensor, h, past uint32, scale float32) *Tensor {
+
+	D, N := q.NE[0], q.NE[2]
+	kvHead := h / (q.NE[1] / k.NE[1])
+	L := past + N
+
+	Q := Dup(ctx, View2D(ctx, q, D, N, q.NB[2], h*D))
+	K := Dup(ctx, View2D(ctx, k, D, L, k.NB[2], kvHead*D))
+	V := Dup(ctx, Transpose(ctx, View2D(ctx, v, D, L, v.NB[2], kvHead*D)))
+
+	KQ := MulMat(ctx, K, Q)
+	KQScaled := Scale(ctx, KQ, NewFP32(ctx, scale))
+	KQMasked := DiagMaskInf(ctx, KQScaled, past)
+	KQSoftMax := SoftMax(ctx, KQMasked)
+
+	return MulMat(ctx, V, KQSoftMax) // [D, N]
+}
+
+func TestFlashAttn(t *testing.T) {
+
+	for _, test := range []struct {
+		name       string
+		D, H, Hkv  uint32
+		N, past, M uint32
+	}{
+		{"Prefill", 16, 4, 4, 7, 0, 7},
+		{"Past", 16, 4, 4, 5, 70, 75},      // keys span two tiles, the last one partial
+		{"GQA", 16, 8, 2, 3, 130, 140},     // 4 heads of queries per KV head, the cache is longer than needed
+		{"Decode", 8, 6, 3, 1, 200, 201},   // a single query over 4 tiles
+		{"SmallHeads", 4, 2, 1, 9, 60, 69}, // the single KV head for all queries, heads of 4 values
+	} {
+		for _, nth := range testThreads {
+			t.Run(fmt.Sprintf("%s/%d", test.name, nth), func(t *testing.T) {
+
+				rnd := rand.New(rand.NewSource(1))
+				ctx := NewContext(nth, false, false)
+
+				q := randTensor(rnd, 3, test.D, test.H, test.N, 1)
+				k := randTensor(rnd, 3, test.D, test.Hkv, test.M, 1)
+				v := randTensor(rnd, 3, test.D, test.Hkv, test.M, 1)
+
+				// positions after past + N are never read
+				for _, tensor := range []*Tensor{k, v} {
+					for i := (test.past + test.N) * test.D * test.Hkv; i < tensor.Nelements(); i++ {
+						tensor.Data[i] = float32(math.NaN())
+					}
+				}
+
+				scale := float32(1.0 / math.Sqrt(float64(test.D)))
+
+				result := FlashAttn(ctx, q, k, v, test.past, scale)
+
+				graph := &Graph{}
+				BuildForwardExpand(graph, result)
+
+				heads := make([]*Tensor, test.H)
+				for h := range heads {
+					heads[h] = unfusedAttn(ctx, q, k, v, uint32(h), test.past, scale)
+					BuildForwardExpand(graph, heads[h])
+				}
+
+				if err := GraphCompute(ctx, graph); err != nil {
+					t.Fatal(err)
+				}
+
+				for h, want := range heads {
+					for i := uint32(0); i < test.N; i++ {
+						for d := uint32(0); d < test.D; d++ {
+							got, want := at(result, d, uint32(h), i, 0), at(want, d, i, 0, 0)
+							if math.IsNaN(float64(got)) || math.Abs(float64(got-want)) > 1e-5 {
+								t.Fatalf("value [%d, %d, %d] is %v, want %v", d, h, i, got, want)
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
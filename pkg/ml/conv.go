@@ -0,0 +1,119 @@
+package ml
+
+import (
+	"fmt"
+)
+
+// 1D convolutions of ggml used by audio encoders like the one of Whisper
+// Kernels [a] are [K, channelsIn, channelsOut] with odd K, inputs [b] are [length, channelsIn]
+// Inputs are padded with K/2 zeros on both sides, so the stride 1 keeps the length and the stride 2 halves it
+
+// ggml_conv_1d_1s
+// Conv1D1S returns [length, channelsOut] tensor
+func Conv1D1S(ctx *Context, a, b *Tensor) *Tensor {
+	return conv1DImpl(ctx, a, b, OP_CONV_1D_1S, b.NE[0])
+}
+
+// ggml_conv_1d_2s
+// Conv1D2S returns [length/2, channelsOut] tensor
+func Conv1D2S(ctx *Context, a, b *Tensor) *Tensor {
+	return conv1DImpl(ctx, a, b, OP_CONV_1D_2S, b.NE[0]/2)
+}
+
+func conv1DImpl(ctx *Context, a, b *Tensor, op optype, length uint32) *Tensor {
+
+	// TODO: support even kernel sizes
+	var err error
+	if a.NE[0]%2 != 1 || a.NE[1] != b.NE[1] || a.NE[3] != 1 || !IsMatrix(b) {
+		err = fmt.Errorf("kernel [a] %v and input [b] %v: %w", a.NE, b.NE, ErrShapeMismatch)
+	}
+
+	result := newNode(ctx, TYPE_F32, 2, length, a.NE[2], 1, 1)
+
+	result.op = op
+	result.err = err
+	result.grad = nil
+	result.src0 = a
+	result.src1 = b
+
+	return result
+}
+
+// ggml_compute_forward_conv_1d_1s_f32 and ggml_compute_forward_conv_1d_2s_f32
+// Output channels are split between threads, each value is the sum over all input channels and kernel taps
+func ComputeForwardConv1DFP32(params *ComputeParams, src0, src1, dst *Tensor, stride uint32) error {
+
+	if src0.Type != TYPE_F32 || src1.Type != TYPE_F32 {
+		return ErrUnsupportedDType
+	}
+
+	if !src0.IsContiguous() {
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
+	}
+
+	if !src1.IsContiguous() {
+		return fmt.Errorf("[src1] %w", ErrNotContiguous)
+	}
+
+	if !dst.IsContiguous() {
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
+	}
+
+	// TODO: support even kernel sizes
+	if src0.NE[0]%2 != 1 || src0.NE[1] != src1.NE[1] || src0.NE[3] != 1 || !IsMatrix(src1) {
+		return fmt.Errorf("kernel [src0] %v and input [src1] %v: %w", src0.NE, src1.NE, ErrShapeMismatch)
+	}
+
+	if dst.NE[0] != src1.NE[0]/stride || dst.NE[1] != src0.NE[2] || !IsMatrix(dst) {
+		return fmt.Errorf("[dst] %v for kernel [src0] %v and input [src1] %v: %w", dst.NE, src0.NE, src1.NE, ErrShapeMismatch)
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	ith := params.ith
+	nth := params.nth
+
+	nk := int(src0.NE[0])
+	nh := nk / 2
+	channels := src0.NE[1]
+	length := int(src1.NE[0])
+
+	nr := dst.NE[1]
+
+	// rows per thread
+	dr := (nr + nth - 1) / nth
+
+	// row range for this thread
+	ir0 := dr * ith
+	ir1 := uint32(min(int(ir0+dr), int(nr)))
+
+	for i1 := ir0; i1 < ir1; i1++ {
+
+		y := dst.Data[i1*dst.NB[1]/4:]
+
+		for i0 := uint32(0); i0 < dst.NE[0]; i0++ {
+
+			// the kernel is centered over the input position
+			center := int(i0 * stride)
+
+			// taps falling into padding are skipped
+			k0 := max(0, nh-center)
+			k1 := min(nk, length-center+nh)
+
+			sum := float32(0.0)
+			for i01 := uint32(0); i01 < channels; i01++ {
+				w := src0.Data[(i1*src0.NB[2]+i01*src0.NB[1])/4:]
+				x := src1.Data[i01*src1.NB[1]/4:]
+				for k := k0; k < k1; k++ {
+					sum += w[k] * x[center+k-nh]
+				}
+			}
+
+			y[i0] = sum
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package ml
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestConv1D(t *testing.T) {
+
+	for _, test := range []struct {
+		name   string
+		op     func(ctx *Context, a, b *Tensor) *Tensor
+		stride uint32
+		kernel uint32
+		length uint32
+	}{
+		{"1S", Conv1D1S, 1, 3, 17},
+		{"1SWide", Conv1D1S, 1, 7, 5},
+		{"2S", Conv1D2S, 2, 3, 17},
+		{"2SWide", Conv1D2S, 2, 5, 16},
+	} {
+		for _, nth := range testThreads {
+			t.Run(fmt.Sprintf("%s/%d", test.name, nth), func(t *testing.T) {
+
+				rnd := rand.New(rand.NewSource(1))
+				ctx := NewContext(nth, false, false)
+
+				// 4 input and 6 output channels
+				a := randTensor(rnd, 3, test.kernel, 4, 6, 1)
+				b := randTensor(rnd, 2, test.length, 4, 1, 1)
+
+				result := test.op(ctx, a, b)
+				if err := computeTensor(ctx, result); err != nil {
+					t.Fatal(err)
+				}
+
+				if result.NE != [4]uint32{test.length / test.stride, 6, 1, 1} {
+					t.Fatalf("result %v for kernel %v and input %v", result.NE, a.NE, b.NE)
+				}
+
+				// zeros pad the input by the half of the kernel on both sides
+				nh := int(test.kernel / 2)
+				for oc := uint32(0); oc < 6; oc++ {
+					for i := uint32(0); i < result.NE[0]; i++ {
+
+						want := float32(0.0)
+						for ic := uint32(0); ic < 4; ic++ {
+							for k := 0; k < int(test.kernel); k++ {
+								pos := int(i*test.stride) + k - nh
+								if pos >= 0 && pos < int(test.length) {
+									want += at(a, uint32(k), ic, oc, 0) * at(b, uint32(pos), ic, 0, 0)
+								}
+							}
+						}
+
+						if got := at(result, i, oc, 0, 0); math.Abs(float64(got-want)) > 1e-5 {
+							t.Fatalf("value [%d, %d] is %v, want %v", i, oc, got, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package ml
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by graph compute, check them with errors.Is
+var (
+	ErrUnsupportedOp    = errors.New("operation is not implemented")
+	ErrUnsupportedDType = errors.New("data type is not supported")
+	ErrShapeMismatch    = errors.New("wrong tensor shape")
+	ErrNotContiguous    = errors.New("tensor is not contiguous")
+	ErrInvalidGraph     = errors.New("graph is broken")
+)
+
+// errBackward is recorded on nodes built for sources with gradients, the backward pass isn't implemented
+var errBackward = fmt.Errorf("backward pass: %w", ErrUnsupportedOp)
+
+var opNames = [OP_COUNT + 1]string{
+	"NONE", "DUP", "ADD", "SUB", "MUL", "DIV", "SQR", "SQRT", "SUM", "MEAN",
+	"REPEAT", "ABS", "SGN", "NEG", "STEP", "RELU", "GELU", "SILU", "NORM", "RMS_NORM",
+	"MUL_MAT",
+	"SCALE", "CPY", "RESHAPE", "VIEW", "PERMUTE", "TRANSPOSE", "GET_ROWS", "DIAG_MASK_INF", "SOFT_MAX", "ROPE",
+	"CONV_1D_1S", "CONV_1D_2S",
+	"FLASH_ATTN", "FLASH_FF",
+	"TOP_K", "GATHER", "MUL_MAT_ID",
+	"COUNT",
+}
+
+// OpError describes the graph node which failed to compute
+type OpError struct {
+	Op   string    // operation name like MUL_MAT
+	Node uint32    // node index within the graph
+	NE   [4]uint32 // shape of the node tensor
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("compute %s at node #%d %v: %v", e.Op, e.Node, e.NE, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
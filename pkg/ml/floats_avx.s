@@ -275,7 +275,7 @@ LBB1_18:
 	WORD $0xf8c5; BYTE $0x77 // vzeroupper
 	BYTE $0xc3               // retq
 
-TEXT ·_mm256_mul_const(SB), $0-32
+TEXT ·_mm256_mul_const(SB), $0-24
 	MOVQ a+0(FP), DI
 	MOVQ b+8(FP), SI
 	MOVQ n+16(FP), DX
@@ -555,10 +555,10 @@ LBB3_18:
 
 // TEXT ·_mm256_dot(SB), $0-32
 TEXT ·vdot(SB), $0-32
-	MOVQ a+0(FP), DI
-	MOVQ b+8(FP), SI
-	MOVQ n+16(FP), DX
-	MOVQ ret+24(FP), CX
+	MOVQ src0+0(FP), DI
+	MOVQ src1+8(FP), SI
+	MOVQ ne+16(FP), DX
+	MOVQ dst+24(FP), CX
 	BYTE $0x55                             // pushq	%rbp
 	WORD $0x8948; BYTE $0xe5               // movq	%rsp, %rbp
 	WORD $0x5641                           // pushq	%r14
@@ -708,3 +708,62 @@ LBB4_15:
 	BYTE $0x5d               // popq	%rbp
 	WORD $0xf8c5; BYTE $0x77 // vzeroupper
 	BYTE $0xc3               // retq
+
+// TEXT ·_mm256_dot_q8(SB), $0-32
+TEXT ·vdot_q8(SB), $0-32
+	MOVQ src0+0(FP), DI
+	MOVQ src1+8(FP), SI
+	MOVQ ne+16(FP), DX
+	MOVQ dst+24(FP), CX
+	WORD $0x8948; BYTE $0xf0 // movq	%rsi, %rax
+	WORD $0x8948; BYTE $0xd6 // movq	%rdx, %rsi
+	LONG $0x1f528d48         // leaq	31(%rdx), %rdx
+	WORD $0x8548; BYTE $0xf6 // testq	%rsi, %rsi
+	LONG $0xd6490f48         // cmovnsq	%rsi, %rdx
+	LONG $0x05fac148         // sarq	$5, %rdx
+	WORD $0xd285             // testl	%edx, %edx
+	JLE  LBB5_3
+	WORD $0xea83; BYTE $0x01 // subl	$1, %edx
+	LONG $0xe457d8c5         // vxorps	%xmm4, %xmm4, %xmm4
+	LONG $0x01c28348         // addq	$1, %rdx
+	LONG $0x07e2c148         // shlq	$7, %rdx
+	WORD $0x0148; BYTE $0xc2 // addq	%rax, %rdx
+
+LBB5_1:
+	LONG $0x217de2c4; WORD $0x0447 // vpmovsxbd	4(%rdi), %ymm0
+	LONG $0x217de2c4; WORD $0x0c5f // vpmovsxbd	12(%rdi), %ymm3
+	LONG $0x80e88348               // subq	$-128, %rax
+	LONG $0x24c78348               // addq	$36, %rdi
+	LONG $0x217de2c4; WORD $0xf057 // vpmovsxbd	-16(%rdi), %ymm2
+	LONG $0x217de2c4; WORD $0xf84f // vpmovsxbd	-8(%rdi), %ymm1
+	LONG $0xc05bfcc5               // vcvtdq2ps	%ymm0, %ymm0
+	LONG $0xdb5bfcc5               // vcvtdq2ps	%ymm3, %ymm3
+	LONG $0x4059fcc5; BYTE $0x80   // vmulps	-128(%rax), %ymm0, %ymm0
+	LONG $0x187de2c4; WORD $0xdc6f // vbroadcastss	-36(%rdi), %ymm5
+	LONG $0x5859e4c5; BYTE $0xa0   // vmulps	-96(%rax), %ymm3, %ymm3
+	LONG $0xd25bfcc5               // vcvtdq2ps	%ymm2, %ymm2
+	LONG $0xc95bfcc5               // vcvtdq2ps	%ymm1, %ymm1
+	LONG $0x5059ecc5; BYTE $0xc0   // vmulps	-64(%rax), %ymm2, %ymm2
+	LONG $0x4859f4c5; BYTE $0xe0   // vmulps	-32(%rax), %ymm1, %ymm1
+	LONG $0xc358fcc5               // vaddps	%ymm3, %ymm0, %ymm0
+	LONG $0xc258fcc5               // vaddps	%ymm2, %ymm0, %ymm0
+	LONG $0xc158fcc5               // vaddps	%ymm1, %ymm0, %ymm0
+	LONG $0xc559fcc5               // vmulps	%ymm5, %ymm0, %ymm0
+	LONG $0xe058dcc5               // vaddps	%ymm0, %ymm4, %ymm4
+	WORD $0x3948; BYTE $0xd0       // cmpq	%rdx, %rax
+	JNE  LBB5_1
+
+LBB5_2:
+	LONG $0x197de3c4; WORD $0x01e0 // vextractf128	$1, %ymm4, %xmm0
+	LONG $0xe058d8c5               // vaddps	%xmm0, %xmm4, %xmm4
+	LONG $0xc412d8c5               // vmovhlps	%xmm4, %xmm4, %xmm0
+	LONG $0xc458f8c5               // vaddps	%xmm4, %xmm0, %xmm0
+	LONG $0x0479e3c4; WORD $0x01c8 // vpermilps	$1, %xmm0, %xmm1
+	LONG $0xc158fac5               // vaddss	%xmm1, %xmm0, %xmm0
+	LONG $0x0111fac5               // vmovss	%xmm0, (%rcx)
+	WORD $0xf8c5; BYTE $0x77       // vzeroupper
+	BYTE $0xc3                     // retq
+
+LBB5_3:
+	LONG $0xe457d8c5 // vxorps	%xmm4, %xmm4, %xmm4
+	JMP  LBB5_2
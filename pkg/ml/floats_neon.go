@@ -23,3 +23,6 @@ func vmul_to(a, b, c, n unsafe.Pointer)
 
 //go:noescape
 func vdot(src0, src1 unsafe.Pointer, ne uint64, dst unsafe.Pointer)
+
+//go:noescape
+func vdot_q8(src0, src1 unsafe.Pointer, ne uint64, dst unsafe.Pointer)
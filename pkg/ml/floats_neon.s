@@ -190,7 +190,7 @@ LBB1_12:
 	WORD $0xa8c17bfd // ldp	x29, x30, [sp],
 	WORD $0xd65f03c0 // ret
 
-TEXT ·vmul_const(SB), $0-32
+TEXT ·vmul_const(SB), $0-24
 	MOVD a+0(FP), R0
 	MOVD b+8(FP), R1
 	MOVD n+16(FP), R2
@@ -362,10 +362,10 @@ LBB3_12:
 	WORD $0xd65f03c0 // ret
 
 TEXT ·vdot(SB), $0-32
-	MOVD a+0(FP), R0
-	MOVD b+8(FP), R1
-	MOVD n+16(FP), R2
-	MOVD ret+24(FP), R3
+	MOVD src0+0(FP), R0
+	MOVD src1+8(FP), R1
+	MOVD ne+16(FP), R2
+	MOVD dst+24(FP), R3
 	WORD $0xa9bf7bfd    // stp	x29, x30, [sp,
 	WORD $0x91000c48    // add	x8, x2,
 	WORD $0xf100005f    // cmp	x2,
@@ -427,3 +427,57 @@ LBB4_9:
 	WORD $0xa8c17bfd // ldp	x29, x30, [sp],
 	//WORD $0xd65f03c0 // ret
 	RET
+
+TEXT ·vdot_q8(SB), $0-32
+	MOVD src0+0(FP), R0
+	MOVD src1+8(FP), R1
+	MOVD ne+16(FP), R2
+	MOVD dst+24(FP), R3
+	WORD $0x9345fc48 // asr	x8, x2,
+	WORD $0x6f00e400 // movi	v0.2d,
+	WORD $0xf100051f // cmp	x8,
+	WORD $0x5400048b // b.lt	.LBB5_2
+
+LBB5_1:
+	WORD $0xbc404410 // ldr	s16, [x0],
+	WORD $0xacc10c02 // ldp	q2, q3, [x0],
+	WORD $0x4cdf2824 // ld1	{v4.4s, v5.4s, v6.4s, v7.4s}, [x1],
+	WORD $0x4cdf2832 // ld1	{v18.4s, v19.4s, v20.4s, v21.4s}, [x1],
+	WORD $0x0f08a456 // sxtl	v22.8h, v2.8b
+	WORD $0x4f08a457 // sxtl2	v23.8h, v2.16b
+	WORD $0x0f08a478 // sxtl	v24.8h, v3.8b
+	WORD $0x4f08a479 // sxtl2	v25.8h, v3.16b
+	WORD $0x0f10a6da // sxtl	v26.4s, v22.4h
+	WORD $0x4f10a6db // sxtl2	v27.4s, v22.8h
+	WORD $0x0f10a6fc // sxtl	v28.4s, v23.4h
+	WORD $0x4f10a6fd // sxtl2	v29.4s, v23.8h
+	WORD $0x0f10a71e // sxtl	v30.4s, v24.4h
+	WORD $0x4f10a71f // sxtl2	v31.4s, v24.8h
+	WORD $0x0f10a736 // sxtl	v22.4s, v25.4h
+	WORD $0x4f10a737 // sxtl2	v23.4s, v25.8h
+	WORD $0x4e21db5a // scvtf	v26.4s, v26.4s
+	WORD $0x4e21db7b // scvtf	v27.4s, v27.4s
+	WORD $0x4e21db9c // scvtf	v28.4s, v28.4s
+	WORD $0x4e21dbbd // scvtf	v29.4s, v29.4s
+	WORD $0x4e21dbde // scvtf	v30.4s, v30.4s
+	WORD $0x4e21dbff // scvtf	v31.4s, v31.4s
+	WORD $0x4e21dad6 // scvtf	v22.4s, v22.4s
+	WORD $0x4e21daf7 // scvtf	v23.4s, v23.4s
+	WORD $0x6e24df58 // fmul	v24.4s, v26.4s, v4.4s
+	WORD $0x4e25cf78 // fmla	v24.4s, v27.4s, v5.4s
+	WORD $0x4e26cf98 // fmla	v24.4s, v28.4s, v6.4s
+	WORD $0x4e27cfb8 // fmla	v24.4s, v29.4s, v7.4s
+	WORD $0x4e32cfd8 // fmla	v24.4s, v30.4s, v18.4s
+	WORD $0x4e33cff8 // fmla	v24.4s, v31.4s, v19.4s
+	WORD $0x4e34ced8 // fmla	v24.4s, v22.4s, v20.4s
+	WORD $0x4e35cef8 // fmla	v24.4s, v23.4s, v21.4s
+	WORD $0xf1000508 // subs	x8, x8,
+	WORD $0x4f901300 // fmla	v0.4s, v24.4s, v16.s[0]
+	WORD $0x54fffbc1 // b.ne	.LBB5_1
+
+LBB5_2:
+	WORD $0x6e20d400 // faddp	v0.4s, v0.4s, v0.4s
+	WORD $0x7e30d800 // faddp	s0, v0.2s
+	WORD $0xbd000060 // str	s0, [x3]
+	//WORD $0xd65f03c0 // ret
+	RET
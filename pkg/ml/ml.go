@@ -1,11 +1,13 @@
 package ml
 
 import (
+	"container/heap"
 	"fmt"
 	"math"
-	"os"
-	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unsafe"
@@ -23,8 +25,12 @@ const (
 
 	QK = 32 // quantization
 
+	// ids of LLaMA special tokens, vocabs use them unless model metadata says otherwise
+	TOKEN_UNK = 0
 	TOKEN_BOS = 1
 	TOKEN_EOS = 2
+
+	TOKEN_NONE = math.MaxUint32 // the vocab has no such special token
 )
 
 // computation graph
@@ -54,6 +60,10 @@ type Context struct {
 	//Graph      *Graph
 	Compute   chan *ComputeParams
 	Allocator *Allocator
+
+	// tasks of Job threads are reused by every ComputeJobs call, graph nodes are computed one by one
+	tasks []ComputeParams
+	wg    sync.WaitGroup
 }
 
 func NewContext(maxThreads int, useAVX, useNEON bool) *Context {
@@ -90,7 +100,8 @@ const (
 	TYPE_I8    DType = 4
 	TYPE_I16   DType = 5
 	TYPE_I32   DType = 6
-	TYPE_COUNT DType = 8
+	TYPE_Q8_0  DType = 8
+	TYPE_COUNT DType = 9
 )
 
 func printTensor(tensor *Tensor, name string) {
@@ -103,11 +114,17 @@ func printTensor(tensor *Tensor, name string) {
 		dt = "FP32"
 	case TYPE_Q4_0:
 		dt = "INT4"
+	case TYPE_Q8_0:
+		dt = "INT8"
 	}
 
 	fmt.Printf("\n\n=== [ %s | %s | %d:%d:%d ] ===\n",
 		name, dt, tensor.NE[0], tensor.NE[1], tensor.NE[2])
 
+	if tensor.Data == nil {
+		return
+	}
+
 	for nn := 0; nn < min(12, int(tensor.NE[1])); nn++ {
 		fmt.Printf("\n %d x %d ...\t", nn, tensor.NE[0])
 		for ii := 0; ii < min(12, int(tensor.NE[0])); ii++ {
@@ -120,8 +137,8 @@ func printTensor(tensor *Tensor, name string) {
 // static ggml_fp16_t table_exp_f16[1 << 16];
 var TableExpFP16 [1 << 16]float16.Float16
 
-var BLCK_SIZE [TYPE_COUNT]uint32 = [TYPE_COUNT]uint32{1, 1, QK, QK, 1, 1, 1, 0}
-var TYPE_SIZE [TYPE_COUNT]uint32 = [TYPE_COUNT]uint32{4, 2, 4 + QK/2, 4*2 + QK/2, 1, 2, 4, 0}
+var BLCK_SIZE [TYPE_COUNT]uint32 = [TYPE_COUNT]uint32{1, 1, QK, QK, 1, 1, 1, 0, QK}
+var TYPE_SIZE [TYPE_COUNT]uint32 = [TYPE_COUNT]uint32{4, 2, 4 + QK/2, 4*2 + QK/2, 1, 2, 4, 0, 4 + QK}
 
 func TypeSizeFloat(dt DType) float32 {
 	return float32(TYPE_SIZE[dt]) / float32(BLCK_SIZE[dt])
@@ -170,6 +187,10 @@ const (
 	OP_FLASH_ATTN
 	OP_FLASH_FF
 
+	OP_TOP_K
+	OP_GATHER
+	OP_MUL_MAT_ID
+
 	OP_COUNT
 )
 
@@ -180,7 +201,7 @@ const (
 type Tensor struct {
 	Type DType
 
-	Reusable bool // this tensor Data buffer might be reused with pooling
+	Reusable bool // this tensor Data buffer lives within the arena of Allocator and is shared with other tensors
 
 	Dims uint32
 
@@ -197,9 +218,22 @@ type Tensor struct {
 
 	opt [MAX_OPT]*Tensor // FIXME: Do we need this?
 
+	srcs []*Tensor // any number of extra sources like weights of experts for MulMatID
+
+	scratch []*Tensor // temporary tensors of the op, they take the memory only while the node is computed
+
+	err error // the op can't be built for its sources, GraphCompute returns it instead of computing the graph
+
+	view     *Tensor // the tensor whose Data this one shares, nil when the tensor owns its buffer
+	viewOffs uint32  // offset of Data within the one of view, in floats
+
 	TasksCount int
 
 	Data []float32
+
+	// Blocks keeps data of quantized tensors (Q4_0, Q4_1, Q8_0) which can't be stored as []float32
+	// See quants.go for the layout of blocks
+	Blocks []byte
 }
 
 // ggml_is_contiguous
@@ -229,7 +263,13 @@ func (t *Tensor) Nbytes() uint32 {
 
 // ggml_view_tensor
 func ViewTensor(ctx *Context, src *Tensor) *Tensor {
-	return NewTensor(ctx, src.Type, src.Dims, src.NE[0], src.NE[1], src.NE[2], src.NE[3], src.Data)
+	result := newNode(ctx, src.Type, src.Dims, src.NE[0], src.NE[1], src.NE[2], src.NE[3])
+	result.Data = src.Data
+	if src.Blocks != nil {
+		result.Blocks = src.Blocks
+	}
+	result.view = src
+	return result
 }
 
 // ggml_dup_tensor
@@ -237,6 +277,20 @@ func DupTensor(ctx *Context, src *Tensor) *Tensor {
 	return NewTensor(ctx, src.Type, src.Dims, src.NE[0], src.NE[1], src.NE[2], src.NE[3], nil) // Reusbale OK
 }
 
+// dupNode is DupTensor for results of operations, their memory is given later by newNode rules
+func dupNode(ctx *Context, src *Tensor) *Tensor {
+	return newNode(ctx, src.Type, src.Dims, src.NE[0], src.NE[1], src.NE[2], src.NE[3])
+}
+
+// viewData returns Data of the tensor from the offset in floats,
+// it's nil until the tensor gets its memory and the view is bound to it then
+func viewData(a *Tensor, offset uint32) []float32 {
+	if a.Data == nil {
+		return nil
+	}
+	return a.Data[offset:]
+}
+
 // struct ggml_tensor * Mul(
 func Mul(ctx *Context, a, b *Tensor) *Tensor {
 	return MulImpl(ctx, a, b, false)
@@ -251,9 +305,9 @@ func MulInplace(ctx *Context, a, b *Tensor) *Tensor {
 func MulImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 	////ASSERT(ggml_are_same_shape(a, b));
 
+	var err error
 	if !AreSameShape(a, b) {
-		fmt.Printf("\n[STOP] MulImpl - tensors of different shapes!")
-		os.Exit(1)
+		err = fmt.Errorf("[a] %v and [b] %v: %w", a.NE, b.NE, ErrShapeMismatch)
 	}
 
 	isNode := false
@@ -270,10 +324,11 @@ func MulImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 	if inplace {
 		result = ViewTensor(ctx, a)
 	} else {
-		result = DupTensor(ctx, a)
+		result = dupNode(ctx, a)
 	}
 
 	result.op = OP_MUL
+	result.err = err
 	result.src0 = a
 	result.src1 = b
 
@@ -287,8 +342,10 @@ func MulImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 }
 
 // ggml_can_mul_mat
+// CanMulMat checks [t0] matrices could be multiplied with [t1] ones
+// Each of [t0] matrices might be shared between the group of [t1] matrices, like KV heads with grouped-query attention
 func CanMulMat(t0, t1 *Tensor) bool {
-	return (t0.NE[0] == t1.NE[0]) && (t0.NE[2] == t1.NE[2]) && (t0.NE[3] == t1.NE[3])
+	return (t0.NE[0] == t1.NE[0]) && (t1.NE[2]%t0.NE[2] == 0) && (t1.NE[3]%t0.NE[3] == 0)
 }
 
 // ggml_mul_mat
@@ -302,7 +359,7 @@ func MulMat(ctx *Context, a, b *Tensor) *Tensor {
 		isNode = true
 	}
 
-	result := NewTensor(ctx, TYPE_F32, min32(a.Dims, b.Dims), a.NE[1], b.NE[1], a.NE[2], b.NE[3], nil) // Reusable OK
+	result := newNode(ctx, TYPE_F32, min32(a.Dims, b.Dims), a.NE[1], b.NE[1], b.NE[2], b.NE[3])
 
 	result.op = OP_MUL_MAT
 	result.src0 = a
@@ -332,7 +389,7 @@ func AddImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 	if inplace {
 		result = ViewTensor(ctx, a)
 	} else {
-		result = DupTensor(ctx, a)
+		result = dupNode(ctx, a)
 	}
 
 	result.op = OP_ADD
@@ -360,7 +417,7 @@ func Sum(ctx *Context, a *Tensor) *Tensor {
 		isNode = true
 	}
 
-	result := NewTensor1D(ctx, a.Type, 1) // Reusable OK
+	result := newNode(ctx, a.Type, 1, 1, 1, 1, 1)
 
 	result.op = OP_SUM
 	result.src0 = a
@@ -389,7 +446,7 @@ func SubImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 	if inplace {
 		result = ViewTensor(ctx, a)
 	} else {
-		result = DupTensor(ctx, a)
+		result = dupNode(ctx, a)
 	}
 
 	result.op = OP_SUB
@@ -427,7 +484,7 @@ func DivImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 	if inplace {
 		result = ViewTensor(ctx, a)
 	} else {
-		result = DupTensor(ctx, a)
+		result = dupNode(ctx, a)
 	}
 
 	result.op = OP_DIV
@@ -459,7 +516,7 @@ func SgnImpl(ctx *Context, a *Tensor, inplace bool) *Tensor {
 	if inplace {
 		result = ViewTensor(ctx, a)
 	} else {
-		result = DupTensor(ctx, a)
+		result = dupNode(ctx, a)
 	}
 
 	result.op = OP_SGN
@@ -497,7 +554,7 @@ func Repeat(ctx *Context, a, b *Tensor) *Tensor {
 		return a
 	}
 
-	result := NewTensor(ctx, a.Type, b.Dims, b.NE[0], b.NE[1], b.NE[2], b.NE[3], nil) // Reusable OK
+	result := newNode(ctx, a.Type, b.Dims, b.NE[0], b.NE[1], b.NE[2], b.NE[3])
 
 	result.op = OP_REPEAT
 	result.src0 = a
@@ -534,16 +591,17 @@ func GetRows(ctx *Context, a, b *Tensor) *Tensor {
 
 	isNode := false
 
+	var err error
 	if a.grad != nil || b.grad != nil {
 		////ASSERT(false); // TODO: implement backward
 		isNode = true
-		fmt.Printf("\n[STOP] ml.GetRows")
-		os.Exit(1)
+		err = errBackward
 	}
 
-	result := NewTensor2D(ctx, TYPE_F32, a.NE[0], b.NE[0]) // Reusable OK
+	result := newNode(ctx, TYPE_F32, 2, a.NE[0], b.NE[0], 1, 1)
 
 	result.op = OP_GET_ROWS
+	result.err = err
 	if isNode {
 		result.grad = DupTensor(ctx, result)
 	} else {
@@ -556,6 +614,33 @@ func GetRows(ctx *Context, a, b *Tensor) *Tensor {
 	return result
 }
 
+// Norm is the layer normalization without learned parameters, eps is fixed to 1e-5 as in RMSNorm
+func Norm(ctx *Context, a *Tensor) *Tensor {
+	return NormImpl(ctx, a, false)
+}
+
+func NormInplace(ctx *Context, a *Tensor) *Tensor {
+	return NormImpl(ctx, a, true)
+}
+
+// ggml_norm_impl
+func NormImpl(ctx *Context, a *Tensor, inplace bool) *Tensor {
+
+	var result *Tensor
+	if inplace {
+		result = ViewTensor(ctx, a)
+	} else {
+		result = dupNode(ctx, a)
+	}
+
+	result.op = OP_NORM
+	result.grad = nil
+	result.src0 = a
+	result.src1 = nil
+
+	return result
+}
+
 func RMSNorm(ctx *Context, a *Tensor) *Tensor {
 	return RMSNormImpl(ctx, a, false)
 }
@@ -568,11 +653,11 @@ func RMSNormInplace(ctx *Context, a *Tensor) *Tensor {
 func RMSNormImpl(ctx *Context, a *Tensor, inplace bool) *Tensor {
 	isNode := false
 
+	var err error
 	if !inplace && a.grad != nil {
 		////ASSERT(false); // TODO: implement backward
 		isNode = true
-		fmt.Printf("\n[STOP] ml.GetRows")
-		os.Exit(1)
+		err = errBackward
 	}
 
 	////struct ggml_tensor * result = inplace ? ggml_view_tensor(ctx, a) : ggml_dup_tensor(ctx, a);
@@ -580,10 +665,11 @@ func RMSNormImpl(ctx *Context, a *Tensor, inplace bool) *Tensor {
 	if inplace {
 		result = ViewTensor(ctx, a)
 	} else {
-		result = DupTensor(ctx, a)
+		result = dupNode(ctx, a)
 	}
 
 	result.op = OP_RMS_NORM
+	result.err = err
 	result.src0 = a
 	result.src1 = nil // TODO: maybe store epsilon here?
 
@@ -605,13 +691,57 @@ func View1D(ctx *Context, a *Tensor, ne0 uint32, offset uint32) *Tensor {
 	////	os.Exit(1)
 	////}
 
-	slice := a.Data[offset:]
-	result := NewTensor(ctx, a.Type, 1, ne0, 1, 1, 1, slice)
+	result := newNode(ctx, a.Type, 1, ne0, 1, 1, 1)
+	result.Data = viewData(a, offset)
+
+	result.op = OP_VIEW
+	result.grad = nil
+	result.src0 = a
+	result.src1 = nil
+	result.view = a
+	result.viewOffs = offset
+
+	return result
+}
+
+// ggml_view_2d
+// NB! Offset is in floats as with View1D, but the row stride nb1 is in bytes like all other strides
+func View2D(ctx *Context, a *Tensor, ne0, ne1, nb1, offset uint32) *Tensor {
+
+	result := newNode(ctx, a.Type, 2, ne0, ne1, 1, 1)
+	result.Data = viewData(a, offset)
+
+	result.NB[1] = nb1
+	result.NB[2] = nb1 * ne1
+	result.NB[3] = result.NB[2]
+
+	result.op = OP_VIEW
+	result.grad = nil
+	result.src0 = a
+	result.src1 = nil
+	result.view = a
+	result.viewOffs = offset
+
+	return result
+}
+
+// ggml_view_3d
+// NB! Offset is in floats as with View1D, but strides nb1 and nb2 are in bytes like all other strides
+func View3D(ctx *Context, a *Tensor, ne0, ne1, ne2, nb1, nb2, offset uint32) *Tensor {
+
+	result := newNode(ctx, a.Type, 3, ne0, ne1, ne2, 1)
+	result.Data = viewData(a, offset)
+
+	result.NB[1] = nb1
+	result.NB[2] = nb2
+	result.NB[3] = nb2 * ne2
 
 	result.op = OP_VIEW
 	result.grad = nil
 	result.src0 = a
-	result.src1 = nil // TODO: maybe store the offset here?
+	result.src1 = nil
+	result.view = a
+	result.viewOffs = offset
 
 	return result
 }
@@ -632,8 +762,7 @@ func BuildForwardImpl(graph *Graph, tensor *Tensor, expand bool) {
 		// the last added node should always be starting point
 		////ASSERT(cgraph.nodes[cgraph.n_nodes - 1] == tensor);
 		if !(graph.Nodes[graph.NodesCount-1] == tensor) {
-			fmt.Printf("\n[STOP] BuildForwardImpl : the last added node should always be starting point!")
-			os.Exit(1)
+			tensor.err = fmt.Errorf("the last added node should always be starting point: %w", ErrInvalidGraph)
 		}
 	}
 }
@@ -681,6 +810,10 @@ func VisitParents(graph *Graph, node *Tensor) {
 		}
 	}
 
+	for _, src := range node.srcs {
+		VisitParents(graph, src)
+	}
+
 	if node.op == OP_NONE && node.grad == nil {
 		// reached a leaf node, not part of the gradient graph (e.g. a constant)
 		////ASSERT(cgraph.n_leafs < MAX_NODES);
@@ -707,17 +840,18 @@ func CopyImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 
 	isNode := false
 
+	var err error
 	if !inplace && (a.grad != nil || b.grad != nil) {
 		////ASSERT(false); // TODO: implement backward
 		isNode = true
-		fmt.Printf("\n[STOP] cpyImpl")
-		os.Exit(1)
+		err = errBackward
 	}
 
 	// make a view of the destination
 	result := ViewTensor(ctx, b)
 
 	result.op = OP_CPY
+	result.err = err
 	result.src0 = a
 	result.src1 = b
 
@@ -767,6 +901,10 @@ func NewTensor(ctx *Context, dt DType, dims uint32, ne0, ne1, ne2, ne3 uint32, d
 
 	////ggml_assert_aligned(result);
 
+	if IsQuantized(dt) {
+		return NewQuantizedTensor(ctx, dt, dims, ne0, ne1, ne2, ne3, nil)
+	}
+
 	if data == nil {
 		total := ne0 * ne1 * ne2 * ne3
 		data = make([]float32, total, total)
@@ -782,6 +920,44 @@ func NewTensor(ctx *Context, dt DType, dims uint32, ne0, ne1, ne2, ne3 uint32, d
 	}
 }
 
+// newNode creates the result tensor of the operation without memory, so building graphs allocates nothing
+// Plan of Allocator places it into the arena, or GraphCompute allocates it before the first compute
+func newNode(ctx *Context, dt DType, dims uint32, ne0, ne1, ne2, ne3 uint32) *Tensor {
+
+	if IsQuantized(dt) {
+		return NewQuantizedTensor(ctx, dt, dims, ne0, ne1, ne2, ne3, nil)
+	}
+
+	return &Tensor{
+		Type: dt,
+		Dims: dims,
+		NE:   [4]uint32{ne0, ne1, ne2, ne3},
+		NB:   [4]uint32{4, ne0 * 4, ne0 * ne1 * 4, ne0 * ne1 * ne2 * 4},
+		op:   OP_NONE,
+	}
+}
+
+// NewQuantizedTensor creates the tensor of quantized type over given blocks, or allocates them when blocks is nil
+// Quantized data is stored as blocks of bytes, strides are in bytes too
+func NewQuantizedTensor(ctx *Context, dt DType, dims uint32, ne0, ne1, ne2, ne3 uint32, blocks []byte) *Tensor {
+
+	nb0 := TYPE_SIZE[dt]
+	nb1 := nb0 * (ne0 / BLCK_SIZE[dt])
+
+	if blocks == nil {
+		blocks = make([]byte, nb1*ne1*ne2*ne3)
+	}
+
+	return &Tensor{
+		Type:   dt,
+		Dims:   dims,
+		NE:     [4]uint32{ne0, ne1, ne2, ne3},
+		NB:     [4]uint32{nb0, nb1, nb1 * ne1, nb1 * ne1 * ne2},
+		op:     OP_NONE,
+		Blocks: blocks,
+	}
+}
+
 // ggml_permute
 func Permute(ctx *Context, a *Tensor, axis0, axis1, axis2, axis3 uint32) *Tensor {
 
@@ -799,11 +975,11 @@ func Permute(ctx *Context, a *Tensor, axis0, axis1, axis2, axis3 uint32) *Tensor
 
 	isNode := false
 
+	var err error
 	if a.grad != nil {
 		////ASSERT(false); // TODO: implement backward
 		isNode = true
-		fmt.Printf("\n[STOP] Permute error")
-		os.Exit(1)
+		err = errBackward
 	}
 
 	result := ViewTensor(ctx, a)
@@ -832,6 +1008,7 @@ func Permute(ctx *Context, a *Tensor, axis0, axis1, axis2, axis3 uint32) *Tensor
 	result.NB[3] = nb[3]
 
 	result.op = OP_PERMUTE
+	result.err = err
 	result.src0 = a
 	result.src1 = nil // TODO: maybe store the permutation here?
 
@@ -844,29 +1021,95 @@ func Permute(ctx *Context, a *Tensor, axis0, axis1, axis2, axis3 uint32) *Tensor
 	return result
 }
 
+// RopeScaling selects how positions are scaled to extend the context beyond the trained one
+type RopeScaling uint8
+
+const (
+	ROPE_SCALING_NONE   RopeScaling = iota
+	ROPE_SCALING_LINEAR             // linear position interpolation
+	ROPE_SCALING_NTK                // NTK-aware scaling of the base frequency
+	ROPE_SCALING_YARN               // YaRN mix of interpolation and extrapolation
+)
+
+func (scaling RopeScaling) String() string {
+	switch scaling {
+	case ROPE_SCALING_LINEAR:
+		return "linear"
+	case ROPE_SCALING_NTK:
+		return "ntk"
+	case ROPE_SCALING_YARN:
+		return "yarn"
+	}
+	return "none"
+}
+
+// RopeParams are the settings of rotary position embeddings
+type RopeParams struct {
+	FreqBase  float32 // base frequency [ 10000.0 for LLaMA ]
+	FreqScale float32 // the context is extended 1 / FreqScale times, ignored with ROPE_SCALING_NONE
+	Scaling   RopeScaling
+	CtxOrig   uint32 // context size the model was trained with, used by YaRN
+
+	// YaRN settings, zero values select the defaults of the paper
+	ExtFactor  float32 // how much of extrapolation to mix in [ 1.0 ]
+	AttnFactor float32 // extra scale of attention magnitude [ 1.0 ]
+	BetaFast   float32 // rotations count where interpolation ends [ 32.0 ]
+	BetaSlow   float32 // rotations count where extrapolation ends [ 1.0 ]
+}
+
+// DefaultRope are the settings LLaMA was trained with
+var DefaultRope = RopeParams{
+	FreqBase:  10000.0,
+	FreqScale: 1.0,
+}
+
+// RoPE modes, they might be combined
+const (
+	ROPE_MODE_NORMAL = 0 // rotates pairs of adjacent values
+	ROPE_MODE_PAST   = 1 // the tensor holds past tokens too and only the new ones are rotated
+	ROPE_MODE_NEOX   = 2 // rotates pairs of values dims/2 apart like GPT-NeoX does
+)
+
+// rope settings are passed to compute within the [src1] tensor
+const ropeParamsCount = 11
+
 // ggml_rope
 func Rope(ctx *Context, a *Tensor, past, dims, mode uint32) *Tensor {
+	return RopeCustom(ctx, a, past, dims, mode, DefaultRope)
+}
+
+// ggml_rope_custom
+func RopeCustom(ctx *Context, a *Tensor, past, dims, mode uint32, rope RopeParams) *Tensor {
 	////ASSERT(n_past >= 0);
 
 	isNode := false
 
+	var err error
 	if a.grad != nil {
 		////ASSERT(false); // TODO: implement backward
 		isNode = true
-		fmt.Printf("\n[STOP] Rope error")
-		os.Exit(1)
+		err = errBackward
 	}
 
 	// TODO: when implement backward, fix this:
 	//struct ggml_tensor * result = inplace ? ggml_view_tensor(ctx, a) : ggml_dup_tensor(ctx, a);
 	result := ViewTensor(ctx, a)
 
-	b := NewTensor1D(ctx, TYPE_I32, 3)
+	b := NewTensor1D(ctx, TYPE_I32, ropeParamsCount)
 	b.Data[0] = float32(past)
 	b.Data[1] = float32(dims)
 	b.Data[2] = float32(mode)
+	b.Data[3] = rope.FreqBase
+	b.Data[4] = rope.FreqScale
+	b.Data[5] = float32(rope.Scaling)
+	b.Data[6] = float32(rope.CtxOrig)
+	b.Data[7] = rope.ExtFactor
+	b.Data[8] = rope.AttnFactor
+	b.Data[9] = rope.BetaFast
+	b.Data[10] = rope.BetaSlow
 
 	result.op = OP_ROPE
+	result.err = err
 	result.src0 = a
 	result.src1 = b
 
@@ -879,6 +1122,21 @@ func Rope(ctx *Context, a *Tensor, past, dims, mode uint32) *Tensor {
 	return result
 }
 
+// ggml_reshape_2d
+func Reshape2D(ctx *Context, a *Tensor, ne0, ne1 uint32) *Tensor {
+
+	result := newNode(ctx, a.Type, 2, ne0, ne1, 1, 1)
+	result.Data = a.Data
+	result.view = a
+
+	result.op = OP_RESHAPE
+	result.grad = nil
+	result.src0 = a
+	result.src1 = nil
+
+	return result
+}
+
 func Reshape3D(ctx *Context, a *Tensor, ne0, ne1, ne2 uint32) *Tensor {
 	////ASSERT(ggml_is_contiguous(a));
 	////ASSERT(ggml_nelements(a) == ne0*ne1*ne2);
@@ -900,7 +1158,9 @@ func Reshape3D(ctx *Context, a *Tensor, ne0, ne1, ne2 uint32) *Tensor {
 	////    is_node = true;
 	////}
 
-	result := NewTensor(ctx, a.Type, 3, ne0, ne1, ne2, 1, a.Data) // Reusable OK
+	result := newNode(ctx, a.Type, 3, ne0, ne1, ne2, 1)
+	result.Data = a.Data
+	result.view = a
 
 	result.op = OP_RESHAPE
 	////result.grad = is_node ? ggml_dup_tensor(ctx, result) : NULL;
@@ -936,11 +1196,11 @@ func ScaleImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 
 	////bool is_node = false;
 
+	var err error
 	if !inplace && (a.grad != nil || b.grad != nil) {
 		////ASSERT(false); // TODO: implement backward
 		////is_node = true;
-		fmt.Printf("\n[STOP] ScaleImpl : assertion failed")
-		os.Exit(1)
+		err = errBackward
 	}
 
 	// TODO: when implement backward, fix this:
@@ -948,6 +1208,7 @@ func ScaleImpl(ctx *Context, a, b *Tensor, inplace bool) *Tensor {
 	result := ViewTensor(ctx, a)
 
 	result.op = OP_SCALE
+	result.err = err
 	////result.grad = is_node ? ggml_dup_tensor(ctx, result) : NULL;
 	result.grad = nil
 	result.src0 = a
@@ -968,11 +1229,11 @@ func ScaleInplace(ctx *Context, a, b *Tensor) *Tensor {
 func DiagMaskInf(ctx *Context, a *Tensor, past uint32) *Tensor {
 	////bool is_node = false;
 
+	var err error
 	if a.grad != nil {
 		////ASSERT(false); // TODO: implement backward
 		////is_node = true;
-		fmt.Printf("\n[STOP] DiagMaskInf : assertion failed")
-		os.Exit(1)
+		err = errBackward
 	}
 
 	// TODO: when implement backward, fix this:
@@ -981,6 +1242,7 @@ func DiagMaskInf(ctx *Context, a *Tensor, past uint32) *Tensor {
 	b := NewFP32(ctx, float32(past)) // FIXME NewI32(ctx, past)
 
 	result.op = OP_DIAG_MASK_INF
+	result.err = err
 	////result.grad = is_node ? ggml_dup_tensor(ctx, result) : NULL;
 	result.grad = nil
 	result.src0 = a
@@ -989,15 +1251,29 @@ func DiagMaskInf(ctx *Context, a *Tensor, past uint32) *Tensor {
 	return result
 }
 
+// SetPast changes the count of past tokens the ROPE, DIAG_MASK_INF or FLASH_ATTN node was built with,
+// so the same graph might be computed again for tokens at the next positions
+func SetPast(tensor *Tensor, past uint32) error {
+	switch tensor.op {
+	case OP_ROPE, OP_DIAG_MASK_INF:
+		tensor.src1.Data[0] = float32(past)
+		return nil
+	case OP_FLASH_ATTN:
+		tensor.opt[1].Data[0] = float32(past)
+		return nil
+	}
+	return ErrUnsupportedOp
+}
+
 // ggml_soft_max
 func SoftMax(ctx *Context, a *Tensor) *Tensor {
 	////bool is_node = false;
 
+	var err error
 	if a.grad != nil {
 		////ASSERT(false); // TODO: implement backward
 		////is_node = true;
-		fmt.Printf("\n[STOP] SoftMax : assertion failed")
-		os.Exit(1)
+		err = errBackward
 	}
 
 	// TODO: when implement backward, fix this:
@@ -1005,6 +1281,7 @@ func SoftMax(ctx *Context, a *Tensor) *Tensor {
 	result := ViewTensor(ctx, a)
 
 	result.op = OP_SOFT_MAX
+	result.err = err
 	////result.grad = is_node ? ggml_dup_tensor(ctx, result) : NULL;
 	result.grad = nil
 	result.src0 = a
@@ -1026,7 +1303,7 @@ func SiluImpl(ctx *Context, a *Tensor, inplace bool) *Tensor {
 	if inplace {
 		result = ViewTensor(ctx, a)
 	} else {
-		result = DupTensor(ctx, a)
+		result = dupNode(ctx, a)
 	}
 
 	result.op = OP_SILU
@@ -1046,6 +1323,115 @@ func SiluInplace(ctx *Context, a *Tensor) *Tensor {
 	return SiluImpl(ctx, a, true)
 }
 
+// ggml_gelu
+func GeluImpl(ctx *Context, a *Tensor, inplace bool) *Tensor {
+
+	var result *Tensor
+	if inplace {
+		result = ViewTensor(ctx, a)
+	} else {
+		result = dupNode(ctx, a)
+	}
+
+	result.op = OP_GELU
+	result.grad = nil
+	result.src0 = a
+	result.src1 = nil
+
+	return result
+}
+
+func Gelu(ctx *Context, a *Tensor) *Tensor {
+	return GeluImpl(ctx, a, false)
+}
+
+func GeluInplace(ctx *Context, a *Tensor) *Tensor {
+	return GeluImpl(ctx, a, true)
+}
+
+// unaryImpl creates the node of element-wise op over [a], the result is the new tensor or the view of [a] itself
+func unaryImpl(ctx *Context, a *Tensor, op optype, inplace bool) *Tensor {
+
+	var result *Tensor
+	if inplace {
+		result = ViewTensor(ctx, a)
+	} else {
+		result = dupNode(ctx, a)
+	}
+
+	result.op = op
+	result.grad = nil
+	result.src0 = a
+	result.src1 = nil
+
+	return result
+}
+
+// ggml_dup
+// Dup copies [a] into the new contiguous tensor, so permuted or transposed views become the usual ones
+func Dup(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_DUP, false)
+}
+
+// ggml_sqr
+func Sqr(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_SQR, false)
+}
+
+func SqrInplace(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_SQR, true)
+}
+
+// ggml_sqrt
+func Sqrt(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_SQRT, false)
+}
+
+func SqrtInplace(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_SQRT, true)
+}
+
+// ggml_abs
+func Abs(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_ABS, false)
+}
+
+func AbsInplace(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_ABS, true)
+}
+
+// ggml_neg
+func Neg(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_NEG, false)
+}
+
+func NegInplace(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_NEG, true)
+}
+
+// ggml_relu
+func Relu(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_RELU, false)
+}
+
+func ReluInplace(ctx *Context, a *Tensor) *Tensor {
+	return unaryImpl(ctx, a, OP_RELU, true)
+}
+
+// ggml_mean
+// Mean returns [1, ne1, ne2, ne3] tensor with the average of each row of [a]
+func Mean(ctx *Context, a *Tensor) *Tensor {
+
+	result := newNode(ctx, TYPE_F32, a.Dims, 1, a.NE[1], a.NE[2], a.NE[3])
+
+	result.op = OP_MEAN
+	result.grad = nil
+	result.src0 = a
+	result.src1 = nil
+
+	return result
+}
+
 // ggml_step
 func StepImpl(ctx *Context, a *Tensor, inplace bool) *Tensor {
 	isNode := false
@@ -1058,7 +1444,7 @@ func StepImpl(ctx *Context, a *Tensor, inplace bool) *Tensor {
 	if inplace {
 		result = ViewTensor(ctx, a)
 	} else {
-		result = DupTensor(ctx, a)
+		result = dupNode(ctx, a)
 	}
 
 	result.op = OP_STEP
@@ -1115,7 +1501,7 @@ func BuildForward(tensor *Tensor) *Graph {
 	return &result
 }
 
-func BuildBackward(ctx *Context, gf *Graph, keep bool) Graph {
+func BuildBackward(ctx *Context, gf *Graph, keep bool) (Graph, error) {
 
 	result := *gf
 	////ASSERT(gf.n_nodes > 0);
@@ -1137,7 +1523,9 @@ func BuildBackward(ctx *Context, gf *Graph, keep bool) Graph {
 
 		// because we detached the grad nodes from the original graph, we can afford inplace operations
 		if node.grad != nil {
-			ComputeBackward(ctx, node, keep)
+			if err := ComputeBackward(ctx, node, keep); err != nil {
+				return result, err
+			}
 		}
 	}
 
@@ -1150,12 +1538,13 @@ func BuildBackward(ctx *Context, gf *Graph, keep bool) Graph {
 		}
 	}
 
-	return result
+	return result, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func ComputeBackward(ctx *Context, tensor *Tensor, inplace bool) {
+// ComputeBackward adds gradient nodes for the sources of the tensor
+func ComputeBackward(ctx *Context, tensor *Tensor, inplace bool) error {
 
 	src0 := tensor.src0
 	src1 := tensor.src1
@@ -1293,8 +1682,7 @@ func ComputeBackward(ctx *Context, tensor *Tensor, inplace bool) {
 		if src0.grad != nil {
 			// TODO: this requires outer product - ggml_out_prod(ctx, src1, tensor.grad);
 			//// ASSERT(false);
-			fmt.Printf("\n[HALT] ComputeBackward : OP_MUL_MAT with src0.grad!")
-			os.Exit(1)
+			return fmt.Errorf("gradient of [src0] for %s: %w", opNames[tensor.op], errBackward)
 		}
 		if src1.grad != nil {
 			src1.grad =
@@ -1337,6 +1725,8 @@ func ComputeBackward(ctx *Context, tensor *Tensor, inplace bool) {
 	case OP_COUNT:
 		//// ASSERT(false);
 	}
+
+	return nil
 }
 
 // ---
@@ -1357,7 +1747,8 @@ type ComputeParams struct {
 
 	tensor *Tensor
 
-	wg *sync.WaitGroup
+	wg  *sync.WaitGroup
+	err error // the result of Job
 
 	UseAVX  bool
 	UseNEON bool
@@ -1383,32 +1774,84 @@ func max(a, b int) int { // FIXME Not needed ?
 }
 
 // Job is goroutine existing while the computation loop is active
-// The main purpose of the Job is to perform some part
-// of time consuming matrix multiplications
+// The main purpose of the Job is to perform some part of time consuming ops like matrix multiplications,
+// each Job computes rows of the tensor selected by ith and nth params, see ComputeJobs
 // TODO: Investigate https://pkg.go.dev/runtime#LockOSThread
 func Job(listen <-chan *ComputeParams, id int) {
 	runtime.LockOSThread()
 	for params := range listen {
-		ComputeForwardMulMatFP32(
-			params,
-			params.tensor.src0,
-			params.tensor.src1,
-			params.tensor)
+		params.err = ComputeForwardRows(params)
 		params.wg.Done()
 	}
 }
 
 // Do is an experimental alternative for always waiting Job threads
 func Do(params *ComputeParams, id int) {
-	ComputeForwardMulMatFP32(
-		params,
-		params.tensor.src0,
-		params.tensor.src1,
-		params.tensor)
+	params.err = ComputeForwardRows(params)
 	params.wg.Done()
 }
 
-func GraphCompute(ctx *Context, graph *Graph) {
+// ComputeForwardRows computes the part of the tensor rows given by ith and nth params, that's what Job threads run
+// Only ops which are split by rows are supported
+func ComputeForwardRows(params *ComputeParams) error {
+
+	tensor := params.tensor
+
+	switch tensor.op {
+	case OP_MUL_MAT:
+		return ComputeForwardMulMat(params, tensor.src0, tensor.src1, tensor)
+	case OP_ADD:
+		return ComputeForwardAddFP32(params, tensor.src0, tensor.src1, tensor)
+	case OP_MUL:
+		return ComputeForwardMulFP32(params, tensor.src0, tensor.src1, tensor)
+	case OP_SCALE:
+		return ComputeForwardScaleFP32(params, tensor.src0, tensor.src1, tensor)
+	case OP_SILU:
+		return ComputeForwardSiluFP32(params, tensor.src0, tensor)
+	case OP_GELU:
+		return ComputeForwardGeluFP32(params, tensor.src0, tensor)
+	case OP_NORM:
+		return ComputeForwardNormFP32(params, tensor.src0, tensor)
+	case OP_RMS_NORM:
+		ComputeForwardRMSNormFP32(params, tensor.src0, tensor)
+	case OP_SOFT_MAX:
+		return ComputeForwardSoftMaxFP32(params, tensor.src0, tensor)
+	case OP_ROPE:
+		return ComputeForwardRopeFP32(params, tensor.src0, tensor.src1, tensor)
+	case OP_CPY, OP_DUP:
+		return ComputeForwardDupFP32(params, tensor.src0, tensor)
+	case OP_SQR:
+		return ComputeForwardSqrFP32(params, tensor.src0, tensor)
+	case OP_SQRT:
+		return ComputeForwardSqrtFP32(params, tensor.src0, tensor)
+	case OP_MEAN:
+		return ComputeForwardMeanFP32(params, tensor.src0, tensor)
+	case OP_ABS:
+		return ComputeForwardAbsFP32(params, tensor.src0, tensor)
+	case OP_NEG:
+		return ComputeForwardNegFP32(params, tensor.src0, tensor)
+	case OP_RELU:
+		return ComputeForwardReluFP32(params, tensor.src0, tensor)
+	case OP_CONV_1D_1S:
+		return ComputeForwardConv1DFP32(params, tensor.src0, tensor.src1, tensor, 1)
+	case OP_CONV_1D_2S:
+		return ComputeForwardConv1DFP32(params, tensor.src0, tensor.src1, tensor, 2)
+	case OP_FLASH_ATTN:
+		return ComputeForwardFlashAttnFP32(params, tensor.src0, tensor.src1, tensor.opt[0], tensor)
+	default:
+		return ErrUnsupportedOp
+	}
+
+	return nil
+}
+
+// tasksCount is the number of Job threads for ops split by rows, there is no sense in more threads than rows
+func tasksCount(node *Tensor, maxThreads int) int {
+	return min(maxThreads, int(node.Nrows()))
+}
+
+// GraphCompute computes all graph nodes one by one, it stops on the first node failed with *OpError
+func GraphCompute(ctx *Context, graph *Graph) error {
 
 	//maxThreads := graph.MaxThreads
 	maxThreads := ctx.MaxThreads
@@ -1422,6 +1865,9 @@ func GraphCompute(ctx *Context, graph *Graph) {
 	//	go Job(graph.Jobs, i)
 	//}
 
+	// nodes of graphs which were not planned get their memory before the first compute
+	allocNodes(graph)
+
 	// --- initialize tasks
 
 	{
@@ -1435,39 +1881,43 @@ func GraphCompute(ctx *Context, graph *Graph) {
 				fmt.Printf("\n\n### STEP #%d ### %d - %d [ %d:%d:%d:%d ]", i, node.op, node.Type, node.NE[0], node.NE[1], node.NE[2], node.NE[3])
 			}
 
+			// constructors record errors of ops which can't be built, nothing is computed then
+			if node.err != nil {
+				return &OpError{Op: opNames[node.op], Node: i, NE: node.NE, Err: node.err}
+			}
+
 			switch node.op {
 
 			case OP_DUP:
-				node.TasksCount = 1
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_ADD:
-				node.TasksCount = 1 // TODO threads
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_SUB:
 			case OP_MUL:
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_DIV:
-			case OP_SQR:
-			case OP_SQRT:
+			case OP_SQR, OP_SQRT, OP_MEAN, OP_ABS, OP_NEG, OP_RELU:
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_SUM:
-			case OP_MEAN:
 			case OP_REPEAT:
-			case OP_ABS:
 			case OP_SGN:
-			case OP_NEG:
 			case OP_STEP:
-			case OP_RELU:
 				node.TasksCount = 1
 			case OP_GELU:
-				node.TasksCount = 1 // TODO threads
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_SILU:
-				node.TasksCount = 1 // TODO threads
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_NORM:
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_RMS_NORM:
-				node.TasksCount = 1 // TODO threads
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_MUL_MAT:
 				node.TasksCount = maxThreads
 				// TODO: use different scheduling for different matrix sizes
 			case OP_SCALE:
-				node.TasksCount = 1 // TODO threads
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_CPY:
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_RESHAPE:
 			case OP_VIEW:
 			case OP_PERMUTE:
@@ -1476,24 +1926,25 @@ func GraphCompute(ctx *Context, graph *Graph) {
 			case OP_DIAG_MASK_INF:
 				node.TasksCount = 1
 			case OP_SOFT_MAX:
-				node.TasksCount = 1 // TODO threads
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_ROPE:
-				////node.TasksCount = 1
-			case OP_CONV_1D_1S:
-			case OP_CONV_1D_2S:
-				node.TasksCount = 1 // TODO threads
-				////ASSERT(node->src0->ne[3] == 1);
-				////ASSERT(node->src1->ne[2] == 1);
-				////ASSERT(node->src1->ne[3] == 1);
+				node.TasksCount = tasksCount(node, maxThreads)
+			case OP_CONV_1D_1S, OP_CONV_1D_2S:
+				// output channels are split between threads
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_FLASH_ATTN:
-				node.TasksCount = 1 // TODO threads
+				// pairs of the query and the head are split between threads
+				node.TasksCount = tasksCount(node, maxThreads)
 			case OP_FLASH_FF:
 				node.TasksCount = 1 // TODO threads
+			case OP_TOP_K, OP_GATHER:
+				node.TasksCount = 1
+			case OP_MUL_MAT_ID:
+				node.TasksCount = 1 // matrices of experts are multiplied by Job threads one by one
 			case OP_NONE:
 				node.TasksCount = 1
 			case OP_COUNT:
-				fmt.Printf("\n[HALT] Something wrong with compute graph!")
-				os.Exit(1)
+				return &OpError{Op: opNames[node.op], Node: i, NE: node.NE, Err: ErrUnsupportedOp}
 			}
 		}
 	}
@@ -1507,154 +1958,102 @@ func GraphCompute(ctx *Context, graph *Graph) {
 		}
 
 		params := &ComputeParams{
-			Type: TASK_INIT,
-			ith:  0,
-			nth:  uint32(node.TasksCount),
+			Type:    TASK_INIT,
+			ith:     0,
+			nth:     uint32(node.TasksCount),
+			UseAVX:  ctx.UseAVX,
+			UseNEON: ctx.UseNEON,
 		}
 
-		ComputeForward(ctx, graph, params, node) // TASK_INIT
-
-		// --- COMPUTE
-
-		params.Type = TASK_COMPUTE
-		ComputeForward(ctx, graph, params, node)
-
-		// --- FINALIZE
-
-		params.Type = TASK_FINALIZE
-		ComputeForward(ctx, graph, params, node)
+		// only the compute is split between Job threads, INIT checks sources before any of them starts
+		for _, task := range []TaskType{TASK_INIT, TASK_COMPUTE, TASK_FINALIZE} {
+			params.Type = task
+			var err error
+			if task == TASK_COMPUTE && node.TasksCount > 1 {
+				err = ComputeJobs(ctx, node, node.TasksCount)
+			} else {
+				err = ComputeForward(ctx, graph, params, node)
+			}
+			if err != nil {
+				return &OpError{Op: opNames[node.op], Node: i, NE: node.NE, Err: err}
+			}
+		}
 	}
 
+	return nil
 }
 
 // =======================================================================
 
-func ComputeForward(ctx *Context, graph *Graph, params *ComputeParams, tensor *Tensor) {
+func ComputeForward(ctx *Context, graph *Graph, params *ComputeParams, tensor *Tensor) error {
 
 	switch tensor.op {
 
 	case OP_DUP:
-		////ggml_compute_forward_dup(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_dup")
-		os.Exit(1)
+		return ComputeForwardDupFP32(params, tensor.src0, tensor)
 	case OP_ADD:
-		ComputeForwardAddFP32(params, tensor.src0, tensor.src1, tensor)
+		return ComputeForwardAddFP32(params, tensor.src0, tensor.src1, tensor)
 	case OP_SUB:
 		////ggml_compute_forward_sub(params, tensor->src0, tensor->src1, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_sub")
-		os.Exit(1)
+		return ErrUnsupportedOp
 	case OP_MUL:
-		ComputeForwardMulFP32(params, tensor.src0, tensor.src1, tensor)
+		return ComputeForwardMulFP32(params, tensor.src0, tensor.src1, tensor)
 	case OP_DIV:
 		////ggml_compute_forward_div(params, tensor->src0, tensor->src1, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_div")
-		os.Exit(1)
+		return ErrUnsupportedOp
 	case OP_SQR:
-		////ggml_compute_forward_sqr(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_sqr")
-		os.Exit(1)
+		return ComputeForwardSqrFP32(params, tensor.src0, tensor)
 	case OP_SQRT:
-		////ggml_compute_forward_sqrt(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_sqrt")
-		os.Exit(1)
+		return ComputeForwardSqrtFP32(params, tensor.src0, tensor)
 	case OP_SUM:
 		////ggml_compute_forward_sum(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_sum")
-		os.Exit(1)
+		return ErrUnsupportedOp
 	case OP_MEAN:
-		////ggml_compute_forward_mean(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_mean")
-		os.Exit(1)
+		return ComputeForwardMeanFP32(params, tensor.src0, tensor)
 	case OP_REPEAT:
 		ComputeForwardRepeatFP32(params, tensor.src0, tensor)
 	case OP_ABS:
-		////ggml_compute_forward_abs(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_abs")
-		os.Exit(1)
+		return ComputeForwardAbsFP32(params, tensor.src0, tensor)
 	case OP_SGN:
 		////ggml_compute_forward_sgn(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_sgn")
-		os.Exit(1)
+		return ErrUnsupportedOp
 	case OP_NEG:
-		////ggml_compute_forward_neg(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_neg")
-		os.Exit(1)
+		return ComputeForwardNegFP32(params, tensor.src0, tensor)
 	case OP_STEP:
 		////ggml_compute_forward_step(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_step")
-		os.Exit(1)
+		return ErrUnsupportedOp
 	case OP_RELU:
-		////ggml_compute_forward_relu(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_relu")
-		os.Exit(1)
+		return ComputeForwardReluFP32(params, tensor.src0, tensor)
 	case OP_GELU:
-		////ggml_compute_forward_gelu(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_gelu")
-		os.Exit(1)
+		return ComputeForwardGeluFP32(params, tensor.src0, tensor)
 	case OP_SILU:
-		ComputeForwardSiluFP32(params, tensor.src0, tensor)
+		return ComputeForwardSiluFP32(params, tensor.src0, tensor)
 	case OP_NORM:
-		////ggml_compute_forward_norm(params, tensor->src0, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_norm")
-		os.Exit(1)
+		return ComputeForwardNormFP32(params, tensor.src0, tensor)
 	case OP_RMS_NORM:
 		ComputeForwardRMSNormFP32(params, tensor.src0, tensor)
 	case OP_MUL_MAT:
 
-		// TODO Optimize this
-		if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-			return
-		}
-
-		// FIXME: Need better heuristic for how many threads to use there
-		// But not more than minimal dimension of tensors involved!
-		// Like if there dim = 8, it safe to use only 8 or less threads, not 12
-
-		// TODO: There might be small architectures where not reasonable to spin up
-		// all available threads, so better to limit parallelism here
-		// But that's not the case for LLMs and particularly LLaMA, thus commented
-
-		// totalRows := tensor.src0.NE[1] * tensor.src0.NE[2] * tensor.src0.NE[3]
-		// maxThreads := min(graph.MaxThreads, int(totalRows))
-
-		//maxThreads := graph.MaxThreads
-		maxThreads := ctx.MaxThreads
-
-		wg := new(sync.WaitGroup)
-		wg.Add(maxThreads)
-
-		for i := 0; i < maxThreads; i++ {
-
-			//graph.Jobs <- &ComputeParams{
-			ctx.Compute <- &ComputeParams{
-				Type:   TASK_COMPUTE,
-				ith:    uint32(i),
-				nth:    uint32(maxThreads),
-				tensor: tensor,
-				//UseNEON: graph.UseNEON,
-				UseNEON: ctx.UseNEON,
-				//UseAVX:  graph.UseAVX,
-				UseAVX: ctx.UseAVX,
-				wg:     wg,
+		// kernels panic on wrong weights, so check the type before any of jobs is sent
+		if params.Type == TASK_INIT {
+			if tensor.src0.Type != TYPE_F32 && !IsQuantized(tensor.src0.Type) {
+				return fmt.Errorf("[src0] %w", ErrUnsupportedDType)
 			}
+			if !CanMulMat(tensor.src0, tensor.src1) {
+				return fmt.Errorf("[src0] %v and [src1] %v: %w", tensor.src0.NE, tensor.src1.NE, ErrShapeMismatch)
+			}
+		}
 
-			/* go Do(&ComputeParams{
-				Type:    TASK_COMPUTE,
-				ith:     uint32(i),
-				nth:     uint32(maxThreads),
-				tensor:  tensor,
-				UseNEON: graph.UseNEON,
-				UseAVX:  graph.UseAVX,
-				wg:      wg,
-			}, i) */
+		if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+			return nil
 		}
 
-		wg.Wait()
+		return ComputeForwardMulMat(params, tensor.src0, tensor.src1, tensor)
 
 	case OP_SCALE:
-		ComputeForwardScaleFP32(params, tensor.src0, tensor.src1, tensor)
+		return ComputeForwardScaleFP32(params, tensor.src0, tensor.src1, tensor)
 	case OP_CPY:
-		ComputeForwardDupFP32(params, tensor.src0, tensor)
+		return ComputeForwardDupFP32(params, tensor.src0, tensor)
 	case OP_RESHAPE:
 		ComputeForwardReshape(params, tensor.src0, tensor) // NOP
 	case OP_VIEW:
@@ -1662,70 +2061,104 @@ func ComputeForward(ctx *Context, graph *Graph, params *ComputeParams, tensor *T
 	case OP_PERMUTE:
 		ComputeForwardPermute(params, tensor.src0) // NOP
 	case OP_TRANSPOSE:
-		////ggml_compute_forward_transpose(params, tensor->src0);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_transpose")
-		os.Exit(1)
+		ComputeForwardTranspose(params, tensor.src0) // NOP
 	case OP_GET_ROWS:
-		ComputeForwardGetRows(params, tensor.src0, tensor.src1, tensor)
+		return ComputeForwardGetRows(params, tensor.src0, tensor.src1, tensor)
 	case OP_DIAG_MASK_INF:
 		ComputeForwardDiagMaskInfFP32(params, tensor.src0, tensor.src1, tensor)
 	case OP_SOFT_MAX:
-		ComputeForwardSoftMaxFP32(params, tensor.src0, tensor)
+		return ComputeForwardSoftMaxFP32(params, tensor.src0, tensor)
 	case OP_ROPE:
-		ComputeForwardRopeFP32(params, tensor.src0, tensor.src1, tensor)
+		return ComputeForwardRopeFP32(params, tensor.src0, tensor.src1, tensor)
 	case OP_CONV_1D_1S:
-		////ggml_compute_forward_conv_1d_1s(params, tensor->src0, tensor->src1, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_conv_1d_1s")
-		os.Exit(1)
+		return ComputeForwardConv1DFP32(params, tensor.src0, tensor.src1, tensor, 1)
 	case OP_CONV_1D_2S:
-		////ggml_compute_forward_conv_1d_2s(params, tensor->src0, tensor->src1, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_conv_1d_2s")
-		os.Exit(1)
+		return ComputeForwardConv1DFP32(params, tensor.src0, tensor.src1, tensor, 2)
 	case OP_FLASH_ATTN:
-		////int32_t t = ggml_get_i32_1d(tensor->opt[1], 0);
-		////ASSERT(t == 0 || t == 1);
-		////bool masked = t != 0;
-		////ggml_compute_forward_flash_attn(params, tensor->src0, tensor->src1, tensor->opt[0], masked, tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_flash_attn")
-		os.Exit(1)
+		return ComputeForwardFlashAttnFP32(params, tensor.src0, tensor.src1, tensor.opt[0], tensor)
 	case OP_FLASH_FF:
 		////ggml_compute_forward_flash_ff(params, tensor->src0, tensor->src1, tensor->opt[0], tensor->opt[1], tensor->opt[2], tensor);
-		fmt.Printf("\n[HALT] Please implement : ggml_compute_forward_flash_ff")
-		os.Exit(1)
+		return ErrUnsupportedOp
+	case OP_TOP_K:
+		return ComputeForwardTopK(params, tensor.src0, tensor)
+	case OP_GATHER:
+		return ComputeForwardGather(params, tensor.src0, tensor.src1, tensor)
+	case OP_MUL_MAT_ID:
+		return ComputeForwardMulMatID(ctx, params, tensor)
 	case OP_NONE:
 		// nop
 	case OP_COUNT:
 		////ASSERT(false);
-		fmt.Printf("\n[HALT] ComputeForward got OP_COUNT method!")
-		os.Exit(1)
+		return ErrUnsupportedOp
 	}
-}
 
-func VecCopyFP32(n uint32, y, x []float32) {
-	for i := uint32(0); i < n; i++ {
-		y[i] = x[i]
-	}
+	return nil
 }
 
-// ggml_compute_forward_get_rows_f32
-func ComputeForwardGetRows(params *ComputeParams, src0, src1, dst *Tensor) {
+// ComputeJobs splits the compute of [tensor] rows between [nth] Job threads and waits for all of them
+// Jobs can't stop each other, so the first error is returned only after all of them are done
+func ComputeJobs(ctx *Context, tensor *Tensor, nth int) error {
 
-	////assert(params->ith == 0);
+	// FIXME: Need better heuristic for how many threads to use there
+	// TODO: There might be small architectures where not reasonable to spin up
+	// all available threads, so better to limit parallelism here
 
-	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-		return
+	if len(ctx.tasks) < nth {
+		ctx.tasks = make([]ComputeParams, nth)
 	}
 
-	nc := src0.NE[0]
-	nr := src1.Nelements()
+	wg := &ctx.wg
+	wg.Add(nth)
+
+	tasks := ctx.tasks[:nth]
+	for i := range tasks {
+		tasks[i] = ComputeParams{
+			Type:    TASK_COMPUTE,
+			ith:     uint32(i),
+			nth:     uint32(nth),
+			tensor:  tensor,
+			UseNEON: ctx.UseNEON,
+			UseAVX:  ctx.UseAVX,
+			wg:      wg,
+		}
+		ctx.Compute <- &tasks[i]
+	}
+
+	wg.Wait()
+
+	for i := range tasks {
+		if tasks[i].err != nil {
+			return tasks[i].err
+		}
+	}
+
+	return nil
+}
+
+func VecCopyFP32(n uint32, y, x []float32) {
+	for i := uint32(0); i < n; i++ {
+		y[i] = x[i]
+	}
+}
+
+// ggml_compute_forward_get_rows_f32
+func ComputeForwardGetRows(params *ComputeParams, src0, src1, dst *Tensor) error {
+
+	////assert(params->ith == 0);
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	nc := src0.NE[0]
+	nr := src1.Nelements()
 
 	////assert( dst->ne[0] == nc);
 	////assert( dst->ne[1] == nr);
 	////assert(src0->nb[0] == sizeof(float));
 
-	if dst.NE[0] != nc || dst.NE[1] != nr || src0.NB[0] != TYPE_SIZE[TYPE_F32] /*TYPE_SIZE[TYPE_I32]*/ {
-		fmt.Printf("[HALT]ComputeForwardGetRows : wrong dimensions!")
-		os.Exit(1)
+	if dst.NE[0] != nc || dst.NE[1] != nr || src0.NB[0] != TYPE_SIZE[src0.Type] /*TYPE_SIZE[TYPE_I32]*/ {
+		return fmt.Errorf("rows of %d elements from %d:%d tensor: %w", nc, src0.NE[0], src0.NE[1], ErrShapeMismatch)
 	}
 
 	// FIXME Speed-up
@@ -1735,6 +2168,17 @@ func ComputeForwardGetRows(params *ComputeParams, src0, src1, dst *Tensor) {
 	////	}
 	////}
 
+	// quantized rows should be converted back into FP32
+	if IsQuantized(src0.Type) {
+		for i := uint32(0); i < nr; i++ {
+			r := uint32(src1.Data[i])
+			if err := DequantizeRow(src0.Type, src0.Blocks[r*src0.NB[1]:], dst.Data[i*dst.NE[0]:i*dst.NE[0]+nc]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	for i := uint32(0); i < nr; i++ {
 		r := uint32(src1.Data[i])
 
@@ -1747,6 +2191,77 @@ func ComputeForwardGetRows(params *ComputeParams, src0, src1, dst *Tensor) {
 		// VecCopyFP32(nc, dst.Data[i*dst.NB[1]/4:], src0.Data[r*src0.NB[1]/4:])
 		VecCopyFP32(nc, dst.Data[i*dst.NE[0]:], src0.Data[r*src0.NE[0]:]) // TODO copy()
 	}
+
+	return nil
+}
+
+// ggml_compute_forward_norm_f32
+func ComputeForwardNormFP32(params *ComputeParams, src0, dst *Tensor) error {
+
+	// rows might be strided, but their values should be adjacent
+	if src0.NB[0] != 4 {
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
+	}
+
+	if dst.NB[0] != 4 {
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
+	}
+
+	if !AreSameShape(src0, dst) {
+		return fmt.Errorf("[src0] %v and [dst] %v: %w", src0.NE, dst.NE, ErrShapeMismatch)
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	ith := params.ith
+	nth := params.nth
+
+	ne00 := src0.NE[0]
+	ne01 := src0.NE[1]
+	ne02 := src0.NE[2]
+	ne03 := src0.NE[3]
+
+	nb01 := src0.NB[1]
+	nb02 := src0.NB[2]
+	nb03 := src0.NB[3]
+
+	nb1 := dst.NB[1]
+	nb2 := dst.NB[2]
+	nb3 := dst.NB[3]
+
+	eps := 1e-5 // TODO: make this a parameter
+
+	for i03 := uint32(0); i03 < ne03; i03++ {
+		for i02 := uint32(0); i02 < ne02; i02++ {
+			for i01 := uint32(ith); i01 < ne01; i01 += nth {
+
+				x := src0.Data[i01*nb01/4+i02*nb02/4+i03*nb03/4:]
+
+				sum := 0.0
+				for i00 := uint32(0); i00 < ne00; i00++ {
+					sum += float64(x[i00])
+				}
+				mean := sum / float64(ne00)
+
+				y := dst.Data[i01*nb1/4+i02*nb2/4+i03*nb3/4:]
+
+				variance := 0.0
+				for i00 := uint32(0); i00 < ne00; i00++ {
+					v := float64(x[i00]) - mean
+					y[i00] = float32(v)
+					variance += v * v
+				}
+				variance /= float64(ne00)
+
+				scale := float32(1.0 / math.Sqrt(variance+eps))
+				VecScaleFP32(ne00, y, scale)
+			}
+		}
+	}
+
+	return nil
 }
 
 // ggml_compute_forward_rms_norm_f32
@@ -1874,20 +2389,22 @@ func VecMulFP32(n uint32, z, x, y []float32) {
 }
 
 // ggml_compute_forward_mul
-func ComputeForwardMulFP32(params *ComputeParams, src0, src1, dst *Tensor) {
+func ComputeForwardMulFP32(params *ComputeParams, src0, src1, dst *Tensor) error {
 
 	////assert(params->ith == 0);
 	////assert(ggml_are_same_shape(src0, src1) && ggml_are_same_shape(src0, dst));
 
 	if !AreSameShape(src0, src1) || !AreSameShape(src0, dst) {
-		fmt.Printf("\n[HALT] ComputeForwardMulFP32 : different shapes!")
-		os.Exit(1)
+		return ErrShapeMismatch
 	}
 
 	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-		return
+		return nil
 	}
 
+	ith := params.ith
+	nth := params.nth
+
 	n := src0.Nrows()
 	nc := src0.NE[0]
 
@@ -1895,7 +2412,14 @@ func ComputeForwardMulFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 	////assert(src0->nb[0] == sizeof(float));
 	////assert(src1->nb[0] == sizeof(float));
 
-	for i := uint32(0); i < n; i++ {
+	// rows per thread
+	dr := (n + nth - 1) / nth
+
+	// row range for this thread
+	ir0 := dr * ith
+	ir1 := uint32(min(int(ir0+dr), int(n)))
+
+	for i := ir0; i < ir1; i++ {
 
 		////ggml_vec_mul_f32(nc,
 		////(float *) ((char *) dst->data  + i*( dst->nb[1])),
@@ -1911,6 +2435,8 @@ func ComputeForwardMulFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 		printTensor(src1, "MUL SRC1")
 		printTensor(dst, "MUL DST")
 	}
+
+	return nil
 }
 
 // ggml_vec_dot_f32
@@ -1989,6 +2515,8 @@ func ComputeForwardMulMatFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 	ne03 := src0.NE[3]
 
 	ne11 := src1.NE[1]
+	ne12 := src1.NE[2]
+	ne13 := src1.NE[3]
 
 	nb01 := src0.NB[1]
 	nb02 := src0.NB[2]
@@ -2007,7 +2535,11 @@ func ComputeForwardMulMatFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 	src1Data := unsafe.Pointer(&src1.Data[0])
 	dstData := unsafe.Pointer(&dst.Data[0])
 
-	nr := ne01 * ne02 * ne03                 // total rows in src0
+	// each src0 matrix is broadcasted over r2 x r3 matrices of src1
+	r2 := ne12 / ne02
+	r3 := ne13 / ne03
+
+	nr := ne01 * ne12 * ne13                 // total rows in src0 including broadcasted ones
 	dr := (nr + params.nth - 1) / params.nth // rows per thread
 	ir0 := dr * params.ith                   // row range...
 	ir1 := min32(ir0+dr, nr)                 // ...for this thread
@@ -2025,7 +2557,10 @@ func ComputeForwardMulMatFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 			step3D := ir / ne01
 			stepPos := ir % ne01
 
-			src0Ptr := unsafe.Add(src0Data, ir*srcStride)
+			i13 := step3D / ne12
+			i12 := step3D - i13*ne12
+
+			src0Ptr := unsafe.Add(src0Data, stepPos*srcStride+(i12/r2)*nb02+(i13/r3)*nb03)
 			src1Ptr := unsafe.Add(src1Data, step3D*nb12)
 			dstPtr := unsafe.Add(dstData, step3D*nb2+stepPos*4)
 
@@ -2038,21 +2573,21 @@ func ComputeForwardMulMatFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 
 	} else {
 
-		mult := ne02 * ne01
+		mult := ne12 * ne01
 		for ir := ir0; ir < ir1; ir++ {
 
 			// original GGML indices math + bit optimizations
-			//i03 := ir / (ne02 * ne01)
-			i03 := ir / mult
-			//i02 := (ir - i03*ne02*ne01) / ne01
-			diff := ir - i03*mult
-			//i02 := (ir - i03*mult) / ne01
-			i02 := diff / ne01
-			//i01 := (ir - i03*ne02*ne01 - i02*ne01)
-			//i01 := ir - i03*mult - i02*ne01
-			i01 := diff - i02*ne01
-
-			src0Offset := i01*nb01 + i02*nb02 + i03*nb03
+			//i13 := ir / (ne12 * ne01)
+			i13 := ir / mult
+			//i12 := (ir - i13*ne12*ne01) / ne01
+			diff := ir - i13*mult
+			//i12 := (ir - i13*mult) / ne01
+			i12 := diff / ne01
+			//i01 := (ir - i13*ne12*ne01 - i12*ne01)
+			//i01 := ir - i13*mult - i12*ne01
+			i01 := diff - i12*ne01
+
+			src0Offset := i01*nb01 + (i12/r2)*nb02 + (i13/r3)*nb03
 
 			for ic := uint32(0); ic < ne11; ic++ {
 
@@ -2063,8 +2598,8 @@ func ComputeForwardMulMatFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 
 				// --- inline VecDotFP32
 
-				src1Offet := ic*nb11 + i02*nb12 + i03*nb13
-				dstOffset := i01*nb0 + ic*nb1 + i02*nb2 + i03*nb3
+				src1Offet := ic*nb11 + i12*nb12 + i13*nb13
+				dstOffset := i01*nb0 + ic*nb1 + i12*nb2 + i13*nb3
 
 				if params.UseAVX || params.UseNEON {
 
@@ -2107,24 +2642,26 @@ func ComputeForwardCopy(params *ComputeParams, src0, dst *Tensor) {
 }
 
 // ggml_compute_forward_dup_f32
-func ComputeForwardDupFP32(params *ComputeParams, src0, dst *Tensor) {
+func ComputeForwardDupFP32(params *ComputeParams, src0, dst *Tensor) error {
 
 	////GGML_ASSERT(params->ith == 0);
 	////GGML_ASSERT(ggml_is_contiguous(dst));
 	////GGML_ASSERT(ggml_nelements(dst) == ggml_nelements(src0));
 
 	if !dst.IsContiguous() {
-		fmt.Printf("[HALT] ComputeForwardDupFP32 : [dst] is NOT contiguous!")
-		os.Exit(1)
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
 	}
 
 	if dst.Nelements() != src0.Nelements() {
-		fmt.Printf("[HALT] ComputeForwardDupFP32 : [dst] and [src0] capacities are different!")
-		os.Exit(1)
+		return fmt.Errorf("[dst] and [src0] capacities are different: %w", ErrShapeMismatch)
+	}
+
+	if IsQuantized(src0.Type) || IsQuantized(dst.Type) {
+		return ErrUnsupportedDType
 	}
 
 	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-		return
+		return nil
 	}
 
 	ne00 := src0.NE[0]
@@ -2137,13 +2674,33 @@ func ComputeForwardDupFP32(params *ComputeParams, src0, dst *Tensor) {
 	nb02 := src0.NB[2] / 4
 	nb03 := src0.NB[3] / 4
 
+	ith := params.ith
+	nth := params.nth
+
 	////if (ggml_is_contiguous(src0) && src0->type == dst->type) {
 	if src0.IsContiguous() && src0.Type == dst.Type {
+
+		// elements per thread
+		n := dst.Nelements()
+		de := (n + nth - 1) / nth
+
+		// element range for this thread
+		ie0 := min32(de*ith, n)
+		ie1 := min32(ie0+de, n)
+
 		////memcpy(dst->data, src0->data, ggml_nelements(dst) * GGML_TYPE_SIZE[src0->type]);
-		copy(dst.Data, src0.Data)
-		return
+		copy(dst.Data[ie0:ie1], src0.Data[ie0:ie1])
+		return nil
 	}
 
+	// rows per thread
+	nr := src0.Nrows()
+	dr := (nr + nth - 1) / nth
+
+	// row range for this thread
+	ir0 := dr * ith
+	ir1 := ir0 + dr
+
 	// --- src0 is NOT contigious
 	// --- supporting only 4-bytes data for [src0] and FP32 for [dst]
 
@@ -2157,12 +2714,14 @@ func ComputeForwardDupFP32(params *ComputeParams, src0, dst *Tensor) {
 				for i02 := uint32(0); i02 < ne02; i02++ {
 					for i01 := uint32(0); i01 < ne01; i01++ {
 
-						////const char * src0_ptr = (char *) src0->data + i01*nb01 + i02*nb02 + i03*nb03;
-						src0Ptr := src0.Data[i01*nb01+i02*nb02+i03*nb03 : i01*nb01+i02*nb02+i03*nb03+rs]
-						////char * dst_ptr = (char *) dst->data + id*rs;
-						dstPtr := dst.Data[id*rs : id*rs+rs]
-						////memcpy(dst_ptr, src0_ptr, rs);
-						copy(dstPtr, src0Ptr)
+						if id >= ir0 && id < ir1 {
+							////const char * src0_ptr = (char *) src0->data + i01*nb01 + i02*nb02 + i03*nb03;
+							src0Ptr := src0.Data[i01*nb01+i02*nb02+i03*nb03 : i01*nb01+i02*nb02+i03*nb03+rs]
+							////char * dst_ptr = (char *) dst->data + id*rs;
+							dstPtr := dst.Data[id*rs : id*rs+rs]
+							////memcpy(dst_ptr, src0_ptr, rs);
+							copy(dstPtr, src0Ptr)
+						}
 
 						id++
 					}
@@ -2186,19 +2745,25 @@ func ComputeForwardDupFP32(params *ComputeParams, src0, dst *Tensor) {
 			////    }
 		} else {
 			////GGML_ASSERT(false); // TODO: implement
-			fmt.Printf("[HALT] ComputeForwardDupFP32 : not supported tensor type!")
-			os.Exit(1)
+			return fmt.Errorf("[dst] %w", ErrUnsupportedDType)
 		}
 	} else {
 
 		if dst.Type == TYPE_F32 {
 
-			id := 0
+			row := uint32(0)
 			////dstPtr = (float *) dst->data;
 
 			for i03 := uint32(0); i03 < ne03; i03++ {
 				for i02 := uint32(0); i02 < ne02; i02++ {
 					for i01 := uint32(0); i01 < ne01; i01++ {
+
+						if row < ir0 || row >= ir1 {
+							row++
+							continue
+						}
+
+						id := row * ne00
 						for i00 := uint32(0); i00 < ne00; i00++ {
 
 							//src0Ptr := src0.Data[i00*nb00/4 + i01*nb01/4 + i02*nb02/4 + i03*nb03/4:]
@@ -2208,6 +2773,8 @@ func ComputeForwardDupFP32(params *ComputeParams, src0, dst *Tensor) {
 
 							id++
 						}
+
+						row++
 					}
 				}
 			}
@@ -2229,14 +2796,15 @@ func ComputeForwardDupFP32(params *ComputeParams, src0, dst *Tensor) {
 			////    }
 		} else {
 			////GGML_ASSERT(false) // TODO: implement
-			fmt.Printf("[HALT] ComputeForwardDupFP32 : not supported tensor type!")
-			os.Exit(1)
+			return fmt.Errorf("[dst] %w", ErrUnsupportedDType)
 		}
 	}
 
 	if DEBUG {
 		fmt.Printf("\n\n>>> ComputeForwardDupFP32 OUT <<<\n")
 	}
+
+	return nil
 }
 
 // ggml_compute_forward_reshape
@@ -2249,26 +2817,72 @@ func ComputeForwardPermute(params *ComputeParams, src0 *Tensor) {
 	// NOP
 }
 
+// ggml_compute_forward_transpose
+func ComputeForwardTranspose(params *ComputeParams, src0 *Tensor) {
+	// NOP
+}
+
 // ggml_compute_forward_rope
-func ComputeForwardRopeFP32(params *ComputeParams, src0, src1, dst *Tensor) {
+func ComputeForwardRopeFP32(params *ComputeParams, src0, src1, dst *Tensor) error {
 
 	////assert(params->ith == 0);
 	////assert(src1->type == GGML_TYPE_I32);
 	////assert(ggml_nelements(src1) == 3);
 
-	if src1.Nelements() != 3 {
-		fmt.Printf("\n[HALT] ComputeForwardRopeFP32 : src1 has NOT EXACT 3 elements!")
-		os.Exit(1)
+	if src1.Nelements() != ropeParamsCount {
+		return fmt.Errorf("[src1] should have exactly %d elements: %w", ropeParamsCount, ErrShapeMismatch)
 	}
 
 	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-		return
+		return nil
 	}
 
 	pastCount := uint32(src1.Data[0])
 	dims := uint32(src1.Data[1])
 	mode := uint32(src1.Data[2])
 
+	freqBase := float64(src1.Data[3])
+	freqScale := float64(src1.Data[4])
+	scaling := RopeScaling(src1.Data[5])
+	ctxOrig := float64(src1.Data[6])
+
+	// --- NTK-aware scaling keeps positions as they are and stretches the base frequency instead
+
+	if scaling == ROPE_SCALING_NONE || freqScale == 0 {
+		freqScale = 1.0
+	}
+
+	if scaling == ROPE_SCALING_NTK && freqScale != 1.0 && dims > 2 {
+		freqBase *= math.Pow(1.0/freqScale, float64(dims)/float64(dims-2))
+		freqScale = 1.0
+	}
+
+	// --- YaRN interpolates low frequencies, extrapolates high ones and ramps between them
+
+	extFactor := 0.0
+	mscale := 1.0
+	var corrLow, corrHigh float64
+
+	if scaling == ROPE_SCALING_YARN {
+
+		extFactor = valueOr(src1.Data[7], 1.0)
+		attnFactor := valueOr(src1.Data[8], 1.0)
+		betaFast := valueOr(src1.Data[9], 32.0)
+		betaSlow := valueOr(src1.Data[10], 1.0)
+
+		// the dimension where the wavelength makes the given number of rotations within the original context
+		corrDim := func(rotations float64) float64 {
+			return float64(dims) * math.Log(ctxOrig/(rotations*2*math.Pi)) / (2 * math.Log(freqBase))
+		}
+		corrLow = math.Max(0, math.Floor(corrDim(betaFast)))
+		corrHigh = math.Min(float64(dims-1), math.Ceil(corrDim(betaSlow)))
+
+		mscale = attnFactor
+		if freqScale < 1.0 {
+			mscale *= 1.0 + 0.1*math.Log(1.0/freqScale)
+		}
+	}
+
 	//const int ne0 = src0->ne[0];
 	ne1 := src0.NE[1]
 	ne2 := src0.NE[2]
@@ -2282,53 +2896,99 @@ func ComputeForwardRopeFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 	////assert(nb0 == sizeof(float));
 
 	var modeCount uint32
-	if mode == 0 {
+	if mode&ROPE_MODE_PAST == 0 {
 		modeCount = 0
 	} else {
 		modeCount = pastCount
 	}
 
+	neox := mode&ROPE_MODE_NEOX != 0
+
+	ith := params.ith
+	nth := params.nth
+
+	// rows per thread
+	nr := src0.Nrows()
+	dr := (nr + nth - 1) / nth
+
+	// row range for this thread
+	ir0 := dr * ith
+	ir1 := ir0 + dr
+
+	ir := uint32(0) // row counter
+
 	// TODO: optimize
 	for i3 := uint32(0); i3 < ne3; i3++ {
 		for i2 := modeCount; i2 < ne2; i2++ {
 
 			////const int p = (mode == 0 ? n_past + i2 : i2);
 			var p uint32
-			if mode == 0 {
+			if mode&ROPE_MODE_PAST == 0 {
 				p = pastCount + i2
 			} else {
 				p = i2
 			}
 
 			for i1 := uint32(0); i1 < ne1; i1++ {
+
+				ir++
+				if ir <= ir0 {
+					continue
+				}
+				if ir > ir1 {
+					break
+				}
+
 				for i0 := 0; i0 < int(dims); i0 += 2 {
 
 					////const double theta = pow(10000.0, ((double)-i0)/n_dims);
-					theta := math.Pow(10000.0, float64(-i0)/float64(dims))
+					thetaExtrap := float64(p) * math.Pow(freqBase, float64(-i0)/float64(dims))
+					theta := freqScale * thetaExtrap
+
+					if extFactor != 0 {
+						ramp := (float64(i0/2) - corrLow) / math.Max(0.001, corrHigh-corrLow)
+						rampMix := (1 - math.Min(1, math.Max(0, ramp))) * extFactor
+						theta = theta*(1-rampMix) + thetaExtrap*rampMix
+					}
 
-					cosTheta := math.Cos(float64(p) * theta)
-					sinTheta := math.Sin(float64(p) * theta)
+					cosTheta := math.Cos(theta) * mscale
+					sinTheta := math.Sin(theta) * mscale
 
 					////const float * const src = (float *)((char *) src0->data + i3*nb3 + i2*nb2 + i1*nb1 + i0*nb0);
 					offset := i3*nb3/4 + i2*nb2/4 + i1*nb1/4 + uint32(i0)*nb0/4
+					// the second value of the pair is the next one or the one from the second half of dims for NeoX
+					next := uint32(1)
+					if neox {
+						offset -= uint32(i0/2) * nb0 / 4
+						next = dims / 2
+					}
 					src := src0.Data[offset:]
 					////   float * dst_data  = (float *)((char *)  dst->data + i3*nb3 + i2*nb2 + i1*nb1 + i0*nb0);
 					dstData := dst.Data[offset:]
 
 					x0 := float64(src[0])
-					x1 := float64(src[1])
+					x1 := float64(src[next])
 
 					dstData[0] = float32(x0*cosTheta - x1*sinTheta)
-					dstData[1] = float32(x0*sinTheta + x1*cosTheta)
+					dstData[next] = float32(x0*sinTheta + x1*cosTheta)
 				}
 			}
 		}
 	}
 
+	return nil
+}
+
+// valueOr returns the default when the value is not set
+func valueOr(value float32, def float64) float64 {
+	if value == 0 {
+		return def
+	}
+	return float64(value)
 }
 
 // ggml_compute_forward_scale_f32
-func ComputeForwardScaleFP32(params *ComputeParams, src0, src1, dst *Tensor) {
+func ComputeForwardScaleFP32(params *ComputeParams, src0, src1, dst *Tensor) error {
 
 	////GGML_ASSERT(ggml_is_contiguous(src0));
 	////GGML_ASSERT(ggml_is_contiguous(dst));
@@ -2336,17 +2996,15 @@ func ComputeForwardScaleFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 	////GGML_ASSERT(ggml_is_scalar(src1));
 
 	if !src0.IsContiguous() {
-		fmt.Printf("[HALT] ComputeForwardScaleFP32 : [src0] is NOT contiguous!")
-		os.Exit(1)
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
 	}
 
 	if !dst.IsContiguous() {
-		fmt.Printf("[HALT] ComputeForwardScaleFP32 : [dst] is NOT contiguous!")
-		os.Exit(1)
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
 	}
 
 	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-		return
+		return nil
 	}
 
 	// scale factor
@@ -2371,6 +3029,7 @@ func ComputeForwardScaleFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 		VecScaleFP32(nc, dst.Data[i1*dst.NB[1]/4:], v)
 	}
 
+	return nil
 }
 
 // ggml_compute_forward_diag_mask_inf
@@ -2429,24 +3088,22 @@ func VecMaxFP32(n uint32, x []float32) float32 {
 }
 
 // ggml_compute_forward_soft_max
-func ComputeForwardSoftMaxFP32(params *ComputeParams, src0, dst *Tensor) {
+func ComputeForwardSoftMaxFP32(params *ComputeParams, src0, dst *Tensor) error {
 
 	////GGML_ASSERT(ggml_is_contiguous(src0));
 	////GGML_ASSERT(ggml_is_contiguous(dst));
 	////GGML_ASSERT(ggml_are_same_shape(src0, dst));
 
 	if !src0.IsContiguous() {
-		fmt.Printf("[HALT] ComputeForwardSoftMaxFP32 : [src0] is NOT contiguous!")
-		os.Exit(1)
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
 	}
 
 	if !dst.IsContiguous() {
-		fmt.Printf("[HALT] ComputeForwardSoftMaxFP32 : [dst] is NOT contiguous!")
-		os.Exit(1)
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
 	}
 
 	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-		return
+		return nil
 	}
 
 	negInf := float32(math.Inf(-1)) // TODO use constant
@@ -2502,6 +3159,8 @@ func ComputeForwardSoftMaxFP32(params *ComputeParams, src0, dst *Tensor) {
 	if DEBUG {
 		fmt.Printf("\n\n>>> ComputeForwardSoftMaxFP32 OUT <<<\n")
 	}
+
+	return nil
 }
 
 // inline static void ggml_vec_add_f32 (const int n, float * z, const float * x, const float * y) { for (int i = 0; i < n; ++i) z[i]  = x[i] + y[i]; }
@@ -2512,17 +3171,16 @@ func VecAddFP32(n uint32, z, x, y []float32) {
 }
 
 // ggml_compute_forward_add
-func ComputeForwardAddFP32(params *ComputeParams, src0, src1, dst *Tensor) {
+func ComputeForwardAddFP32(params *ComputeParams, src0, src1, dst *Tensor) error {
 
 	////GGML_ASSERT(ggml_are_same_shape(src0, src1) && ggml_are_same_shape(src0, dst));
 
 	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-		return
+		return nil
 	}
 
 	if src1.NB[0] != TYPE_SIZE[TYPE_F32] {
-		fmt.Printf("[HALT] ComputeForwardAddFP32 : [src1] is NOT contiguous!")
-		os.Exit(1)
+		return fmt.Errorf("[src1] %w", ErrNotContiguous)
 	}
 
 	ith := params.ith
@@ -2581,6 +3239,8 @@ func ComputeForwardAddFP32(params *ComputeParams, src0, src1, dst *Tensor) {
 	if DEBUG {
 		fmt.Printf("\n\n>>> OUT <<< ComputeForwardAddFP32 <<<")
 	}
+
+	return nil
 }
 
 // Sigmoid Linear Unit (SiLU) function
@@ -2596,24 +3256,22 @@ func VecSiluFP32(n uint32, y, x []float32) {
 }
 
 // ggml_compute_forward_silu
-func ComputeForwardSiluFP32(params *ComputeParams, src0, dst *Tensor) {
+func ComputeForwardSiluFP32(params *ComputeParams, src0, dst *Tensor) error {
 
 	////GGML_ASSERT(ggml_is_contiguous(src0));
 	////GGML_ASSERT(ggml_is_contiguous(dst));
 	////GGML_ASSERT(ggml_are_same_shape(src0, dst));
 
 	if !src0.IsContiguous() {
-		fmt.Printf("[HALT] ComputeForwardSiluFP32 : [src0] is NOT contiguous!")
-		os.Exit(1)
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
 	}
 
 	if !dst.IsContiguous() {
-		fmt.Printf("[HALT] ComputeForwardSiluFP32 : [dst] is NOT contiguous!")
-		os.Exit(1)
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
 	}
 
 	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
-		return
+		return nil
 	}
 
 	ith := params.ith
@@ -2641,28 +3299,323 @@ func ComputeForwardSiluFP32(params *ComputeParams, src0, dst *Tensor) {
 		printTensor(src0, "SRC SILI")
 		printTensor(dst, "DST SILI")
 	}
+
+	return nil
+}
+
+// Gaussian Error Linear Unit (GELU) function with the tanh approximation used by ggml
+func GeluFP32(x float32) float32 {
+	const coefA = 0.044715
+	const sqrt2OverPi = 0.79788456080286535587989211986876
+	x64 := float64(x)
+	return float32(0.5 * x64 * (1.0 + math.Tanh(sqrt2OverPi*x64*(1.0+coefA*x64*x64))))
+}
+
+func VecGeluFP32(n uint32, y, x []float32) {
+	for i := uint32(0); i < n; i++ {
+		y[i] = GeluFP32(x[i])
+	}
+}
+
+// ggml_compute_forward_gelu
+func ComputeForwardGeluFP32(params *ComputeParams, src0, dst *Tensor) error {
+
+	if !src0.IsContiguous() {
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
+	}
+
+	if !dst.IsContiguous() {
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
+	}
+
+	if !AreSameShape(src0, dst) {
+		return fmt.Errorf("[src0] %v and [dst] %v: %w", src0.NE, dst.NE, ErrShapeMismatch)
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	ith := params.ith
+	nth := params.nth
+
+	nc := src0.NE[0]
+	nr := src0.Nrows()
+
+	// rows per thread
+	dr := (nr + nth - 1) / nth
+
+	// row range for this thread
+	ir0 := dr * ith
+	ir1 := uint32(min(int(ir0+dr), int(nr)))
+
+	for i1 := ir0; i1 < ir1; i1++ {
+		VecGeluFP32(nc, dst.Data[i1*dst.NB[1]/4:], src0.Data[i1*src0.NB[1]/4:])
+	}
+
+	return nil
+}
+
+// computeForwardUnaryFP32 applies vec to every row of [src0], rows are split between threads
+func computeForwardUnaryFP32(params *ComputeParams, src0, dst *Tensor, vec func(n uint32, y, x []float32)) error {
+
+	if !src0.IsContiguous() {
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
+	}
+
+	if !dst.IsContiguous() {
+		return fmt.Errorf("[dst] %w", ErrNotContiguous)
+	}
+
+	if !AreSameShape(src0, dst) {
+		return fmt.Errorf("[src0] %v and [dst] %v: %w", src0.NE, dst.NE, ErrShapeMismatch)
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	ith := params.ith
+	nth := params.nth
+
+	nc := src0.NE[0]
+	nr := src0.Nrows()
+
+	// rows per thread
+	dr := (nr + nth - 1) / nth
+
+	// row range for this thread
+	ir0 := dr * ith
+	ir1 := uint32(min(int(ir0+dr), int(nr)))
+
+	for i1 := ir0; i1 < ir1; i1++ {
+		vec(nc, dst.Data[i1*dst.NB[1]/4:], src0.Data[i1*src0.NB[1]/4:])
+	}
+
+	return nil
+}
+
+// ggml_vec_sqr_f32
+func VecSqrFP32(n uint32, y, x []float32) {
+	for i := uint32(0); i < n; i++ {
+		y[i] = x[i] * x[i]
+	}
+}
+
+// ggml_vec_sqrt_f32
+func VecSqrtFP32(n uint32, y, x []float32) {
+	for i := uint32(0); i < n; i++ {
+		y[i] = float32(math.Sqrt(float64(x[i])))
+	}
+}
+
+// ggml_vec_abs_f32
+func VecAbsFP32(n uint32, y, x []float32) {
+	for i := uint32(0); i < n; i++ {
+		y[i] = float32(math.Abs(float64(x[i])))
+	}
+}
+
+// ggml_vec_neg_f32
+func VecNegFP32(n uint32, y, x []float32) {
+	for i := uint32(0); i < n; i++ {
+		y[i] = -x[i]
+	}
+}
+
+// ggml_vec_relu_f32
+func VecReluFP32(n uint32, y, x []float32) {
+	for i := uint32(0); i < n; i++ {
+		if x[i] > 0 {
+			y[i] = x[i]
+		} else {
+			y[i] = 0
+		}
+	}
+}
+
+// ggml_compute_forward_sqr
+func ComputeForwardSqrFP32(params *ComputeParams, src0, dst *Tensor) error {
+	return computeForwardUnaryFP32(params, src0, dst, VecSqrFP32)
+}
+
+// ggml_compute_forward_sqrt
+func ComputeForwardSqrtFP32(params *ComputeParams, src0, dst *Tensor) error {
+	return computeForwardUnaryFP32(params, src0, dst, VecSqrtFP32)
+}
+
+// ggml_compute_forward_abs
+func ComputeForwardAbsFP32(params *ComputeParams, src0, dst *Tensor) error {
+	return computeForwardUnaryFP32(params, src0, dst, VecAbsFP32)
+}
+
+// ggml_compute_forward_neg
+func ComputeForwardNegFP32(params *ComputeParams, src0, dst *Tensor) error {
+	return computeForwardUnaryFP32(params, src0, dst, VecNegFP32)
+}
+
+// ggml_compute_forward_relu
+func ComputeForwardReluFP32(params *ComputeParams, src0, dst *Tensor) error {
+	return computeForwardUnaryFP32(params, src0, dst, VecReluFP32)
+}
+
+// ggml_compute_forward_mean
+// Rows of [src0] might be strided, but their values should be adjacent
+func ComputeForwardMeanFP32(params *ComputeParams, src0, dst *Tensor) error {
+
+	if src0.NB[0] != 4 {
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
+	}
+
+	if dst.NE[0] != 1 || dst.NE[1] != src0.NE[1] || dst.NE[2] != src0.NE[2] || dst.NE[3] != src0.NE[3] {
+		return fmt.Errorf("[src0] %v and [dst] %v: %w", src0.NE, dst.NE, ErrShapeMismatch)
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	ith := params.ith
+	nth := params.nth
+
+	ne00 := src0.NE[0]
+	ne01 := src0.NE[1]
+	ne02 := src0.NE[2]
+	nr := src0.Nrows()
+
+	// rows per thread
+	dr := (nr + nth - 1) / nth
+
+	// row range for this thread
+	ir0 := dr * ith
+	ir1 := uint32(min(int(ir0+dr), int(nr)))
+
+	for ir := ir0; ir < ir1; ir++ {
+
+		i03 := ir / (ne02 * ne01)
+		i02 := (ir - i03*ne02*ne01) / ne01
+		i01 := ir - i03*ne02*ne01 - i02*ne01
+
+		x := src0.Data[(i01*src0.NB[1]+i02*src0.NB[2]+i03*src0.NB[3])/4:]
+
+		sum := 0.0
+		for i00 := uint32(0); i00 < ne00; i00++ {
+			sum += float64(x[i00])
+		}
+
+		dst.Data[(i01*dst.NB[1]+i02*dst.NB[2]+i03*dst.NB[3])/4] = float32(sum / float64(ne00))
+	}
+
+	return nil
 }
 
 // ---
 
+// TokenType is the kind of vocab token, values are the same as in GGUF files
+type TokenType uint8
+
+const (
+	TOKEN_TYPE_UNDEFINED    TokenType = 0
+	TOKEN_TYPE_NORMAL       TokenType = 1
+	TOKEN_TYPE_UNKNOWN      TokenType = 2
+	TOKEN_TYPE_CONTROL      TokenType = 3
+	TOKEN_TYPE_USER_DEFINED TokenType = 4
+	TOKEN_TYPE_UNUSED       TokenType = 5
+	TOKEN_TYPE_BYTE         TokenType = 6
+)
+
 type TokenScore struct {
 	Token string
 	Score float32
+	Type  TokenType // TOKEN_TYPE_UNDEFINED for ggjt files which do not store types
 }
 
 type Vocab struct {
-	Size     uint32
-	Token2ID map[string]uint32
-	ID2Token []TokenScore
+	Size      uint32
+	Token2ID  map[string]uint32
+	ID2Token  []TokenScore
+	Tokenizer Tokenizer // nil means SentencePiece, which ggjt vocabs are made for
+
+	// Normalize changes the text before tokenization, TokenizeSpecial applies it to each text between special tokens
+	// Vocabs of model files have none, so callers add the leading space themselves
+	Normalize func(text string) string
+
+	// Prefix adds the leading space SentencePiece expects, only the text at the very start gets it,
+	// so there is no extra space after special tokens like [INST] or </s>
+	Prefix func(text string) string
+
+	// ids of special tokens, TOKEN_NONE when there is no such token
+	BOS uint32
+	EOS uint32
+	UNK uint32
+	PAD uint32
+
+	specials     map[byte][]uint32 // special tokens by the first byte of their text, the longest text first
+	specialsOnce sync.Once
 }
 
 func NewVocab(size uint32) *Vocab {
 	return &Vocab{
+		Size:     size,
 		Token2ID: make(map[string]uint32, size),
 		ID2Token: make([]TokenScore, size, size),
+		BOS:      TOKEN_BOS,
+		EOS:      TOKEN_EOS,
+		UNK:      TOKEN_UNK,
+		PAD:      TOKEN_NONE,
 	}
 }
 
+// NewLine returns the id of the new line token, both SentencePiece and byte-level vocabs keep it as the raw byte
+func (vocab *Vocab) NewLine() uint32 {
+	if id, ok := vocab.Token2ID["\n"]; ok {
+		return id
+	}
+	return NewLineToken
+}
+
+// IsSpecial tells whether the token is one of BOS, EOS or PAD tokens or a control or user-defined one
+// Only such tokens are matched by their text with TokenizeSpecial
+func (vocab *Vocab) IsSpecial(id uint32) bool {
+
+	if id >= uint32(len(vocab.ID2Token)) {
+		return false
+	}
+
+	if id == vocab.BOS || id == vocab.EOS || id == vocab.PAD {
+		return true
+	}
+
+	tokenType := vocab.ID2Token[id].Type
+	return tokenType == TOKEN_TYPE_CONTROL || tokenType == TOKEN_TYPE_USER_DEFINED
+}
+
+// special returns the id of the special token the text starts with, the longest one wins
+func (vocab *Vocab) special(text string) (uint32, int, bool) {
+
+	vocab.specialsOnce.Do(func() {
+		vocab.specials = make(map[byte][]uint32)
+		for id, token := range vocab.ID2Token {
+			if token.Token != "" && vocab.IsSpecial(uint32(id)) {
+				vocab.specials[token.Token[0]] = append(vocab.specials[token.Token[0]], uint32(id))
+			}
+		}
+		for _, ids := range vocab.specials {
+			sort.SliceStable(ids, func(i, j int) bool {
+				return len(vocab.ID2Token[ids[i]].Token) > len(vocab.ID2Token[ids[j]].Token)
+			})
+		}
+	})
+
+	for _, id := range vocab.specials[text[0]] {
+		if token := vocab.ID2Token[id].Token; strings.HasPrefix(text, token) {
+			return id, len(token), true
+		}
+	}
+
+	return 0, 0, false
+}
+
 func min(a, b int) int {
 	if a <= b {
 		return a
@@ -2708,35 +3661,67 @@ func utf8Len(src byte) uint32 {
 	return lookup[highbits]
 }
 
+// Token2Str returns the text of the token, byte tokens might be only a part of UTF-8 char
+// Use Detokenizer to get valid UTF-8 text out of the stream of tokens
 func Token2Str(vocab *Vocab, token uint32) string {
 	if int(token) >= len(vocab.ID2Token) {
 		return ""
 	}
 
-	return vocab.ID2Token[token].Token
-}
+	tokenScore := vocab.ID2Token[token]
+
+	switch tokenScore.Type {
 
-func PopMax(queue *[]Bigram) Bigram {
+	// control tokens like <s> and </s> have no text representation
+	case TOKEN_TYPE_CONTROL:
+		return ""
 
-	max := 0 // index of max score element in queue
-	for cur := 1; cur < len(*queue); cur++ {
-		if ((*queue)[max].Score < (*queue)[cur].Score) ||
-			((*queue)[max].Score == (*queue)[cur].Score &&
-				(*queue)[max].Left > (*queue)[cur].Left) {
-			max = cur
+	// loaders convert byte pieces like <0xE6> into raw bytes, but vocabs made elsewhere might keep them as is
+	case TOKEN_TYPE_BYTE:
+		piece := tokenScore.Token
+		if len(piece) == 6 && strings.HasPrefix(piece, "<0x") && piece[5] == '>' {
+			if b, err := strconv.ParseUint(piece[3:5], 16, 8); err == nil {
+				return string([]byte{byte(b)})
+			}
 		}
 	}
 
-	pop := (*queue)[max]
+	// the same for SentencePiece whitespace markers, byte-level BPE might have the very same char as a regular one
+	if _, bpe := vocab.Tokenizer.(*BPE); !bpe {
+		return strings.ReplaceAll(tokenScore.Token, "▁", " ")
+	}
+
+	return tokenScore.Token
+}
+
+// BigramQueue is the priority queue of bigrams for container/heap, the best score goes first
+// and the leftmost one among equal scores, so merges are the same whatever order bigrams were queued in
+type BigramQueue []Bigram
+
+func (queue BigramQueue) Len() int { return len(queue) }
+
+func (queue BigramQueue) Less(i, j int) bool {
+	return queue[i].Score > queue[j].Score ||
+		(queue[i].Score == queue[j].Score && queue[i].Left < queue[j].Left)
+}
 
-	// replace max element with last and shrink slice (if max == last, then just remove it)
-	(*queue)[max] = (*queue)[len(*queue)-1]
-	*queue = (*queue)[:len(*queue)-1]
+func (queue BigramQueue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
 
+func (queue *BigramQueue) Push(x interface{}) { *queue = append(*queue, x.(Bigram)) }
+
+func (queue *BigramQueue) Pop() interface{} {
+	last := len(*queue) - 1
+	pop := (*queue)[last]
+	*queue = (*queue)[:last]
 	return pop
 }
 
-func TryAddBigram(vocab *Vocab, symbols []Symbol, workQueue *[]Bigram, left, right int) {
+// PopMax removes the bigram with the best score from the queue
+func PopMax(queue *BigramQueue) Bigram {
+	return heap.Pop(queue).(Bigram)
+}
+
+func TryAddBigram(vocab *Vocab, symbols []Symbol, workQueue *BigramQueue, left, right int) {
 
 	if left == -1 || right == -1 {
 		return
@@ -2752,20 +3737,88 @@ func TryAddBigram(vocab *Vocab, symbols []Symbol, workQueue *[]Bigram, left, rig
 	tokenScore := vocab.ID2Token[id]
 
 	bigram := Bigram{Left: left, Right: right, Score: tokenScore.Score, Size: uint32(len(token))}
-	*workQueue = append(*workQueue, bigram)
+	heap.Push(workQueue, bigram)
 }
 
-const NewLineToken = 13 // ml.Tokenize(Ctx.Vocab, "\n", false)[0]
+const NewLineToken = 13 // ml.Tokenize(Ctx.Vocab, "\n", false)[0], use Vocab.NewLine for other vocabs
 
-// void tokenize(const std::string & text, std::vector<llama_vocab::id> & output) {
+// Tokenize splits text into tokens with the tokenizer of vocab, optionally starting with BOS
+// The text of special tokens like </s> is split into regular pieces, so the user text could never produce them
 func Tokenize(vocab *Vocab, text string, bos bool) []uint32 {
+	return tokenize(vocab, text, bos, false)
+}
+
+// TokenizeSpecial is the same as Tokenize, but the text of special tokens like </s> or [INST] becomes their ids
+// It's meant for trusted text like chat templates, the text of users should be tokenized with Tokenize
+func TokenizeSpecial(vocab *Vocab, text string, bos bool) []uint32 {
+	return tokenize(vocab, text, bos, true)
+}
+
+func tokenize(vocab *Vocab, text string, bos, special bool) []uint32 {
+
+	output := make([]uint32, 0)
+
+	if bos && vocab.BOS != TOKEN_NONE {
+		output = append(output, vocab.BOS)
+	}
+
+	var tokenizer Tokenizer = SentencePiece{}
+	if vocab.Tokenizer != nil {
+		tokenizer = vocab.Tokenizer
+	}
+
+	// the text between special tokens is normalized and tokenized on its own
+	fragment := func(text string, first bool) {
+		if vocab.Normalize != nil {
+			text = vocab.Normalize(text)
+		}
+		if first && vocab.Prefix != nil {
+			text = vocab.Prefix(text)
+		}
+		output = append(output, tokenizer.Tokenize(vocab, text)...)
+	}
+
+	start := 0
+	for i := 0; special && i < len(text); {
+		id, size, ok := vocab.special(text[i:])
+		if !ok {
+			i++
+			continue
+		}
+		if i > start {
+			fragment(text[start:i], start == 0)
+		}
+		output = append(output, id)
+		i += size
+		start = i
+	}
+
+	if start < len(text) || start == 0 {
+		fragment(text[start:], start == 0)
+	}
+
+	if DEBUG {
+		fmt.Printf("\n\n=== TOKENIZER ===\n\n%+v", output)
+		for i := 0; i < len(output); i++ {
+			fmt.Printf("%d:'%s'  ", output[i], Token2Str(vocab, output[i]))
+		}
+	}
+
+	return output
+}
+
+// SentencePiece is the tokenizer of LLaMA merging the pair of symbols with the best vocab score first
+type SentencePiece struct{}
+
+// void tokenize(const std::string & text, std::vector<llama_vocab::id> & output) {
+func (SentencePiece) Tokenize(vocab *Vocab, text string) []uint32 {
 
 	output := make([]uint32, 0)
-	symbols := make([]Symbol, 0)   // std::vector<llama_sp_symbol> symbols_;
-	workQueue := make([]Bigram, 0) // llama_sp_bigram::queue work_queue_; // std::priority_queue<llama_sp_bigram, queue_storage, comparator>;
+	symbols := make([]Symbol, 0)      // std::vector<llama_sp_symbol> symbols_;
+	workQueue := make(BigramQueue, 0) // llama_sp_bigram::queue work_queue_; // std::priority_queue<llama_sp_bigram, queue_storage, comparator>;
 
-	if bos {
-		output = append(output, 1) // TODO: replace with vocab.bos
+	if len(text) == 0 {
+		return output
 	}
 
 	// --- split string into utf8 chars
@@ -2827,8 +3880,12 @@ func Tokenize(vocab *Vocab, text string, bos bool) []uint32 {
 		if !ok {
 			// output any symbols that did not form tokens as bytes.
 			for j := uint32(0); j < symbol.N; j++ {
-				////llama_vocab::id token_id = static_cast<uint8_t>(symbol.text[j]) + 3;
-				tokenID := uint32(symbol.Text[j] + 3)
+				// byte tokens are kept as raw bytes, LLaMA has them right after <unk>, <s> and </s>
+				tokenID, ok := vocab.Token2ID[symbol.Text[j:j+1]]
+				if !ok {
+					////llama_vocab::id token_id = static_cast<uint8_t>(symbol.text[j]) + 3;
+					tokenID = uint32(symbol.Text[j]) + 3
+				}
 				output = append(output, tokenID)
 			}
 		} else {
@@ -2836,15 +3893,7 @@ func Tokenize(vocab *Vocab, text string, bos bool) []uint32 {
 		}
 	}
 
-	if DEBUG {
-		fmt.Printf("\n\n=== TOKENIZER ===\n\n%+v", output)
-		for i := 0; i < len(output); i++ {
-			fmt.Printf("%d:'%s'  ", output[i], Token2Str(vocab, output[i]))
-		}
-	}
-
 	return output
-
 }
 
 // TODO Do we need this?
@@ -2875,143 +3924,6 @@ func Init(params InitParams) {
 
 }
 
-// Allocator is an experimental memory pool for FP32 slices
-// TODO: Investigate https://github.com/valyala/bytebufferpool
-type Allocator struct {
-	sync.Mutex
-
-	// TODO: [][]float32 vs []*[]float32
-	// Used map[uint32][]*[]float32
-	// Free map[uint32][]*[]float32
-
-	PoolSize int
-	MemSize  int
-
-	Pool []byte
-	Mem  []byte
-}
-
-// TODO: Precompute max needed RAM size
-const MaxPool = 0 // 2_000_000_000
-const MaxMem = 0  // 28_000_000_000
-
-func NewAllocator() *Allocator {
-	return &Allocator{
-		// Used: make(map[uint32][]*[]float32),
-		// Free: make(map[uint32][]*[]float32),
-		Pool: make([]byte, MaxPool),
-		Mem:  make([]byte, MaxMem),
-	}
-}
-
-// Get new or reuse memory buffer of size bytes
-func (a *Allocator) Get(size uint32) *[]float32 {
-	//gcSlice := make([]float32, size, size)
-	//return &gcSlice
-
-	a.Lock()
-	byteSize := int(size * 4)
-
-	if a.PoolSize+byteSize >= MaxPool {
-		fmt.Printf("[ HALT ] Allocator go over free POOL MEM")
-		os.Exit(0)
-	}
-
-	cur := a.PoolSize
-	a.PoolSize += byteSize
-	a.Unlock()
-
-	var slice []float32
-	head := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-	head.Len = int(size)
-	head.Cap = int(size)
-	head.Data = uintptr(unsafe.Pointer(&a.Pool[cur]))
-
-	return &slice
-
-	/*
-		head := reflect.SliceHeader{
-			Len:  size,
-			Cap:  size,
-			Data: (*[]float32)(unsafe.Pointer(&a.Mem[cur])),
-		}*/
-
-	/*
-	   _, ok := a.Free[size]
-
-	   	if !ok {
-	   		a.Used[size] = make([]*[]float32, 0, 1024) // Which CAP default?
-	   		a.Free[size] = make([]*[]float32, 0, 1024) // Which CAP default?
-	   	}
-
-	   available := len(a.Free[size])
-
-	   	if available > 0 {
-	   		slice := a.Free[size][available-1]
-	   		a.Free[size] = a.Free[size][:available-1]
-	   		a.Used[size] = append(a.Used[size], slice)
-	   		return slice
-	   	}
-
-	   ///slice := make([]float32, size, size)
-	   a.Used[size] = append(a.Used[size], &slice)
-	   return &slice
-	*/
-}
-
-// Get fixed memory buffer of size bytes
-func (a *Allocator) GetFixed(size uint32) *[]float32 {
-	//gcSlice := make([]float32, size, size)
-	//return &gcSlice
-
-	a.Lock()
-	byteSize := int(size * 4)
-
-	if a.MemSize+byteSize >= MaxMem {
-		fmt.Printf("[ HALT ] Allocator go over free FIXED MEM")
-		os.Exit(0)
-	}
-
-	cur := a.MemSize
-	a.MemSize += byteSize
-	a.Unlock()
-
-	var slice []float32
-	head := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-	head.Len = int(size)
-	head.Cap = int(size)
-	head.Data = uintptr(unsafe.Pointer(&a.Mem[cur]))
-
-	return &slice
-
-	/*
-		head := reflect.SliceHeader{
-			Len:  size,
-			Cap:  size,
-			Data: (*[]float32)(unsafe.Pointer(&a.Mem[cur])),
-		}*/
-}
-
-func (a *Allocator) Reset() {
-	a.Lock()
-	a.PoolSize = 0
-	a.Unlock()
-	runtime.GC()
-
-	// var rtm runtime.MemStats
-	// runtime.ReadMemStats(&rtm)
-	// printMemStats("Start", rtm)
-
-	/*
-	   	for size, _ := range a.Used {
-	   		a.Free[size] = append(a.Free[size], a.Used[size]...)
-	   		a.Used[size] = a.Used[size][:0]
-	   	}
-
-	   fmt.Printf("")
-	*/
-}
-
 func printMemStats(message string, rtm runtime.MemStats) {
 	fmt.Println("\n===", message, "===")
 	fmt.Println("Mallocs: ", rtm.Mallocs)
@@ -3023,104 +3935,3 @@ func printMemStats(message string, rtm runtime.MemStats) {
 	fmt.Println("HeapObjects: ", rtm.HeapObjects)
 	fmt.Println("HeapAlloc: ", rtm.HeapAlloc)
 }
-
-/*
-// Release memory buffer back
-func (a *Allocator) Put(size uint32, slice []float32) {
-
-}
-
-// Release memory buffer back
-func (a Allocator) PutTensor(tensor *Tensor) {
-	size := tensor.NE[0] * tensor.NE[1] * tensor.NE[2] * tensor.NE[3]
-	_, ok := a.Pool[size]
-	if !ok {
-		a.Pool[size] = make([][]float32, 0, 64) // Which CAP default?
-	}
-	a.Pool[size] = append(a.Pool[size], tensor.Data)
-	tensor.Data = nil
-}
-*/
-
-/*
-func NewReusableTensor1D(ctx *Context, dt DType, ne0 uint32) *Tensor {
-	return NewTensor(ctx, dt, 1, ne0, 1, 1, 1, nil) // Reusable OK
-}
-
-func NewReusableTensor2D(ctx *Context, dt DType, ne0, ne1 uint32) *Tensor {
-	return NewTensor(ctx, dt, 2, ne0, ne1, 1, 1, nil) // Reusable OK
-}
-
-func NewReusableTensor3D(ctx *Context, dt DType, ne0, ne1, ne2 uint32) *Tensor {
-	return NewTensor(ctx, dt, 3, ne0, ne1, ne2, 1, nil) // Reusable OK
-}
-
-func NewFixedTensor1D(ctx *Context, dt DType, ne0 uint32) *Tensor {
-	return NewFixedTensor(ctx, dt, 1, ne0, 1, 1, 1, nil)
-}
-
-func NewFixedTensor2D(ctx *Context, dt DType, ne0, ne1 uint32) *Tensor {
-	return NewFixedTensor(ctx, dt, 2, ne0, ne1, 1, 1, nil)
-}
-*/
-/*
-// ggml_new_tensor_impl
-func NewReusableTensor(ctx *Context, dt DType, dims uint32, ne0, ne1, ne2, ne3 uint32, data []float32) *Tensor {
-
-	fmt.Printf("NewReusableTensor")
-	os.Exit(1)
-
-	// Reusable OK
-	if data == nil {
-		data = *ctx.Allocator.Get(ne0 * ne1 * ne2 * ne3)
-	}
-
-	//if data == nil {
-	//	total := ne0 * ne1 * ne2 * ne3
-	//	data = make([]float32, total, total)
-	//}
-
-	return &Tensor{
-		Type:     dt,
-		Reusable: true,
-		Dims:     dims,
-		NE:       [4]uint32{ne0, ne1, ne2, ne3},
-		NB:       [4]uint32{4, ne0 * 4, ne0 * ne1 * 4, ne0 * ne1 * ne2 * 4},
-		op:       OP_NONE,
-		Data:     data,
-	}
-}
-*/
-/*
-// ggml_new_tensor_impl
-func NewFixedTensor(ctx *Context, dt DType, dims uint32, ne0, ne1, ne2, ne3 uint32, data []float32) *Tensor {
-
-	fmt.Printf("NewFixedTensor")
-	os.Exit(1)
-
-	// TODO: Check allowed data types on graph creation
-	//if dt != TYPE_F32 && dt != TYPE_I32 {
-	//	fmt.Printf("\n[ERROR] NewTensorImpl got not supported type : %d", dt)
-	//	os.Exit(1)
-	//}
-
-	////ggml_assert_aligned(result);
-
-	if data == nil {
-		total := ne0 * ne1 * ne2 * ne3
-		data = make([]float32, total, total)
-
-		// Reusable OK ???
-		// data = *ctx.Allocator.GetFixed(ne0 * ne1 * ne2 * ne3)
-	}
-
-	return &Tensor{
-		Type: dt,
-		Dims: dims,
-		NE:   [4]uint32{ne0, ne1, ne2, ne3},
-		NB:   [4]uint32{4, ne0 * 4, ne0 * ne1 * 4, ne0 * ne1 * ne2 * 4},
-		op:   OP_NONE,
-		Data: data,
-	}
-}
-*/
@@ -0,0 +1,212 @@
+package ml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// thread counts to compute with, 8 threads get fewer rows than others or none at all
+var testThreads = []int{1, 3, 8}
+
+// randTensor creates FP32 tensor of random values within [-2, 2]
+func randTensor(rnd *rand.Rand, dims, ne0, ne1, ne2, ne3 uint32) *Tensor {
+	tensor := NewTensor(nil, TYPE_F32, dims, ne0, ne1, ne2, ne3, nil)
+	for i := range tensor.Data {
+		tensor.Data[i] = rnd.Float32()*4 - 2
+	}
+	return tensor
+}
+
+// at returns the value of the tensor at the given indices following its strides
+func at(tensor *Tensor, i0, i1, i2, i3 uint32) float32 {
+	return tensor.Data[(i0*tensor.NB[0]+i1*tensor.NB[1]+i2*tensor.NB[2]+i3*tensor.NB[3])/4]
+}
+
+// computeTensor builds the graph of the tensor and computes it with threads of the context
+func computeTensor(ctx *Context, tensor *Tensor) error {
+	graph := &Graph{}
+	BuildForwardExpand(graph, tensor)
+	return GraphCompute(ctx, graph)
+}
+
+// checkValues compares the contiguous result with values expected at each index
+func checkValues(t *testing.T, result *Tensor, want func(i0, i1, i2, i3 uint32) float32) {
+	t.Helper()
+	for i3 := uint32(0); i3 < result.NE[3]; i3++ {
+		for i2 := uint32(0); i2 < result.NE[2]; i2++ {
+			for i1 := uint32(0); i1 < result.NE[1]; i1++ {
+				for i0 := uint32(0); i0 < result.NE[0]; i0++ {
+					got, want := at(result, i0, i1, i2, i3), want(i0, i1, i2, i3)
+					if math.Float32bits(got) != math.Float32bits(want) {
+						t.Fatalf("value [%d, %d, %d, %d] is %v, want %v", i0, i1, i2, i3, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestUnaryOps(t *testing.T) {
+
+	for _, test := range []struct {
+		name string
+		op   func(ctx *Context, a *Tensor) *Tensor
+		want func(x float32) float32
+	}{
+		{"Sqr", Sqr, func(x float32) float32 { return x * x }},
+		{"Sqrt", Sqrt, func(x float32) float32 { return float32(math.Sqrt(float64(x))) }},
+		{"Abs", Abs, func(x float32) float32 { return float32(math.Abs(float64(x))) }},
+		{"Neg", Neg, func(x float32) float32 { return -x }},
+		{"Relu", Relu, func(x float32) float32 { return float32(math.Max(float64(x), 0)) }},
+		{"SqrInplace", SqrInplace, func(x float32) float32 { return x * x }},
+		{"NegInplace", NegInplace, func(x float32) float32 { return -x }},
+	} {
+		for _, nth := range testThreads {
+			t.Run(fmt.Sprintf("%s/%d", test.name, nth), func(t *testing.T) {
+
+				rnd := rand.New(rand.NewSource(1))
+				ctx := NewContext(nth, false, false)
+
+				a := randTensor(rnd, 3, 13, 7, 3, 1)
+				src := DupTensor(ctx, a)
+				copy(src.Data, a.Data)
+
+				result := test.op(ctx, a)
+				if err := computeTensor(ctx, result); err != nil {
+					t.Fatal(err)
+				}
+
+				checkValues(t, result, func(i0, i1, i2, i3 uint32) float32 {
+					return test.want(at(src, i0, i1, i2, i3))
+				})
+			})
+		}
+	}
+}
+
+func TestMean(t *testing.T) {
+
+	for _, test := range []struct {
+		name string
+		src  func(ctx *Context, a *Tensor) *Tensor
+	}{
+		{"Contiguous", func(ctx *Context, a *Tensor) *Tensor { return a }},
+		{"StridedRows", func(ctx *Context, a *Tensor) *Tensor { return View2D(ctx, a, 9, a.NE[1], a.NB[1], 2) }},
+		{"Permuted", func(ctx *Context, a *Tensor) *Tensor { return Permute(ctx, a, 0, 2, 1, 3) }},
+	} {
+		for _, nth := range testThreads {
+			t.Run(fmt.Sprintf("%s/%d", test.name, nth), func(t *testing.T) {
+
+				rnd := rand.New(rand.NewSource(1))
+				ctx := NewContext(nth, false, false)
+
+				src := test.src(ctx, randTensor(rnd, 3, 13, 7, 3, 1))
+
+				result := Mean(ctx, src)
+				if err := computeTensor(ctx, result); err != nil {
+					t.Fatal(err)
+				}
+
+				if result.NE != [4]uint32{1, src.NE[1], src.NE[2], src.NE[3]} {
+					t.Fatalf("result %v for [src] %v", result.NE, src.NE)
+				}
+
+				checkValues(t, result, func(_, i1, i2, i3 uint32) float32 {
+					sum := 0.0
+					for i0 := uint32(0); i0 < src.NE[0]; i0++ {
+						sum += float64(at(src, i0, i1, i2, i3))
+					}
+					return float32(sum / float64(src.NE[0]))
+				})
+			})
+		}
+	}
+}
+
+func TestDup(t *testing.T) {
+
+	for _, test := range []struct {
+		name string
+		src  func(ctx *Context, a *Tensor) *Tensor
+	}{
+		{"Contiguous", func(ctx *Context, a *Tensor) *Tensor { return a }},
+		{"Transposed", func(ctx *Context, a *Tensor) *Tensor { return Transpose(ctx, View2D(ctx, a, 13, 21, a.NB[1], 0)) }},
+		{"Permuted", func(ctx *Context, a *Tensor) *Tensor { return Permute(ctx, a, 2, 0, 1, 3) }},
+		{"StridedRows", func(ctx *Context, a *Tensor) *Tensor { return View2D(ctx, a, 9, a.NE[1], a.NB[1], 2) }},
+	} {
+		for _, nth := range testThreads {
+			t.Run(fmt.Sprintf("%s/%d", test.name, nth), func(t *testing.T) {
+
+				rnd := rand.New(rand.NewSource(1))
+				ctx := NewContext(nth, false, false)
+
+				src := test.src(ctx, randTensor(rnd, 3, 13, 7, 3, 1))
+
+				result := Dup(ctx, src)
+				if err := computeTensor(ctx, result); err != nil {
+					t.Fatal(err)
+				}
+
+				if result.NE != src.NE || !result.IsContiguous() {
+					t.Fatalf("result %v with strides %v for [src] %v", result.NE, result.NB, src.NE)
+				}
+
+				checkValues(t, result, func(i0, i1, i2, i3 uint32) float32 {
+					return at(src, i0, i1, i2, i3)
+				})
+			})
+		}
+	}
+}
+
+func TestOpErrors(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+
+	matrix := randTensor(rnd, 2, 13, 7, 1, 1)
+	kernel := randTensor(rnd, 3, 3, 4, 6, 1)
+	input := randTensor(rnd, 2, 17, 4, 1, 1)
+
+	for _, test := range []struct {
+		name  string
+		op    func(ctx *Context) *Tensor
+		err   error
+		built bool // the constructor records the error before anything is computed
+	}{
+		{"SqrTransposed", func(ctx *Context) *Tensor { return Sqr(ctx, Transpose(ctx, matrix)) }, ErrNotContiguous, false},
+		{"ReluTransposed", func(ctx *Context) *Tensor { return Relu(ctx, Transpose(ctx, matrix)) }, ErrNotContiguous, false},
+		{"MeanTransposed", func(ctx *Context) *Tensor { return Mean(ctx, Transpose(ctx, matrix)) }, ErrNotContiguous, false},
+		{"Conv1DTransposed", func(ctx *Context) *Tensor {
+			return Conv1D1S(ctx, kernel, Transpose(ctx, randTensor(rnd, 2, 4, 17, 1, 1)))
+		}, ErrNotContiguous, false},
+		{"Conv1DEvenKernel", func(ctx *Context) *Tensor {
+			return Conv1D1S(ctx, randTensor(rnd, 3, 4, 4, 6, 1), input)
+		}, ErrShapeMismatch, true},
+		{"Conv1DChannels", func(ctx *Context) *Tensor {
+			return Conv1D2S(ctx, kernel, randTensor(rnd, 2, 17, 5, 1, 1))
+		}, ErrShapeMismatch, true},
+		{"Conv1DInput3D", func(ctx *Context) *Tensor {
+			return Conv1D1S(ctx, kernel, randTensor(rnd, 3, 17, 4, 2, 1))
+		}, ErrShapeMismatch, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+
+			ctx := NewContext(2, false, false)
+
+			result := test.op(ctx)
+			if test.built && !errors.Is(result.err, test.err) {
+				t.Errorf("constructor error %v, want %v", result.err, test.err)
+			}
+
+			err := computeTensor(ctx, result)
+
+			var opErr *OpError
+			if !errors.As(err, &opErr) || !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want *OpError of %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package ml
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Operations for sparse mixture-of-experts layers like the ones of Mixtral
+// The router picks a few experts for each token with TopK, Gather collects their router values
+// and MulMatID multiplies every token by the weights of the expert chosen for it
+
+// TopK returns [k, rows] tensor with indices of k largest values within each row of [a], the largest first
+// Indices are kept as float32 values of TYPE_I32 tensor the same way other integer params are
+func TopK(ctx *Context, a *Tensor, k uint32) *Tensor {
+
+	result := newNode(ctx, TYPE_I32, 2, k, a.Nrows(), 1, 1)
+
+	result.op = OP_TOP_K
+	result.grad = nil
+	result.src0 = a
+	result.src1 = nil
+
+	return result
+}
+
+// Gather returns the tensor of [ids] shape with values of [a] from the same row at columns given by [ids]
+func Gather(ctx *Context, a, ids *Tensor) *Tensor {
+
+	result := newNode(ctx, TYPE_F32, 2, ids.NE[0], ids.NE[1], 1, 1)
+
+	result.op = OP_GATHER
+	result.grad = nil
+	result.src0 = a
+	result.src1 = ids
+
+	return result
+}
+
+// MulMatID multiplies each column of [b] by the matrix of [as] selected for it by [ids]
+// The matrix index for the column j is taken from the row [slot] of ids column j, like TopK returns them
+// All matrices should be of the same shape, the result is [as[0].NE[1], b.NE[1]]
+func MulMatID(ctx *Context, as []*Tensor, ids *Tensor, slot uint32, b *Tensor) *Tensor {
+
+	result := newNode(ctx, TYPE_F32, 2, as[0].NE[1], b.NE[1], 1, 1)
+
+	result.op = OP_MUL_MAT_ID
+	result.grad = nil
+	result.src0 = ids
+	result.src1 = b
+	result.srcs = as
+
+	// the slot is a param like the ones of Rope
+	result.opt[0] = NewFP32(ctx, float32(slot))
+
+	// columns of one matrix are gathered into the input and multiplied into the output,
+	// both are large enough for all columns and take the memory only while the node is computed
+	input := newNode(ctx, TYPE_F32, 2, b.NE[0], b.NE[1], 1, 1)
+	output := newNode(ctx, TYPE_F32, 2, as[0].NE[1], b.NE[1], 1, 1)
+	output.op = OP_MUL_MAT
+	output.src1 = input
+	result.scratch = []*Tensor{input, output}
+
+	return result
+}
+
+// ComputeForwardTopK sorts each row of [src0] keeping k indices of the largest values
+func ComputeForwardTopK(params *ComputeParams, src0, dst *Tensor) error {
+
+	if !src0.IsContiguous() {
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
+	}
+
+	if dst.NE[0] > src0.NE[0] {
+		return fmt.Errorf("top %d of %d values: %w", dst.NE[0], src0.NE[0], ErrShapeMismatch)
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	nc := src0.NE[0]
+	k := dst.NE[0]
+
+	indices := make([]int, nc)
+
+	for row := uint32(0); row < src0.Nrows(); row++ {
+
+		x := src0.Data[row*nc : row*nc+nc]
+
+		for i := range indices {
+			indices[i] = i
+		}
+
+		// stable, so among equal values the first one wins
+		sort.SliceStable(indices, func(i, j int) bool {
+			return x[indices[i]] > x[indices[j]]
+		})
+
+		for i := uint32(0); i < k; i++ {
+			dst.Data[row*k+i] = float32(indices[i])
+		}
+	}
+
+	return nil
+}
+
+// ComputeForwardGather picks values of [src0] rows by the indices from the same rows of [src1]
+func ComputeForwardGather(params *ComputeParams, src0, src1, dst *Tensor) error {
+
+	if !src0.IsContiguous() {
+		return fmt.Errorf("[src0] %w", ErrNotContiguous)
+	}
+
+	if src0.Nrows() != src1.Nrows() {
+		return fmt.Errorf("[src0] %v and [src1] %v rows: %w", src0.NE, src1.NE, ErrShapeMismatch)
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	nc := src0.NE[0]
+	k := src1.NE[0]
+
+	for row := uint32(0); row < src1.Nrows(); row++ {
+		for i := uint32(0); i < k; i++ {
+			col := uint32(src1.Data[row*src1.NB[1]/4+i])
+			if col >= nc {
+				return fmt.Errorf("index %d of row with %d values: %w", col, nc, ErrShapeMismatch)
+			}
+			dst.Data[row*k+i] = src0.Data[row*nc+col]
+		}
+	}
+
+	return nil
+}
+
+// ComputeForwardMulMatID groups columns of [src1] by the chosen matrix, so each matrix is multiplied only once
+// by all of its columns with the usual MUL_MAT split between Job threads, then results are scattered back
+func ComputeForwardMulMatID(ctx *Context, params *ComputeParams, tensor *Tensor) error {
+
+	ids := tensor.src0
+	src1 := tensor.src1
+	as := tensor.srcs
+
+	slot := uint32(tensor.opt[0].Data[0])
+
+	if slot >= ids.NE[0] || ids.NE[1] != src1.NE[1] {
+		return fmt.Errorf("[ids] %v for slot %d and [src1] %v: %w", ids.NE, slot, src1.NE, ErrShapeMismatch)
+	}
+
+	if !src1.IsContiguous() {
+		return fmt.Errorf("[src1] %w", ErrNotContiguous)
+	}
+
+	for _, a := range as {
+		if a.Type != TYPE_F32 && !IsQuantized(a.Type) {
+			return fmt.Errorf("[srcs] %w", ErrUnsupportedDType)
+		}
+		if a.NE != as[0].NE || a.NE[0] != src1.NE[0] {
+			return fmt.Errorf("[srcs] %v and [src1] %v: %w", a.NE, src1.NE, ErrShapeMismatch)
+		}
+	}
+
+	if params.Type == TASK_INIT || params.Type == TASK_FINALIZE {
+		return nil
+	}
+
+	ne10 := src1.NE[0]
+	ne01 := as[0].NE[1]
+	cols := src1.NE[1]
+
+	// the column j goes to the matrix id(j)
+	id := func(j uint32) int {
+		return int(ids.Data[j*ids.NB[1]/4+slot])
+	}
+
+	for j := uint32(0); j < cols; j++ {
+		if id(j) < 0 || id(j) >= len(as) {
+			return fmt.Errorf("matrix %d of %d: %w", id(j), len(as), ErrShapeMismatch)
+		}
+	}
+
+	input := tensor.scratch[0]
+	output := tensor.scratch[1]
+
+	for i := range as {
+
+		// --- columns of the matrix are copied together
+
+		count := uint32(0)
+		for j := uint32(0); j < cols; j++ {
+			if id(j) == i {
+				copy(input.Data[count*ne10:], src1.Data[j*ne10:j*ne10+ne10])
+				count++
+			}
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		setRows(input, count)
+		setRows(output, count)
+		output.src0 = as[i]
+
+		if err := ComputeJobs(ctx, output, ctx.MaxThreads); err != nil {
+			return err
+		}
+
+		// --- and results are scattered back
+
+		count = 0
+		for j := uint32(0); j < cols; j++ {
+			if id(j) == i {
+				copy(tensor.Data[j*ne01:j*ne01+ne01], output.Data[count*ne01:])
+				count++
+			}
+		}
+	}
+
+	return nil
+}
+
+// setRows makes the contiguous 2D tensor of the given rows count over the first ones of its Data
+func setRows(tensor *Tensor, rows uint32) {
+	tensor.NE[1] = rows
+	tensor.NB[2] = tensor.NB[1] * rows
+	tensor.NB[3] = tensor.NB[2]
+}
@@ -0,0 +1,344 @@
+package ml
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// Quantized tensors keep their data within Tensor.Blocks as the sequence of blocks
+// of QK elements each. The layout of blocks is the same as ggjt v1 files use,
+// so the data might be read from disk as is:
+//
+// block_q4_0 : float32 d; uint8 qs[QK/2]
+//   x[i] = d * (q[i] - 8)
+//
+// block_q4_1 : float32 d; float32 m; uint8 qs[QK/2]
+//   x[i] = d * q[i] + m
+//
+// block_q8_0 : float32 d; int8 qs[QK]
+//   x[i] = d * q[i]
+//
+// Two 4-bit values are packed into each byte of qs, even elements go into lower nibbles
+
+// IsQuantized reports whether the data type is stored as blocks of quantized values
+func IsQuantized(dt DType) bool {
+	return dt < TYPE_COUNT && BLCK_SIZE[dt] > 1
+}
+
+// QuantizeRowQ4_0 converts len(x) FP32 values into Q4_0 blocks stored to y
+func QuantizeRowQ4_0(x []float32, y []byte) {
+	blocks := len(x) / QK
+	for i := 0; i < blocks; i++ {
+		src := x[i*QK : i*QK+QK]
+		block := y[i*(4+QK/2) : (i+1)*(4+QK/2)]
+
+		amax := float32(0.0) // absolute max
+		for _, v := range src {
+			amax = maxFloat(amax, float32(math.Abs(float64(v))))
+		}
+
+		d := amax / ((1 << 3) - 1)
+		id := float32(0.0)
+		if d != 0 {
+			id = 1.0 / d
+		}
+
+		binary.LittleEndian.PutUint32(block, math.Float32bits(d))
+		for j := 0; j < QK/2; j++ {
+			vi0 := uint8(int8(roundFloat(src[2*j]*id)) + 8)
+			vi1 := uint8(int8(roundFloat(src[2*j+1]*id)) + 8)
+			block[4+j] = vi0 | vi1<<4
+		}
+	}
+}
+
+// QuantizeRowQ4_1 converts len(x) FP32 values into Q4_1 blocks stored to y
+func QuantizeRowQ4_1(x []float32, y []byte) {
+	blocks := len(x) / QK
+	for i := 0; i < blocks; i++ {
+		src := x[i*QK : i*QK+QK]
+		block := y[i*(8+QK/2) : (i+1)*(8+QK/2)]
+
+		min := float32(math.MaxFloat32)
+		max := float32(-math.MaxFloat32)
+		for _, v := range src {
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+
+		d := (max - min) / ((1 << 4) - 1)
+		id := float32(0.0)
+		if d != 0 {
+			id = 1.0 / d
+		}
+
+		binary.LittleEndian.PutUint32(block, math.Float32bits(d))
+		binary.LittleEndian.PutUint32(block[4:], math.Float32bits(min))
+		for j := 0; j < QK/2; j++ {
+			vi0 := uint8(roundFloat((src[2*j] - min) * id))
+			vi1 := uint8(roundFloat((src[2*j+1] - min) * id))
+			block[8+j] = vi0 | vi1<<4
+		}
+	}
+}
+
+// QuantizeRowQ8_0 converts len(x) FP32 values into Q8_0 blocks stored to y
+func QuantizeRowQ8_0(x []float32, y []byte) {
+	blocks := len(x) / QK
+	for i := 0; i < blocks; i++ {
+		src := x[i*QK : i*QK+QK]
+		block := y[i*(4+QK) : (i+1)*(4+QK)]
+
+		amax := float32(0.0) // absolute max
+		for _, v := range src {
+			amax = maxFloat(amax, float32(math.Abs(float64(v))))
+		}
+
+		d := amax / ((1 << 7) - 1)
+		id := float32(0.0)
+		if d != 0 {
+			id = 1.0 / d
+		}
+
+		binary.LittleEndian.PutUint32(block, math.Float32bits(d))
+		for j := 0; j < QK; j++ {
+			block[4+j] = uint8(int8(roundFloat(src[j] * id)))
+		}
+	}
+}
+
+// QuantizeRow converts FP32 values into quantized blocks of any supported type
+func QuantizeRow(dt DType, x []float32, y []byte) error {
+	switch dt {
+	case TYPE_Q4_0:
+		QuantizeRowQ4_0(x, y)
+	case TYPE_Q4_1:
+		QuantizeRowQ4_1(x, y)
+	case TYPE_Q8_0:
+		QuantizeRowQ8_0(x, y)
+	default:
+		return fmt.Errorf("quantize row of type %d: %w", dt, ErrUnsupportedDType)
+	}
+	return nil
+}
+
+// roundFloat rounds half away from zero like roundf() from C
+func roundFloat(x float32) float32 {
+	return float32(math.Round(float64(x)))
+}
+
+// DequantizeRowQ4_0 converts Q4_0 blocks from x into len(y) FP32 values
+func DequantizeRowQ4_0(x []byte, y []float32) {
+	blocks := len(y) / QK
+	for i := 0; i < blocks; i++ {
+		block := x[i*(4+QK/2) : (i+1)*(4+QK/2)]
+		d := math.Float32frombits(binary.LittleEndian.Uint32(block))
+		qs := block[4:]
+		out := y[i*QK : i*QK+QK]
+		for j := 0; j < QK/2; j++ {
+			out[2*j] = float32(int8(qs[j]&0x0F)-8) * d
+			out[2*j+1] = float32(int8(qs[j]>>4)-8) * d
+		}
+	}
+}
+
+// DequantizeRowQ4_1 converts Q4_1 blocks from x into len(y) FP32 values
+func DequantizeRowQ4_1(x []byte, y []float32) {
+	blocks := len(y) / QK
+	for i := 0; i < blocks; i++ {
+		block := x[i*(8+QK/2) : (i+1)*(8+QK/2)]
+		d := math.Float32frombits(binary.LittleEndian.Uint32(block))
+		m := math.Float32frombits(binary.LittleEndian.Uint32(block[4:]))
+		qs := block[8:]
+		out := y[i*QK : i*QK+QK]
+		for j := 0; j < QK/2; j++ {
+			out[2*j] = float32(qs[j]&0x0F)*d + m
+			out[2*j+1] = float32(qs[j]>>4)*d + m
+		}
+	}
+}
+
+// DequantizeRowQ8_0 converts Q8_0 blocks from x into len(y) FP32 values
+func DequantizeRowQ8_0(x []byte, y []float32) {
+	blocks := len(y) / QK
+	for i := 0; i < blocks; i++ {
+		block := x[i*(4+QK) : (i+1)*(4+QK)]
+		d := math.Float32frombits(binary.LittleEndian.Uint32(block))
+		qs := block[4:]
+		out := y[i*QK : i*QK+QK]
+		for j := 0; j < QK; j++ {
+			out[j] = float32(int8(qs[j])) * d
+		}
+	}
+}
+
+// DequantizeRow converts quantized blocks of any supported type into FP32 values
+func DequantizeRow(dt DType, x []byte, y []float32) error {
+	switch dt {
+	case TYPE_Q4_0:
+		DequantizeRowQ4_0(x, y)
+	case TYPE_Q4_1:
+		DequantizeRowQ4_1(x, y)
+	case TYPE_Q8_0:
+		DequantizeRowQ8_0(x, y)
+	default:
+		return fmt.Errorf("dequantize row of type %d: %w", dt, ErrUnsupportedDType)
+	}
+	return nil
+}
+
+// VecDotQ4_0FP32 computes dot product of n values stored as Q4_0 blocks in x and FP32 vector y
+func VecDotQ4_0FP32(n uint32, x []byte, y []float32) float32 {
+	sumf := float32(0.0)
+	blocks := int(n / QK)
+	for i := 0; i < blocks; i++ {
+		block := x[i*(4+QK/2) : (i+1)*(4+QK/2)]
+		d := math.Float32frombits(binary.LittleEndian.Uint32(block))
+		qs := block[4:]
+		yb := y[i*QK : i*QK+QK]
+		sum := float32(0.0)
+		for j := 0; j < QK/2; j++ {
+			sum += float32(int8(qs[j]&0x0F)-8)*yb[2*j] + float32(int8(qs[j]>>4)-8)*yb[2*j+1]
+		}
+		sumf += d * sum
+	}
+	return sumf
+}
+
+// VecDotQ4_1FP32 computes dot product of n values stored as Q4_1 blocks in x and FP32 vector y
+func VecDotQ4_1FP32(n uint32, x []byte, y []float32) float32 {
+	sumf := float32(0.0)
+	blocks := int(n / QK)
+	for i := 0; i < blocks; i++ {
+		block := x[i*(8+QK/2) : (i+1)*(8+QK/2)]
+		d := math.Float32frombits(binary.LittleEndian.Uint32(block))
+		m := math.Float32frombits(binary.LittleEndian.Uint32(block[4:]))
+		qs := block[8:]
+		yb := y[i*QK : i*QK+QK]
+		sumq := float32(0.0)
+		sumy := float32(0.0)
+		for j := 0; j < QK/2; j++ {
+			y0, y1 := yb[2*j], yb[2*j+1]
+			sumq += float32(qs[j]&0x0F)*y0 + float32(qs[j]>>4)*y1
+			sumy += y0 + y1
+		}
+		sumf += d*sumq + m*sumy
+	}
+	return sumf
+}
+
+// VecDotQ8_0FP32 computes dot product of n values stored as Q8_0 blocks in x and FP32 vector y
+func VecDotQ8_0FP32(n uint32, x []byte, y []float32) float32 {
+	sumf := float32(0.0)
+	blocks := int(n / QK)
+	for i := 0; i < blocks; i++ {
+		block := x[i*(4+QK) : (i+1)*(4+QK)]
+		d := math.Float32frombits(binary.LittleEndian.Uint32(block))
+		qs := block[4:]
+		yb := y[i*QK : i*QK+QK]
+		sum := float32(0.0)
+		for j := 0; j < QK; j += 4 {
+			sum += float32(int8(qs[j]))*yb[j] + float32(int8(qs[j+1]))*yb[j+1] +
+				float32(int8(qs[j+2]))*yb[j+2] + float32(int8(qs[j+3]))*yb[j+3]
+		}
+		sumf += d * sum
+	}
+	return sumf
+}
+
+// ComputeForwardMulMat selects the matrix multiplication kernel by the type of [src0]
+// [src1] and [dst] are always FP32 there, types are checked by ComputeForward before jobs are sent
+func ComputeForwardMulMat(params *ComputeParams, src0, src1, dst *Tensor) error {
+	switch src0.Type {
+	case TYPE_F32:
+		ComputeForwardMulMatFP32(params, src0, src1, dst)
+	case TYPE_Q4_0, TYPE_Q4_1, TYPE_Q8_0:
+		ComputeForwardMulMatQ(params, src0, src1, dst)
+	default:
+		return fmt.Errorf("[src0] of type %d: %w", src0.Type, ErrUnsupportedDType)
+	}
+	return nil
+}
+
+// ComputeForwardMulMatQ multiplies quantized [src0] with FP32 [src1]
+// Each row of [src0] is dot-producted directly from its blocks without dequantization
+// Q8_0 rows are processed with x64 AVX2 or ARM NEON code when it's enabled
+func ComputeForwardMulMatQ(params *ComputeParams, src0, src1, dst *Tensor) {
+
+	var vecDot func(n uint32, x []byte, y []float32) float32
+	switch src0.Type {
+	case TYPE_Q4_0:
+		vecDot = VecDotQ4_0FP32
+	case TYPE_Q4_1:
+		vecDot = VecDotQ4_1FP32
+	case TYPE_Q8_0:
+		vecDot = VecDotQ8_0FP32
+	}
+
+	useSIMD := (params.UseAVX || params.UseNEON) && src0.Type == TYPE_Q8_0
+
+	ne00 := src0.NE[0]
+	ne01 := src0.NE[1]
+	ne02 := src0.NE[2]
+	ne03 := src0.NE[3]
+
+	ne11 := src1.NE[1]
+	ne12 := src1.NE[2]
+	ne13 := src1.NE[3]
+
+	// strides of quantized [src0] are in bytes and used to index Blocks,
+	// while FP32 strides of [src1] and [dst] are converted into float offsets
+
+	nb01 := src0.NB[1]
+	nb02 := src0.NB[2]
+	nb03 := src0.NB[3]
+
+	nb11 := src1.NB[1] / 4
+	nb12 := src1.NB[2] / 4
+	nb13 := src1.NB[3] / 4
+
+	nb0 := dst.NB[0] / 4
+	nb1 := dst.NB[1] / 4
+	nb2 := dst.NB[2] / 4
+	nb3 := dst.NB[3] / 4
+
+	// each src0 matrix is broadcasted over r2 x r3 matrices of src1
+	r2 := ne12 / ne02
+	r3 := ne13 / ne03
+
+	nr := ne01 * ne12 * ne13                 // total rows in src0 including broadcasted ones
+	dr := (nr + params.nth - 1) / params.nth // rows per thread
+	ir0 := dr * params.ith                   // row range...
+	ir1 := min32(ir0+dr, nr)                 // ...for this thread
+
+	mult := ne12 * ne01
+	for ir := ir0; ir < ir1; ir++ {
+
+		i13 := ir / mult
+		diff := ir - i13*mult
+		i12 := diff / ne01
+		i01 := diff - i12*ne01
+
+		src0Row := src0.Blocks[i01*nb01+(i12/r2)*nb02+(i13/r3)*nb03:]
+
+		for ic := uint32(0); ic < ne11; ic++ {
+			src1Offset := ic*nb11 + i12*nb12 + i13*nb13
+			dstOffset := i01*nb0 + ic*nb1 + i12*nb2 + i13*nb3
+			if useSIMD {
+				vdot_q8(
+					unsafe.Pointer(&src0Row[0]),
+					unsafe.Pointer(&src1.Data[src1Offset]),
+					uint64(ne00),
+					unsafe.Pointer(&dst.Data[dstOffset]))
+			} else {
+				dst.Data[dstOffset] = vecDot(ne00, src0Row, src1.Data[src1Offset:])
+			}
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package ml
+
+import (
+	"container/heap"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer splits the text into ids of vocab tokens
+// SentencePiece is the one of LLaMA, BPE is byte-level one of GPT-2 and models trained the same way
+type Tokenizer interface {
+	Tokenize(vocab *Vocab, text string) []uint32
+}
+
+// Detokenizer turns the stream of tokens back into text
+// Byte tokens might hold only a part of UTF-8 char, so such bytes are kept until the char is complete,
+// thus every chunk returned is valid UTF-8 text which is safe to stream to clients
+type Detokenizer struct {
+	vocab   *Vocab
+	pending []byte // bytes of incomplete char
+}
+
+func NewDetokenizer(vocab *Vocab) *Detokenizer {
+	return &Detokenizer{vocab: vocab}
+}
+
+// Decode adds the token and returns the text ready to be shown, it's empty while the char is incomplete
+func (d *Detokenizer) Decode(token uint32) string {
+
+	d.pending = append(d.pending, Token2Str(d.vocab, token)...)
+
+	// look for the start of the last char within the longest UTF-8 sequence
+	end := len(d.pending)
+	for i := len(d.pending) - 1; i >= 0 && i >= len(d.pending)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(d.pending[i]) {
+			if !utf8.FullRune(d.pending[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+
+	text := strings.ToValidUTF8(string(d.pending[:end]), string(utf8.RuneError))
+	d.pending = append(d.pending[:0], d.pending[end:]...)
+
+	return text
+}
+
+// Flush returns bytes left from incomplete char, they are replaced with U+FFFD since the char never completed
+func (d *Detokenizer) Flush() string {
+	text := strings.ToValidUTF8(string(d.pending), string(utf8.RuneError))
+	d.pending = d.pending[:0]
+	return text
+}
+
+// ---- Byte-level BPE Tokenizer
+
+// Pre-tokenization patterns splitting the text into words before merges
+// Go regexp has no lookahead, so \s+(?!\S) is emulated by BPE itself, see NewBPE
+const (
+	BPE_PATTERN_GPT2   = `'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+`
+	BPE_PATTERN_LLAMA3 = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+)
+
+// the only lookahead pre-tokenizers use: whitespaces not followed by anything but whitespaces
+const bpeLookahead = `\s+(?!\S)`
+
+// BPE merges pairs of symbols by their ranks within the list of merges, the earliest merge wins
+// Merges never cross the words produced by pre-tokenization
+// Vocab tokens and merges are expected as raw bytes, not the printable chars GPT-2 maps bytes into
+type BPE struct {
+	CharLevel bool // merges start from utf8 chars instead of bytes, like BPE models of HF made from SentencePiece ones
+
+	ranks   map[[2]string]int
+	pattern *regexp.Regexp
+	trailer int // index of the regexp group standing for the lookahead, zero if there is none
+}
+
+// NewBPE creates the tokenizer from merges in the order of their ranks and pre-tokenization regexp
+// The empty pattern means the whole text is a single word
+func NewBPE(merges [][2]string, pattern string) (*BPE, error) {
+
+	bpe := &BPE{
+		ranks: make(map[[2]string]int, len(merges)),
+	}
+
+	for rank, merge := range merges {
+		if _, ok := bpe.ranks[merge]; !ok {
+			bpe.ranks[merge] = rank
+		}
+	}
+
+	if pattern == "" {
+		return bpe, nil
+	}
+
+	// the lookahead keeps the last whitespace for the next word when the run is followed by something else,
+	// so it's matched as a group and the last rune is given back after the match
+	pattern = strings.Replace(pattern, bpeLookahead, `(?P<trailer>\s+)`, 1)
+
+	re, err := regexp.Compile(`^(?:` + pattern + `)`)
+	if err != nil {
+		return nil, fmt.Errorf("wrong pre-tokenization pattern: %w", err)
+	}
+
+	bpe.pattern = re
+	if index := re.SubexpIndex("trailer"); index > 0 {
+		bpe.trailer = index
+	}
+
+	return bpe, nil
+}
+
+// Words splits the text with pre-tokenization pattern
+// The text not matched at all becomes words of single runes
+func (bpe *BPE) Words(text string) []string {
+
+	words := make([]string, 0)
+
+	if bpe.pattern == nil {
+		if len(text) > 0 {
+			words = append(words, text)
+		}
+		return words
+	}
+
+	for len(text) > 0 {
+
+		match := bpe.pattern.FindStringSubmatchIndex(text)
+
+		size := 0
+		if match != nil {
+			size = match[1]
+		}
+
+		// \s+(?!\S) matched the run followed by non-space, so give back the last whitespace
+		if bpe.trailer > 0 && match != nil && match[2*bpe.trailer] >= 0 && size < len(text) {
+			if r, _ := utf8.DecodeRuneInString(text[size:]); !unicode.IsSpace(r) {
+				_, last := utf8.DecodeLastRuneInString(text[:size])
+				if size > last {
+					size -= last
+				}
+			}
+		}
+
+		if size == 0 {
+			_, size = utf8.DecodeRuneInString(text)
+		}
+
+		words = append(words, text[:size])
+		text = text[size:]
+	}
+
+	return words
+}
+
+// Tokenize splits the text into words and then merges bytes of each one with the best ranked merges
+func (bpe *BPE) Tokenize(vocab *Vocab, text string) []uint32 {
+
+	output := make([]uint32, 0)
+
+	for _, word := range bpe.Words(text) {
+
+		symbols := make([]Symbol, 0, len(word))
+		workQueue := make(BigramQueue, 0)
+
+		// byte-level BPE starts from single bytes, not utf8 chars
+		for offs := 0; offs < len(word); {
+			size := 1
+			if bpe.CharLevel {
+				_, size = utf8.DecodeRuneInString(word[offs:])
+			}
+			index := len(symbols)
+			symbols = append(symbols, Symbol{Prev: index - 1, Next: index + 1, Text: word[offs:], N: uint32(size)})
+			offs += size
+		}
+		symbols[len(symbols)-1].Next = -1
+
+		for i := 1; i < len(symbols); i++ {
+			bpe.tryAddMerge(symbols, &workQueue, i-1, i)
+		}
+
+		for len(workQueue) > 0 {
+			bigram := PopMax(&workQueue)
+
+			leftSym := &symbols[bigram.Left]
+			rightSym := &symbols[bigram.Right]
+
+			// if one of the symbols already got merged, skip it
+			if leftSym.N == 0 || rightSym.N == 0 || leftSym.N+rightSym.N != bigram.Size {
+				continue
+			}
+
+			leftSym.N += rightSym.N
+			rightSym.N = 0
+
+			leftSym.Next = rightSym.Next
+			if rightSym.Next >= 0 {
+				symbols[rightSym.Next].Prev = bigram.Left
+			}
+
+			bpe.tryAddMerge(symbols, &workQueue, leftSym.Prev, bigram.Left)
+			bpe.tryAddMerge(symbols, &workQueue, bigram.Left, leftSym.Next)
+		}
+
+		for i := 0; i != -1; i = symbols[i].Next {
+			symbol := symbols[i]
+
+			if id, ok := vocab.Token2ID[symbol.Text[:symbol.N]]; ok {
+				output = append(output, id)
+				continue
+			}
+
+			// merged symbols missing within vocab are output as single bytes,
+			// the run of bytes without tokens turns into the single unknown token so no text is lost silently
+			unknown := false
+			for j := uint32(0); j < symbol.N; j++ {
+				if id, ok := vocab.Token2ID[symbol.Text[j:j+1]]; ok {
+					output = append(output, id)
+					unknown = false
+					continue
+				}
+				if !unknown && vocab.UNK != TOKEN_NONE {
+					output = append(output, vocab.UNK)
+					unknown = true
+				}
+			}
+		}
+	}
+
+	return output
+}
+
+// tryAddMerge queues the merge of two neighbour symbols if there is one, lower ranks get higher scores
+func (bpe *BPE) tryAddMerge(symbols []Symbol, workQueue *BigramQueue, left, right int) {
+
+	if left == -1 || right == -1 {
+		return
+	}
+
+	pair := [2]string{symbols[left].Text[:symbols[left].N], symbols[right].Text[:symbols[right].N]}
+	rank, ok := bpe.ranks[pair]
+	if !ok {
+		return
+	}
+
+	bigram := Bigram{Left: left, Right: right, Score: -float32(rank), Size: symbols[left].N + symbols[right].N}
+	heap.Push(workQueue, bigram)
+}
@@ -0,0 +1,230 @@
+package ml
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testAlphabet = "abcdefgh "
+
+// testVocab has all strings up to 3 chars of the alphabet, scores take only a few values so most of them tie
+func testVocab() *Vocab {
+
+	tokens := []string{""}
+	for size := 1; size <= 3; size++ {
+		for _, prefix := range tokens {
+			if len(prefix) != size-1 {
+				continue
+			}
+			for _, char := range testAlphabet {
+				tokens = append(tokens, prefix+string(char))
+			}
+		}
+	}
+	tokens = tokens[1:]
+
+	vocab := NewVocab(uint32(len(tokens)))
+	for id, token := range tokens {
+		vocab.ID2Token[id] = TokenScore{Token: token, Score: -float32(id % 3)}
+		vocab.Token2ID[token] = uint32(id)
+	}
+
+	return vocab
+}
+
+// testBPE merges pairs of chars first and then the pairs with one more char
+func testBPE(tb testing.TB) *BPE {
+
+	var merges [][2]string
+	for _, a := range testAlphabet {
+		for _, b := range testAlphabet {
+			merges = append(merges, [2]string{string(a), string(b)})
+		}
+	}
+	for _, pair := range merges[:len(merges):len(merges)] {
+		for _, c := range testAlphabet {
+			merges = append(merges, [2]string{pair[0] + pair[1], string(c)})
+		}
+	}
+
+	bpe, err := NewBPE(merges, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return bpe
+}
+
+func testText(rnd *rand.Rand, size int) string {
+	var text strings.Builder
+	for i := 0; i < size; i++ {
+		text.WriteByte(testAlphabet[rnd.Intn(len(testAlphabet))])
+	}
+	return text.String()
+}
+
+// popMaxLinear is PopMax as it was before the heap, it scans the whole queue for the best bigram
+func popMaxLinear(queue *BigramQueue) Bigram {
+
+	max := 0 // index of max score element in queue
+	for cur := 1; cur < len(*queue); cur++ {
+		if ((*queue)[max].Score < (*queue)[cur].Score) ||
+			((*queue)[max].Score == (*queue)[cur].Score &&
+				(*queue)[max].Left > (*queue)[cur].Left) {
+			max = cur
+		}
+	}
+
+	pop := (*queue)[max]
+
+	// replace max element with last and shrink slice (if max == last, then just remove it)
+	(*queue)[max] = (*queue)[len(*queue)-1]
+	*queue = (*queue)[:len(*queue)-1]
+
+	return pop
+}
+
+// tokenizeLinear is SentencePiece.Tokenize merging bigrams in the order popMaxLinear gives
+func tokenizeLinear(vocab *Vocab, text string) []uint32 {
+
+	var symbols []Symbol
+	for offs := 0; offs < len(text); offs++ {
+		symbols = append(symbols, Symbol{Prev: offs - 1, Next: offs + 1, Text: text[offs:], N: 1})
+	}
+	symbols[len(symbols)-1].Next = -1
+
+	var workQueue BigramQueue
+	for i := 1; i < len(symbols); i++ {
+		TryAddBigram(vocab, symbols, &workQueue, i-1, i)
+	}
+
+	for len(workQueue) > 0 {
+		bigram := popMaxLinear(&workQueue)
+
+		leftSym := &symbols[bigram.Left]
+		rightSym := &symbols[bigram.Right]
+
+		if leftSym.N == 0 || rightSym.N == 0 || leftSym.N+rightSym.N != bigram.Size {
+			continue
+		}
+
+		leftSym.N += rightSym.N
+		rightSym.N = 0
+
+		leftSym.Next = rightSym.Next
+		if rightSym.Next >= 0 {
+			symbols[rightSym.Next].Prev = bigram.Left
+		}
+
+		TryAddBigram(vocab, symbols, &workQueue, leftSym.Prev, bigram.Left)
+		TryAddBigram(vocab, symbols, &workQueue, bigram.Left, leftSym.Next)
+	}
+
+	var output []uint32
+	for i := 0; i != -1; i = symbols[i].Next {
+		output = append(output, vocab.Token2ID[symbols[i].Text[:symbols[i].N]])
+	}
+
+	return output
+}
+
+// linearTokenizer makes tokenizeLinear a Tokenizer for benchmarks
+type linearTokenizer struct{}
+
+func (linearTokenizer) Tokenize(vocab *Vocab, text string) []uint32 {
+	return tokenizeLinear(vocab, text)
+}
+
+func TestPopMaxTies(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+
+	// pushes and pops interleaved the way tokenizers do them, scores and positions tie a lot
+	for round := 0; round < 100; round++ {
+
+		var queue, linear BigramQueue
+
+		for step := 0; step < 1000; step++ {
+
+			if rnd.Intn(3) > 0 || len(queue) == 0 {
+				left := rnd.Intn(20)
+				bigram := Bigram{Left: left, Right: left + 1, Score: -float32(rnd.Intn(3)), Size: 2}
+				heap.Push(&queue, bigram)
+				linear = append(linear, bigram)
+				continue
+			}
+
+			got, want := PopMax(&queue), popMaxLinear(&linear)
+			if got.Score != want.Score || got.Left != want.Left {
+				t.Fatalf("round %d step %d: popped %+v, want %+v", round, step, got, want)
+			}
+		}
+	}
+}
+
+func TestTokenizeTies(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+	vocab := testVocab()
+
+	for i := 0; i < 300; i++ {
+		text := testText(rnd, 1+rnd.Intn(200))
+		if got, want := (SentencePiece{}).Tokenize(vocab, text), tokenizeLinear(vocab, text); !reflect.DeepEqual(got, want) {
+			t.Fatalf("'%s' is %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestTokenizeBPEUnknown(t *testing.T) {
+
+	vocab := testVocab()
+	vocab.Tokenizer = testBPE(t)
+
+	ab, c := vocab.Token2ID["ab"], vocab.Token2ID["c"]
+
+	for _, test := range []struct {
+		name string
+		unk  uint32
+		want []uint32
+	}{
+		{"Unknown", 1000, []uint32{ab, 1000, 1000, c}}, // x and y are never merged, so each of them is unknown
+		{"None", TOKEN_NONE, []uint32{ab, c}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			vocab.UNK = test.unk
+			if got := vocab.Tokenizer.Tokenize(vocab, "abxyc"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("'abxyc' is %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func benchmarkTokenize(b *testing.B, vocab *Vocab, tokenizer Tokenizer) {
+	for _, size := range []int{1000, 4000, 16000, 64000} {
+		text := testText(rand.New(rand.NewSource(1)), size)
+		b.Run(fmt.Sprintf("%dk", size/1000), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				tokenizer.Tokenize(vocab, text)
+			}
+		})
+	}
+}
+
+func BenchmarkTokenizeSentencePiece(b *testing.B) {
+	benchmarkTokenize(b, testVocab(), SentencePiece{})
+}
+
+// BenchmarkTokenizeLinear is the baseline for BenchmarkTokenizeSentencePiece, bigrams are found by the scan of the whole queue
+func BenchmarkTokenizeLinear(b *testing.B) {
+	benchmarkTokenize(b, testVocab(), linearTokenizer{})
+}
+
+func BenchmarkTokenizeBPE(b *testing.B) {
+	vocab := testVocab()
+	vocab.Tokenizer = testBPE(b)
+	benchmarkTokenize(b, vocab, vocab.Tokenizer)
+}
@@ -30,6 +30,7 @@ type Job struct {
 	ID         string
 	Status     string
 	Prompt     string
+	Adapter    string // name of LoRA adapter from Adapters, empty for the base model
 	Output     string
 	CreatedAt  int64
 	StartedAt  int64
@@ -46,6 +47,8 @@ var (
 	Ctx    *llama.Context
 	Params *llama.ModelParams
 
+	Adapters map[string]*llama.Adapter // LoRA adapters loaded on start, jobs choose them by name
+
 	MaxPods     int64
 	RunningPods int64 // number of pods running right now in parallel
 
@@ -117,11 +120,15 @@ func Do(jobID string) {
 	mu.Lock()
 	Jobs[jobID].StartedAt = time.Now().Unix()
 	prompt := " " + Jobs[jobID].Prompt // add a space to match LLaMA tokenizer behavior
+	adapter := Jobs[jobID].Adapter
 	mu.Unlock()
 
 	// tokenize the prompt
 	embdPrompt := ml.Tokenize(Vocab, prompt, true)
 
+	// output is streamed by parts of valid UTF-8 text, not by tokens
+	detokenizer := ml.NewDetokenizer(Vocab)
+
 	// ring buffer for last N tokens
 	lastNTokens := ring.New(int(Params.CtxSize))
 
@@ -148,6 +155,9 @@ func Do(jobID string) {
 
 	// new context opens sync channel and starts workers for tensor compute
 	ctx := llama.NewContext(Model, Params)
+	if adapter != "" {
+		ctx.Adapters = []*llama.Adapter{Adapters[adapter]}
+	}
 
 	for remainedCount > 0 {
 
@@ -227,7 +237,7 @@ func Do(jobID string) {
 		for _, id := range embd {
 
 			tokenCounter++
-			token := ml.Token2Str(Vocab, id) // TODO: Simplify
+			token := detokenizer.Decode(id)
 
 			mu.Lock()
 			Jobs[jobID].Output += token
@@ -239,6 +249,7 @@ func Do(jobID string) {
 	ctx.ReleaseContext()
 
 	mu.Lock()
+	Jobs[jobID].Output += detokenizer.Flush()
 	Jobs[jobID].FinishedAt = time.Now().Unix()
 	Jobs[jobID].Output = strings.Trim(Jobs[jobID].Output, "\n ")
 	Jobs[jobID].Status = "finished"
@@ -278,7 +289,7 @@ func Do(jobID string) {
 
 // --- Place new job into queue
 
-func PlaceJob(jobID, prompt string) {
+func PlaceJob(jobID, prompt, adapter string) {
 
 	timing := time.Now().Unix()
 
@@ -287,6 +298,7 @@ func PlaceJob(jobID, prompt string) {
 	Jobs[jobID] = &Job{
 		ID:        jobID,
 		Prompt:    prompt,
+		Adapter:   adapter,
 		Status:    "queued",
 		CreatedAt: timing,
 	}
@@ -300,14 +312,16 @@ func PlaceJob(jobID, prompt string) {
 //
 //	{
 //	    "id": "5fb8ebd0-e0c9-4759-8f7d-35590f6c9fcb",
-//	    "prompt": "Why Golang is so popular?"
+//	    "prompt": "Why Golang is so popular?",
+//	    "adapter": "golang" // optional name of LoRA adapter
 //	}
 
 func NewJob(ctx *fiber.Ctx) error {
 
 	payload := struct {
-		ID     string `json:"id"`
-		Prompt string `json:"prompt"`
+		ID      string `json:"id"`
+		Prompt  string `json:"prompt"`
+		Adapter string `json:"adapter"`
 	}{}
 
 	if err := ctx.BodyParser(&payload); err != nil {
@@ -333,14 +347,21 @@ func NewJob(ctx *fiber.Ctx) error {
 			SendString(fmt.Sprintf("Prompt length %d is more than allowed %d chars!", len(payload.Prompt), Params.CtxSize))
 	}
 
+	if _, ok := Adapters[payload.Adapter]; payload.Adapter != "" && !ok {
+		return ctx.
+			Status(fiber.StatusBadRequest).
+			SendString(fmt.Sprintf("Unknown adapter %s!", payload.Adapter))
+	}
+
 	// TODO: Tokenize and check for max tokens
 
-	PlaceJob(payload.ID, payload.Prompt)
+	PlaceJob(payload.ID, payload.Prompt, payload.Adapter)
 
 	// TODO: Guard with mutex
 	return ctx.JSON(fiber.Map{
 		"id":      payload.ID,
 		"prompt":  payload.Prompt,
+		"adapter": payload.Adapter,
 		"created": Jobs[payload.ID].CreatedAt,
 		//"started":  Jobs[payload.ID].StartedAt,
 		//"finished": Jobs[payload.ID].FinishedAt,
@@ -396,6 +417,7 @@ func GetJob(ctx *fiber.Ctx) error {
 	return ctx.JSON(fiber.Map{
 		"id":       id,
 		"prompt":   Jobs[id].Prompt,
+		"adapter":  Jobs[id].Adapter,
 		"output":   Jobs[id].Output,
 		"created":  Jobs[id].CreatedAt,
 		"started":  Jobs[id].StartedAt,
@@ -128,3 +128,36 @@ void _mm256_dot(float *a, float *b, int64_t n, float *ret)
         *ret += a[i] * b[i];
     }
 }
+
+void _mm256_dot_q8(void *a, float *b, int64_t n, float *ret)
+{
+    // a is the sequence of Q8_0 blocks: float d; int8_t qs[32]
+    uint8_t *x = (uint8_t *)a;
+    int blocks = n / 32;
+    __m256 s = _mm256_setzero_ps();
+    for (int i = 0; i < blocks; i++)
+    {
+        __m256 d = _mm256_broadcast_ss((float *)x);
+        __m256 q0 = _mm256_cvtepi32_ps(_mm256_cvtepi8_epi32(_mm_loadl_epi64((__m128i *)(x + 4))));
+        __m256 q1 = _mm256_cvtepi32_ps(_mm256_cvtepi8_epi32(_mm_loadl_epi64((__m128i *)(x + 12))));
+        __m256 q2 = _mm256_cvtepi32_ps(_mm256_cvtepi8_epi32(_mm_loadl_epi64((__m128i *)(x + 20))));
+        __m256 q3 = _mm256_cvtepi32_ps(_mm256_cvtepi8_epi32(_mm_loadl_epi64((__m128i *)(x + 28))));
+        __m256 v = _mm256_mul_ps(q0, _mm256_loadu_ps(b));
+        v = _mm256_add_ps(_mm256_mul_ps(q1, _mm256_loadu_ps(b + 8)), v);
+        v = _mm256_add_ps(_mm256_mul_ps(q2, _mm256_loadu_ps(b + 16)), v);
+        v = _mm256_add_ps(_mm256_mul_ps(q3, _mm256_loadu_ps(b + 24)), v);
+        s = _mm256_add_ps(_mm256_mul_ps(d, v), s);
+        x += 36;
+        b += 32;
+    }
+    __m128 s7_6_5_4 = _mm256_extractf128_ps(s, 1);
+    __m128 s3_2_1_0 = _mm256_castps256_ps128(s);
+    __m128 s37_26_15_04 = _mm_add_ps(s7_6_5_4, s3_2_1_0);
+    __m128 sxx_15_04 = s37_26_15_04;
+    __m128 sxx_37_26 = _mm_movehl_ps(s37_26_15_04, s37_26_15_04);
+    const __m128 sxx_1357_0246 = _mm_add_ps(sxx_15_04, sxx_37_26);
+    const __m128 sxxx_0246 = sxx_1357_0246;
+    const __m128 sxxx_1357 = _mm_shuffle_ps(sxx_1357_0246, sxx_1357_0246, 0x1);
+    __m128 sxxx_01234567 = _mm_add_ss(sxxx_0246, sxxx_1357);
+    *ret = _mm_cvtss_f32(sxxx_01234567);
+}
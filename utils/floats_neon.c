@@ -105,3 +105,31 @@ void vdot(float *a, float *b, long n, float* ret) {
         *ret += a[i] * b[i];
     }
 }
+
+void vdot_q8(void *a, float *b, long n, float* ret) {
+    // a is the sequence of Q8_0 blocks: float d; int8_t qs[32]
+    uint8_t *x = (uint8_t *)a;
+    int blocks = n / 32;
+    float32x4_t s = vdupq_n_f32(0);
+    for (int i = 0; i < blocks; i++) {
+        float d = *(float *)x;
+        int8x16_t q0 = vld1q_s8((int8_t *)(x + 4));
+        int8x16_t q1 = vld1q_s8((int8_t *)(x + 20));
+        int16x8_t h0 = vmovl_s8(vget_low_s8(q0));
+        int16x8_t h1 = vmovl_high_s8(q0);
+        int16x8_t h2 = vmovl_s8(vget_low_s8(q1));
+        int16x8_t h3 = vmovl_high_s8(q1);
+        float32x4_t v = vmulq_f32(vcvtq_f32_s32(vmovl_s16(vget_low_s16(h0))), vld1q_f32(b));
+        v = vmlaq_f32(v, vcvtq_f32_s32(vmovl_high_s16(h0)), vld1q_f32(b + 4));
+        v = vmlaq_f32(v, vcvtq_f32_s32(vmovl_s16(vget_low_s16(h1))), vld1q_f32(b + 8));
+        v = vmlaq_f32(v, vcvtq_f32_s32(vmovl_high_s16(h1)), vld1q_f32(b + 12));
+        v = vmlaq_f32(v, vcvtq_f32_s32(vmovl_s16(vget_low_s16(h2))), vld1q_f32(b + 16));
+        v = vmlaq_f32(v, vcvtq_f32_s32(vmovl_high_s16(h2)), vld1q_f32(b + 20));
+        v = vmlaq_f32(v, vcvtq_f32_s32(vmovl_s16(vget_low_s16(h3))), vld1q_f32(b + 24));
+        v = vmlaq_f32(v, vcvtq_f32_s32(vmovl_high_s16(h3)), vld1q_f32(b + 28));
+        s = vmlaq_n_f32(s, v, d);
+        x += 36;
+        b += 32;
+    }
+    *ret = vaddvq_f32(s);
+}